@@ -0,0 +1,102 @@
+// Package auth verifies account passwords stored in the configuration,
+// either as plain text or as bcrypt or argon2 hashes.
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Hash is a parsed PHC-format argon2 hash:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2Hash struct {
+	variant string // "argon2id" or "argon2i"
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// ValidateHash checks that a stored password hash is well-formed. Plain-text
+// passwords are always valid.
+func ValidateHash(stored string) error {
+	switch {
+	case isBcrypt(stored):
+		if _, err := bcrypt.Cost([]byte(stored)); err != nil {
+			return fmt.Errorf("auth: invalid bcrypt hash: %w", err)
+		}
+	case strings.HasPrefix(stored, "$argon2"):
+		if _, err := parseArgon2(stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckPassword reports whether password matches the stored password or hash.
+func CheckPassword(stored, password string) bool {
+	switch {
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2"):
+		h, err := parseArgon2(stored)
+		if err != nil {
+			return false
+		}
+		var key []byte
+		if h.variant == "argon2id" {
+			key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		} else {
+			key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		}
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+func isBcrypt(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+func parseArgon2(s string) (*argon2Hash, error) {
+	// "", variant, version, params, salt, key
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("auth: invalid argon2 hash: expected 5 fields")
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return nil, fmt.Errorf("auth: unsupported argon2 variant %q", h.variant)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("auth: invalid argon2 version %q: %w", parts[2], err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("auth: unsupported argon2 version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("auth: invalid argon2 parameters %q: %w", parts[3], err)
+	}
+	if h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("auth: invalid argon2 parameters %q", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("auth: invalid argon2 salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("auth: invalid argon2 key: %w", err)
+	}
+	if len(h.key) == 0 {
+		return nil, fmt.Errorf("auth: invalid argon2 key: empty")
+	}
+	return h, nil
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+// Hashes of "secret": bcrypt at the minimum cost, and argon2 with tiny
+// parameters (m=64 KiB, t=1, p=1) so the tests stay fast.
+const (
+	bcryptSecret   = "$2a$04$kRXVCBM7WeE0JV1VzBfZtua0Ttyb6Db/3ShWSq1XAk/ODdBXWfs3O"
+	argon2idSecret = "$argon2id$v=19$m=64,t=1,p=1$b3Bkcy1zYWx0LTEyMzQ1Ng$fUylqEPo1qZx209zvWcIIkF2kLHQcF4jGNOVga7bnZE"
+	argon2iSecret  = "$argon2i$v=19$m=64,t=1,p=1$b3Bkcy1zYWx0LTEyMzQ1Ng$TzxgbLvK9Sme8XW9C7gPAhBvu9yIlgRSS2J/CU1CRkA"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"plain text", "secret", "secret", true},
+		{"plain text wrong", "secret", "Secret", false},
+		{"plain text empty", "secret", "", false},
+		{"bcrypt", bcryptSecret, "secret", true},
+		{"bcrypt wrong", bcryptSecret, "wrong", false},
+		{"bcrypt 2b prefix", "$2b$" + bcryptSecret[4:], "secret", true},
+		{"bcrypt truncated", bcryptSecret[:30], "secret", false},
+		{"argon2id", argon2idSecret, "secret", true},
+		{"argon2id wrong", argon2idSecret, "wrong", false},
+		{"argon2i", argon2iSecret, "secret", true},
+		{"argon2i hash as argon2id", strings.Replace(argon2iSecret, "argon2i$", "argon2id$", 1), "secret", false},
+		{"argon2 malformed", "$argon2id$v=19$m=64,t=1,p=1$salt", "secret", false},
+		{"argon2 hash is not a plain password", argon2idSecret, argon2idSecret, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckPassword(tt.stored, tt.password); got != tt.want {
+				t.Errorf("CheckPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHash(t *testing.T) {
+	salt, key := "b3Bkcy1zYWx0LTEyMzQ1Ng", "fUylqEPo1qZx209zvWcIIkF2kLHQcF4jGNOVga7bnZE"
+	tests := []struct {
+		name    string
+		stored  string
+		wantErr string
+	}{
+		{"plain text", "secret", ""},
+		{"bcrypt", bcryptSecret, ""},
+		{"bcrypt bad cost", "$2a$99$" + bcryptSecret[7:], "invalid bcrypt hash"},
+		{"bcrypt truncated", bcryptSecret[:20], "invalid bcrypt hash"},
+		{"argon2id", argon2idSecret, ""},
+		{"argon2i", argon2iSecret, ""},
+		{"missing fields", "$argon2id$v=19$m=64,t=1,p=1$" + salt, "expected 5 fields"},
+		{"unknown variant", "$argon2d$v=19$m=64,t=1,p=1$" + salt + "$" + key, "unsupported argon2 variant"},
+		{"bad version", "$argon2id$version$m=64,t=1,p=1$" + salt + "$" + key, "invalid argon2 version"},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key, "unsupported argon2 version"},
+		{"bad parameters", "$argon2id$v=19$memory=64$" + salt + "$" + key, "invalid argon2 parameters"},
+		{"zero time", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, "invalid argon2 parameters"},
+		{"zero threads", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, "invalid argon2 parameters"},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$not*base64$" + key, "invalid argon2 salt"},
+		{"padded salt", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "==$" + key, "invalid argon2 salt"},
+		{"bad key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$not*base64", "invalid argon2 key"},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", "invalid argon2 key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHash(tt.stored)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("ValidateHash = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("ValidateHash = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+// Package blobcache is a content-addressed disk cache for proxied downloads
+// and cover images. Blobs are stored once per SHA-256 of their content and
+// looked up by source and key (usually the upstream URL), so the same cover
+// served by several sources takes disk space only once, while one source's
+// keys never resolve to files stored for another. The total size is
+// bounded; least-recently-used keys are evicted first.
+//
+// The index is written to disk a few seconds after it changes, batching the
+// changes made meanwhile, and on Close. After a crash the cache only loses
+// what changed since the last write: blobs the index does not know about are
+// removed, and entries whose blob is gone are dropped.
+package blobcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	indexFile  = "index.json"
+	objectsDir = "objects"
+
+	// saveDelay is how long index changes are collected before the index is
+	// written.
+	saveDelay = 5 * time.Second
+)
+
+// Entry describes a cached blob.
+type Entry struct {
+	Hash        string      `json:"hash"` // hex SHA-256 of the content
+	ContentType string      `json:"content_type"`
+	Header      http.Header `json:"header,omitempty"` // upstream headers to replay when serving
+	Size        int64       `json:"size"`
+	AccessedAt  time.Time   `json:"accessed_at"`
+}
+
+// Cache is a size-bounded, content-addressed blob cache rooted at a directory.
+type Cache struct {
+	dir     string
+	maxSize int64
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*Entry // key → entry
+	refs    map[string]int    // content hash → number of keys pointing at it
+	size    int64             // bytes of distinct blobs on disk
+	dirty   bool              // entries changed since the index was last written
+	save    *time.Timer       // pending index write, if any
+	closed  bool
+
+	saveMu sync.Mutex // serializes index writes
+}
+
+// New opens (or creates) a cache in dir holding at most maxSize bytes.
+// The index from a previous run is reloaded; entries whose blob is missing
+// and blobs no entry refers to are discarded.
+func New(dir string, maxSize int64, logger *slog.Logger) (*Cache, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := os.MkdirAll(filepath.Join(dir, objectsDir), 0o755); err != nil {
+		return nil, fmt.Errorf("blobcache: create %s: %w", dir, err)
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		logger:  logger,
+		entries: make(map[string]*Entry),
+		refs:    make(map[string]int),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Open returns the blob source cached for key, opened for reading, and marks
+// it as recently used. The caller must close the file.
+func (c *Cache) Open(source, key string) (*os.File, Entry, bool) {
+	key = indexKey(source, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, Entry{}, false
+	}
+	f, err := os.Open(c.objectPath(e.Hash))
+	if err != nil {
+		c.logger.Warn("cached blob unreadable, dropping", "key", key, "error", err)
+		c.removeLocked(key)
+		return nil, Entry{}, false
+	}
+	e.AccessedAt = time.Now()
+	c.changedLocked()
+	return f, *e, true
+}
+
+// Size returns the total bytes of blobs currently stored.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Create starts writing a new blob for source under key. header holds
+// response headers to keep alongside it. Data written to the returned Writer
+// is only visible to Open after Commit.
+func (c *Cache) Create(source, key, contentType string, header http.Header) (*Writer, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, objectsDir), "blob-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("blobcache: create temp file: %w", err)
+	}
+	return &Writer{
+		c:           c,
+		key:         indexKey(source, key),
+		contentType: contentType,
+		header:      header,
+		tmp:         tmp,
+		hash:        sha256.New(),
+	}, nil
+}
+
+// Writer streams a blob into the cache.
+type Writer struct {
+	c           *Cache
+	key         string
+	contentType string
+	header      http.Header
+	tmp         *os.File
+	hash        hash.Hash
+	size        int64
+	done        bool
+}
+
+// Write appends p to the blob.
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Abort discards the blob. It is safe to call after Commit.
+func (w *Writer) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// Commit stores the blob under its content hash, points the key at it and
+// evicts least-recently-used keys until the cache fits its size limit.
+// Blobs larger than the whole cache are discarded.
+func (w *Writer) Commit() error {
+	if w.done {
+		return errors.New("blobcache: writer already closed")
+	}
+	w.done = true
+	defer os.Remove(w.tmp.Name())
+	if err := w.tmp.Close(); err != nil {
+		return fmt.Errorf("blobcache: write %q: %w", w.key, err)
+	}
+
+	c := w.c
+	if w.size > c.maxSize {
+		return nil
+	}
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[w.key]; ok {
+		if old.Hash == sum {
+			old.ContentType = w.contentType
+			old.Header = w.header
+			old.AccessedAt = time.Now()
+			c.changedLocked()
+			return nil
+		}
+		c.removeLocked(w.key)
+	}
+	if c.refs[sum] == 0 {
+		path := c.objectPath(sum)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("blobcache: create object dir: %w", err)
+		}
+		if err := os.Rename(w.tmp.Name(), path); err != nil {
+			return fmt.Errorf("blobcache: commit %q: %w", w.key, err)
+		}
+		c.size += w.size
+	}
+	c.entries[w.key] = &Entry{
+		Hash:        sum,
+		ContentType: w.contentType,
+		Header:      w.header,
+		Size:        w.size,
+		AccessedAt:  time.Now(),
+	}
+	c.refs[sum]++
+
+	c.evictLocked()
+	c.changedLocked()
+	return nil
+}
+
+// changedLocked marks the index as changed and schedules writing it.
+func (c *Cache) changedLocked() {
+	c.dirty = true
+	if c.save == nil && !c.closed {
+		c.save = time.AfterFunc(saveDelay, func() {
+			if err := c.flush(); err != nil {
+				c.logger.Warn("failed to write download cache index", "dir", c.dir, "error", err)
+			}
+		})
+	}
+}
+
+// flush writes the index if it changed since it was last written.
+func (c *Cache) flush() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	c.save = nil
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("blobcache: encode index: %w", err)
+	}
+	if err := c.writeIndex(data); err != nil {
+		c.mu.Lock()
+		c.changedLocked()
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close writes pending index changes. The cache must not be used afterwards.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	if c.save != nil {
+		c.save.Stop()
+	}
+	c.mu.Unlock()
+	return c.flush()
+}
+
+// evictLocked drops least-recently-used keys until the cache fits maxSize.
+func (c *Cache) evictLocked() {
+	if c.size <= c.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].AccessedAt.Before(c.entries[keys[j]].AccessedAt)
+	})
+	evicted := 0
+	for _, k := range keys {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.removeLocked(k)
+		evicted++
+	}
+	c.logger.Debug("evicted cached blobs", "count", evicted, "size", c.size, "max_size", c.maxSize)
+}
+
+// removeLocked drops a key, deleting its blob once no key refers to it.
+func (c *Cache) removeLocked(key string) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	delete(c.entries, key)
+	c.changedLocked()
+	c.refs[e.Hash]--
+	if c.refs[e.Hash] > 0 {
+		return
+	}
+	delete(c.refs, e.Hash)
+	c.size -= e.Size
+	if err := os.Remove(c.objectPath(e.Hash)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logger.Warn("failed to remove cached blob", "hash", e.Hash, "error", err)
+	}
+}
+
+// indexKey is the key of a source's blob in the index.
+func indexKey(source, key string) string {
+	return source + "\x00" + key
+}
+
+func (c *Cache) objectPath(sum string) string {
+	return filepath.Join(c.dir, objectsDir, sum[:2], sum)
+}
+
+// writeIndex writes the encoded index atomically (temp file + rename).
+func (c *Cache) writeIndex(data []byte) error {
+	tmp, err := os.CreateTemp(c.dir, indexFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("blobcache: create temp index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("blobcache: write index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("blobcache: write index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, indexFile)); err != nil {
+		return fmt.Errorf("blobcache: commit index: %w", err)
+	}
+	return nil
+}
+
+// load reads the index left by a previous run and removes stray files.
+func (c *Cache) load() error {
+	data, err := os.ReadFile(filepath.Join(c.dir, indexFile))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("blobcache: read index: %w", err)
+	default:
+		var entries map[string]*Entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			c.logger.Warn("discarding unreadable download cache index", "error", err)
+		}
+		for key, e := range entries {
+			if len(e.Hash) < 2 {
+				continue
+			}
+			if _, err := os.Stat(c.objectPath(e.Hash)); err != nil {
+				continue
+			}
+			c.entries[key] = e
+			if c.refs[e.Hash] == 0 {
+				c.size += e.Size
+			}
+			c.refs[e.Hash]++
+		}
+	}
+
+	// Remove interrupted writes and blobs that no entry refers to.
+	root := filepath.Join(c.dir, objectsDir)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if c.refs[d.Name()] == 0 {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("blobcache: scan %s: %w", root, err)
+	}
+
+	c.evictLocked()
+	c.logger.Info("download cache loaded", "dir", c.dir, "entries", len(c.entries), "size", c.size)
+	return nil
+}
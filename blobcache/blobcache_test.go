@@ -0,0 +1,145 @@
+package blobcache
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newCache(t *testing.T, dir string, maxSize int64) *Cache {
+	t.Helper()
+	c, err := New(dir, maxSize, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func put(t *testing.T, c *Cache, source, key, data string) {
+	t.Helper()
+	w, err := c.Create(source, key, "text/plain", http.Header{"Etag": {`"` + data + `"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the blob cached for key, or "" if there is none.
+func get(t *testing.T, c *Cache, source, key string) string {
+	t.Helper()
+	f, _, ok := c.Open(source, key)
+	if !ok {
+		return ""
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestEviction(t *testing.T) {
+	c := newCache(t, t.TempDir(), 10)
+	put(t, c, "books", "a", "aaaa")
+	put(t, c, "books", "b", "bbbb")
+	get(t, c, "books", "a") // a is now more recently used than b
+	put(t, c, "books", "c", "cccc")
+
+	if got := get(t, c, "books", "b"); got != "" {
+		t.Error("least recently used blob not evicted")
+	}
+	for key, want := range map[string]string{"a": "aaaa", "c": "cccc"} {
+		if got := get(t, c, "books", key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if c.Size() != 8 {
+		t.Errorf("size = %d, want 8", c.Size())
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	c := newCache(t, t.TempDir(), 4)
+	put(t, c, "books", "big", "too large")
+	if got := get(t, c, "books", "big"); got != "" || c.Size() != 0 {
+		t.Errorf("blob larger than the cache stored: %q, size %d", got, c.Size())
+	}
+
+	// Replacing a key frees the old blob.
+	put(t, c, "books", "a", "aaaa")
+	put(t, c, "books", "a", "bbb")
+	if got := get(t, c, "books", "a"); got != "bbb" || c.Size() != 3 {
+		t.Errorf("replaced blob = %q, size %d; want bbb, 3", got, c.Size())
+	}
+}
+
+func TestSourceScopedKeys(t *testing.T) {
+	c := newCache(t, t.TempDir(), 100)
+	put(t, c, "one", "http://example.com/cover.jpg", "cover")
+
+	if got := get(t, c, "two", "http://example.com/cover.jpg"); got != "" {
+		t.Errorf("another source's blob served: %q", got)
+	}
+	// The same content stored by a second source is kept once.
+	put(t, c, "two", "http://example.com/cover.jpg", "cover")
+	if got := get(t, c, "two", "http://example.com/cover.jpg"); got != "cover" {
+		t.Errorf("second source's blob = %q", got)
+	}
+	if c.Size() != 5 {
+		t.Errorf("size = %d, want the shared blob counted once", c.Size())
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	c := newCache(t, dir, 100)
+	put(t, c, "books", "a", "aaaa")
+	put(t, c, "books", "b", "bbbb")
+
+	// Index writes are batched rather than made on every commit.
+	if _, err := os.Stat(filepath.Join(dir, indexFile)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("index written on commit: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := filepath.Join(dir, objectsDir, "ff", "ff00")
+	if err := os.MkdirAll(filepath.Dir(stray), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stray, []byte("stray"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newCache(t, dir, 100)
+	defer c.Close()
+	if got := get(t, c, "books", "a"); got != "aaaa" {
+		t.Errorf("reloaded a = %q, want aaaa", got)
+	}
+	f, e, ok := c.Open("books", "b")
+	if !ok {
+		t.Fatal("b lost on reload")
+	}
+	f.Close()
+	if e.ContentType != "text/plain" || e.Header.Get("ETag") != `"bbbb"` {
+		t.Errorf("reloaded entry = %+v", e)
+	}
+	if c.Size() != 8 {
+		t.Errorf("size = %d, want 8", c.Size())
+	}
+	if _, err := os.Stat(stray); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("blob unknown to the index not removed")
+	}
+}
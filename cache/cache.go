@@ -1,19 +1,32 @@
-// Package cache provides thread-safe in-memory feed caching.
+// Package cache provides thread-safe feed caching with optional on-disk persistence.
 package cache
 
 import (
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/metrics"
+	"github.com/madeddie/opds-aggregator/opds"
 )
 
-// FeedCache stores crawled feed trees in memory.
+// FeedCache stores crawled feed trees in memory, writing through to an
+// optional Store so the cache can be warm-started after a restart.
 type FeedCache struct {
-	mu      sync.RWMutex
-	entries map[string]*CachedFeed // keyed by source slug
-	logger  *slog.Logger
+	mu        sync.RWMutex
+	entries   map[string]*CachedFeed // keyed by source slug
+	store     Store                  // nil = memory only
+	listeners []func(slug string, cached *CachedFeed)
+	logger    *slog.Logger
+	seq       map[string]uint64      // bumped by every Put and Remove of a slug
+	saveMu    map[string]*sync.Mutex // serializes store writes per slug
+
+	memMu sync.Mutex
+	mem   *memoryIndex
+
+	gen atomic.Uint64 // bumped on every change to a cached tree
 }
 
 // CachedFeed is a single cached source.
@@ -22,26 +35,97 @@ type CachedFeed struct {
 	UpdatedAt time.Time
 }
 
-// NewFeedCache creates a new empty feed cache.
-func NewFeedCache(logger *slog.Logger) *FeedCache {
+// NewFeedCache creates a new empty feed cache. If store is nil, the cache is
+// kept in memory only.
+func NewFeedCache(logger *slog.Logger, store Store) *FeedCache {
 	if logger == nil {
 		logger = slog.Default()
 	}
 	return &FeedCache{
 		entries: make(map[string]*CachedFeed),
+		store:   store,
 		logger:  logger,
+		seq:     make(map[string]uint64),
+		saveMu:  make(map[string]*sync.Mutex),
+		mem:     newMemoryIndex(),
 	}
 }
 
-// Put stores a feed tree under the given slug.
-func (fc *FeedCache) Put(slug string, tree *crawler.FeedTree) {
+// OnChange registers fn to be called whenever a source's cached tree is
+// stored (by Put or Restore) or removed (with a nil CachedFeed). Listeners
+// run synchronously on the goroutine that changed the cache.
+func (fc *FeedCache) OnChange(fn func(slug string, cached *CachedFeed)) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	fc.entries[slug] = &CachedFeed{
+	fc.listeners = append(fc.listeners, fn)
+}
+
+func (fc *FeedCache) notify(slug string, cached *CachedFeed) {
+	fc.mu.RLock()
+	listeners := fc.listeners
+	fc.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(slug, cached)
+	}
+}
+
+// Restore loads all snapshots from the backing store into memory and returns
+// how many feeds were restored. It is a no-op for memory-only caches.
+func (fc *FeedCache) Restore() (int, error) {
+	if fc.store == nil {
+		return 0, nil
+	}
+	snapshots, err := fc.store.LoadAll()
+
+	fc.mu.Lock()
+	for slug, cached := range snapshots {
+		fc.entries[slug] = cached
+		fc.logger.Debug("feed restored from snapshot", "slug", slug, "updatedAt", cached.UpdatedAt)
+	}
+	fc.mu.Unlock()
+
+	fc.memMu.Lock()
+	for slug, cached := range snapshots {
+		fc.trackLocked(slug, cached.Tree)
+	}
+	fc.memMu.Unlock()
+	fc.gen.Add(1)
+
+	for slug, cached := range snapshots {
+		fc.notify(slug, cached)
+	}
+	return len(snapshots), err
+}
+
+// Put stores a feed tree under the given slug.
+func (fc *FeedCache) Put(slug string, tree *crawler.FeedTree) {
+	cached := &CachedFeed{
 		Tree:      tree,
 		UpdatedAt: time.Now(),
 	}
+
+	// Hold memMu across the swap so on-demand nodes added to the new tree are
+	// accounted for after it, and those added to the old one are ignored.
+	fc.memMu.Lock()
+	fc.mu.Lock()
+	fc.entries[slug] = cached
+	fc.seq[slug]++
+	seq := fc.seq[slug]
+	fc.mu.Unlock()
+	fc.trackLocked(slug, tree)
+	fc.memMu.Unlock()
+	fc.gen.Add(1)
 	fc.logger.Info("feed cached", "slug", slug)
+	fc.notify(slug, cached)
+
+	fc.persist(slug, seq, cached)
+}
+
+// Generation returns a number that changes whenever a cached tree is
+// stored, removed or grown, so results derived from the cache can be reused
+// until it does.
+func (fc *FeedCache) Generation() uint64 {
+	return fc.gen.Load()
 }
 
 // Get retrieves the cached feed tree for a slug.
@@ -63,9 +147,150 @@ func (fc *FeedCache) All() map[string]*CachedFeed {
 	return result
 }
 
-// Remove deletes a cached feed.
+// Remove deletes a cached feed and its snapshot.
 func (fc *FeedCache) Remove(slug string) {
 	fc.mu.Lock()
-	defer fc.mu.Unlock()
 	delete(fc.entries, slug)
+	fc.seq[slug]++
+	seq := fc.seq[slug]
+	fc.mu.Unlock()
+	fc.memMu.Lock()
+	fc.mem.removeSource(slug)
+	fc.memMu.Unlock()
+	fc.gen.Add(1)
+	fc.notify(slug, nil)
+
+	fc.persist(slug, seq, nil)
+}
+
+// persist writes the snapshot stored by the Put (or, with a nil cached, the
+// Remove) numbered seq to the store. Writes for a slug are serialized and
+// skipped once a later Put or Remove has superseded them, so the store
+// always ends up matching memory even when calls race.
+func (fc *FeedCache) persist(slug string, seq uint64, cached *CachedFeed) {
+	if fc.store == nil {
+		return
+	}
+	fc.mu.Lock()
+	saveMu, ok := fc.saveMu[slug]
+	if !ok {
+		saveMu = new(sync.Mutex)
+		fc.saveMu[slug] = saveMu
+	}
+	fc.mu.Unlock()
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	fc.mu.RLock()
+	superseded := fc.seq[slug] != seq
+	fc.mu.RUnlock()
+	if superseded {
+		return
+	}
+
+	if cached == nil {
+		if err := fc.store.Delete(slug); err != nil {
+			fc.logger.Warn("failed to delete feed snapshot", "slug", slug, "error", err)
+		}
+		return
+	}
+	if err := fc.store.Save(slug, cached); err != nil {
+		fc.logger.Warn("failed to persist feed snapshot", "slug", slug, "error", err)
+	}
+}
+
+// SetMemoryBudget limits the approximate memory held by cached feed trees
+// and the search index (see SetIndexSize) to maxBytes (0 = unlimited). When
+// the budget is exceeded, the least recently used sub-feeds are evicted;
+// source roots always stay, and sub-feeds pre-crawled with poll_depth are
+// pinned unless evictCrawled is set.
+func (fc *FeedCache) SetMemoryBudget(maxBytes int64, evictCrawled bool) {
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.budget = maxBytes
+	fc.mem.evictCrawled = evictCrawled
+	fc.evictLocked()
+}
+
+// SetIndexSize records the memory held by the search index built from a
+// source's tree, so it counts towards the memory budget. The index itself
+// cannot be evicted; it leaves less room for sub-feeds instead. A new tree
+// stored by Put or Restore resets the size until it is set again.
+func (fc *FeedCache) SetIndexSize(slug string, bytes int64) {
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.setIndexed(slug, bytes)
+	fc.evictLocked()
+}
+
+// AddChild caches a sub-feed fetched on demand in a source's tree under key
+// and returns the node now stored there (see crawler.FeedTree.AddChild).
+func (fc *FeedCache) AddChild(slug string, parent *crawler.FeedTree, key string, child *crawler.FeedTree) *crawler.FeedTree {
+	stored := parent.AddChild(key, child)
+	if stored == child {
+		fc.gen.Add(1)
+	}
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.add(&memoryNode{slug: slug, parent: parent, key: key, node: stored})
+	fc.evictLocked()
+	return stored
+}
+
+// ReplaceChild swaps a refreshed sub-feed in for old (see
+// crawler.FeedTree.ReplaceChild) and moves the memory accounting over to it.
+func (fc *FeedCache) ReplaceChild(slug string, parent *crawler.FeedTree, key string, old, child *crawler.FeedTree) bool {
+	if !parent.ReplaceChild(key, old, child) {
+		return false
+	}
+	fc.gen.Add(1)
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.forget(old)
+	fc.mem.add(&memoryNode{slug: slug, parent: parent, key: key, node: child})
+	fc.evictLocked()
+	return true
+}
+
+// AppendPage appends a lazily loaded upstream page to a cached node (see
+// crawler.FeedTree.AppendPage) and accounts for the added entries.
+func (fc *FeedCache) AppendPage(node *crawler.FeedTree, from string, page *opds.Feed, hasMore bool, nextURL string) bool {
+	if !node.AppendPage(from, page, hasMore, nextURL) {
+		return false
+	}
+	fc.gen.Add(1)
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.resize(node, opds.EntriesSize(page.Entries))
+	fc.evictLocked()
+	return true
+}
+
+// Touch marks a cached node as recently used, so it is evicted last.
+func (fc *FeedCache) Touch(node *crawler.FeedTree) {
+	fc.memMu.Lock()
+	defer fc.memMu.Unlock()
+	fc.mem.touch(node)
+}
+
+// trackLocked replaces the memory accounting for a source with its new
+// tree. fc.memMu must be held.
+func (fc *FeedCache) trackLocked(slug string, tree *crawler.FeedTree) {
+	fc.mem.removeSource(slug)
+	fc.mem.addTree(slug, tree)
+	fc.evictLocked()
+}
+
+// evictLocked enforces the memory budget. fc.memMu must be held.
+func (fc *FeedCache) evictLocked() {
+	for _, n := range fc.mem.evict() {
+		fc.gen.Add(1)
+		metrics.FeedCacheEvictions.WithLabelValues(n.slug).Inc()
+		fc.logger.Info("cached feed evicted from memory",
+			"slug", n.slug,
+			"path", n.key,
+			"bytes", n.size,
+			"totalBytes", fc.mem.total,
+			"budgetBytes", fc.mem.budget)
+	}
 }
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// memStore is a Store that keeps snapshots in memory. Saves of the first
+// tree are slowed down so they finish after later ones unless writes are
+// ordered.
+type memStore struct {
+	mu    sync.Mutex
+	saved map[string]*CachedFeed
+	slow  *crawler.FeedTree
+}
+
+func (s *memStore) Save(slug string, feed *CachedFeed) error {
+	if feed.Tree == s.slow {
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved[slug] = feed
+	return nil
+}
+
+func (s *memStore) LoadAll() (map[string]*CachedFeed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string]*CachedFeed, len(s.saved))
+	for k, v := range s.saved {
+		all[k] = v
+	}
+	return all, nil
+}
+
+func (s *memStore) Delete(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saved, slug)
+	return nil
+}
+
+func newTree(title string) *crawler.FeedTree {
+	return &crawler.FeedTree{Feed: &opds.Feed{Title: title}, Children: make(map[string]*crawler.FeedTree)}
+}
+
+func TestPutPersistsLatestTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove bool
+	}{
+		{"put", false},
+		{"put then remove", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			older, newer := newTree("older"), newTree("newer")
+			store := &memStore{saved: make(map[string]*CachedFeed), slow: older}
+			fc := NewFeedCache(slog.New(slog.DiscardHandler), store)
+
+			done := make(chan struct{})
+			go func() {
+				fc.Put("books", older)
+				close(done)
+			}()
+			// Let the first Put reach the store before the second starts.
+			time.Sleep(10 * time.Millisecond)
+			fc.Put("books", newer)
+			if tt.remove {
+				fc.Remove("books")
+			}
+			<-done
+
+			saved, _ := store.LoadAll()
+			cached, ok := fc.Get("books")
+			switch {
+			case tt.remove && (ok || saved["books"] != nil):
+				t.Fatalf("removed feed still cached (%v) or stored (%v)", ok, saved["books"] != nil)
+			case !tt.remove && saved["books"].Tree != cached.Tree:
+				t.Fatalf("stored %q, cached %q", saved["books"].Tree.Feed.Title, cached.Tree.Feed.Title)
+			}
+		})
+	}
+}
+
+func TestConcurrentPutsPersistLatest(t *testing.T) {
+	store := &memStore{saved: make(map[string]*CachedFeed)}
+	fc := NewFeedCache(slog.New(slog.DiscardHandler), store)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fc.Put("books", newTree(fmt.Sprint(i)))
+		}()
+	}
+	wg.Wait()
+	saved, _ := store.LoadAll()
+	cached, _ := fc.Get("books")
+	if saved["books"].Tree != cached.Tree {
+		t.Fatalf("stored %q, cached %q", saved["books"].Tree.Feed.Title, cached.Tree.Feed.Title)
+	}
+}
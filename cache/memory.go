@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"container/list"
+
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/metrics"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// memoryIndex tracks the approximate size of every cached feed node, plus
+// the search index built from each source, and evicts the least recently
+// used sub-feeds once the total exceeds the budget. Source roots are never
+// evicted; sub-feeds pre-crawled with poll_depth are pinned unless
+// evictCrawled is set. It is guarded by FeedCache.memMu.
+type memoryIndex struct {
+	budget       int64 // bytes; 0 = unlimited
+	evictCrawled bool
+	total        int64
+	bySource     map[string]int64
+	indexed      map[string]int64 // search index size per source, included in total and bySource
+	lru          *list.List       // of *memoryNode, most recently used first
+	nodes        map[*crawler.FeedTree]*list.Element
+}
+
+// memoryNode is a cached feed node and where it hangs in its source's tree.
+type memoryNode struct {
+	slug    string
+	parent  *crawler.FeedTree // nil for a source root
+	key     string            // key of the node in parent.Children
+	node    *crawler.FeedTree
+	size    int64
+	crawled bool // part of the tree stored by Put or Restore, not fetched on demand
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{
+		bySource: make(map[string]int64),
+		indexed:  make(map[string]int64),
+		lru:      list.New(),
+		nodes:    make(map[*crawler.FeedTree]*list.Element),
+	}
+}
+
+// add starts tracking node, or marks it used if it is tracked already.
+// Nodes whose parent is not tracked belong to a tree that has since been
+// replaced or removed, and are ignored.
+func (m *memoryIndex) add(n *memoryNode) {
+	if el, ok := m.nodes[n.node]; ok {
+		m.lru.MoveToFront(el)
+		return
+	}
+	if _, ok := m.nodes[n.parent]; n.parent != nil && !ok {
+		return
+	}
+	feed, _, _ := n.node.Snapshot()
+	n.size = opds.FeedSize(feed)
+	m.nodes[n.node] = m.lru.PushFront(n)
+	m.grow(n.slug, n.size)
+}
+
+// addTree tracks a source's whole crawled tree.
+func (m *memoryIndex) addTree(slug string, root *crawler.FeedTree) {
+	var walk func(parent *crawler.FeedTree, key string, node *crawler.FeedTree)
+	walk = func(parent *crawler.FeedTree, key string, node *crawler.FeedTree) {
+		m.add(&memoryNode{slug: slug, parent: parent, key: key, node: node, crawled: true})
+		for k, child := range node.ChildNodes() {
+			walk(node, k, child)
+		}
+	}
+	walk(nil, "", root)
+}
+
+// touch marks node as recently used.
+func (m *memoryIndex) touch(node *crawler.FeedTree) {
+	if el, ok := m.nodes[node]; ok {
+		m.lru.MoveToFront(el)
+	}
+}
+
+// resize records that node's feed has grown by delta bytes.
+func (m *memoryIndex) resize(node *crawler.FeedTree, delta int64) {
+	el, ok := m.nodes[node]
+	if !ok {
+		return
+	}
+	n := el.Value.(*memoryNode)
+	n.size += delta
+	m.grow(n.slug, delta)
+	m.lru.MoveToFront(el)
+}
+
+// removeSource stops tracking every node of a source.
+func (m *memoryIndex) removeSource(slug string) {
+	for el := m.lru.Front(); el != nil; {
+		next := el.Next()
+		if n := el.Value.(*memoryNode); n.slug == slug {
+			m.lru.Remove(el)
+			delete(m.nodes, n.node)
+		}
+		el = next
+	}
+	m.total -= m.bySource[slug]
+	delete(m.bySource, slug)
+	delete(m.indexed, slug)
+	metrics.FeedCacheBytes.DeleteLabelValues(slug)
+}
+
+// setIndexed records the size of a source's search index.
+func (m *memoryIndex) setIndexed(slug string, size int64) {
+	delta := size - m.indexed[slug]
+	if delta == 0 {
+		return
+	}
+	if size == 0 {
+		delete(m.indexed, slug)
+	} else {
+		m.indexed[slug] = size
+	}
+	m.grow(slug, delta)
+}
+
+// evict drops least recently used nodes until the total is within budget
+// or nothing evictable is left, and returns the evicted nodes.
+func (m *memoryIndex) evict() []*memoryNode {
+	if m.budget <= 0 {
+		return nil
+	}
+	var evicted []*memoryNode
+	for el := m.lru.Back(); el != nil && m.total > m.budget; {
+		prev := el.Prev()
+		n := el.Value.(*memoryNode)
+		if n.parent != nil && (!n.crawled || m.evictCrawled) {
+			n.parent.RemoveChild(n.key, n.node)
+			m.forget(n.node)
+			evicted = append(evicted, n)
+			if prev != nil && m.nodes[prev.Value.(*memoryNode).node] != prev {
+				prev = m.lru.Back() // prev was in the evicted subtree
+			}
+		}
+		el = prev
+	}
+	return evicted
+}
+
+// forget stops tracking node and everything below it.
+func (m *memoryIndex) forget(node *crawler.FeedTree) {
+	if el, ok := m.nodes[node]; ok {
+		n := el.Value.(*memoryNode)
+		m.lru.Remove(el)
+		delete(m.nodes, node)
+		m.grow(n.slug, -n.size)
+	}
+	for _, child := range node.ChildNodes() {
+		m.forget(child)
+	}
+}
+
+func (m *memoryIndex) grow(slug string, delta int64) {
+	m.total += delta
+	m.bySource[slug] += delta
+	metrics.FeedCacheBytes.WithLabelValues(slug).Set(float64(m.bySource[slug]))
+}
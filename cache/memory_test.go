@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// sizedTree returns a feed node whose accounted size is nodeSize.
+func sizedTree(name string) *crawler.FeedTree {
+	return &crawler.FeedTree{
+		Feed:     &opds.Feed{Title: name + strings.Repeat(".", 100-len(name))},
+		Children: make(map[string]*crawler.FeedTree),
+	}
+}
+
+var nodeSize = opds.FeedSize(sizedTree("x").Feed)
+
+func TestMemoryBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       int64 // in nodes; 0 = unlimited
+		evictCrawled bool
+		index        int64 // search index size, in nodes
+		steps        []string
+		want         []string // children of the root left afterwards
+	}{
+		{
+			name:  "unlimited",
+			steps: []string{"a", "b", "c"},
+			want:  []string{"a", "b", "c", "crawled"},
+		},
+		{
+			name:   "least recently used goes first",
+			budget: 4,
+			steps:  []string{"a", "b", "c"},
+			want:   []string{"b", "c", "crawled"},
+		},
+		{
+			name:   "touch keeps a node",
+			budget: 4,
+			steps:  []string{"a", "b", "touch a", "c"},
+			want:   []string{"a", "c", "crawled"},
+		},
+		{
+			name:   "crawled sub-feeds are pinned",
+			budget: 1,
+			steps:  []string{"a", "b"},
+			want:   []string{"crawled"},
+		},
+		{
+			name:         "crawled sub-feeds evictable",
+			budget:       3,
+			evictCrawled: true,
+			steps:        []string{"a", "b"},
+			want:         []string{"a", "b"},
+		},
+		{
+			name:   "search index counts",
+			budget: 4,
+			index:  1,
+			steps:  []string{"a", "b"},
+			want:   []string{"b", "crawled"},
+		},
+		{
+			name:   "lower budget evicts",
+			budget: 4,
+			steps:  []string{"a", "b", "budget 3"},
+			want:   []string{"b", "crawled"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := NewFeedCache(slog.New(slog.DiscardHandler), nil)
+			fc.SetMemoryBudget(tt.budget*nodeSize, tt.evictCrawled)
+			root := sizedTree("root")
+			root.Children["crawled"] = sizedTree("crawled")
+			fc.Put("books", root)
+			fc.SetIndexSize("books", tt.index*nodeSize)
+
+			nodes := make(map[string]*crawler.FeedTree)
+			for _, step := range tt.steps {
+				switch {
+				case strings.HasPrefix(step, "touch "):
+					fc.Touch(nodes[strings.TrimPrefix(step, "touch ")])
+				case strings.HasPrefix(step, "budget "):
+					n, _ := strconv.ParseInt(strings.TrimPrefix(step, "budget "), 10, 64)
+					fc.SetMemoryBudget(n*nodeSize, tt.evictCrawled)
+				default:
+					nodes[step] = fc.AddChild("books", root, step, sizedTree(step))
+				}
+			}
+
+			var got []string
+			for key := range root.ChildNodes() {
+				got = append(got, key)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("children = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	fc := NewFeedCache(slog.New(slog.DiscardHandler), nil)
+	root := sizedTree("root")
+	fc.Put("books", root)
+	fc.AddChild("books", root, "a", sizedTree("a"))
+	fc.SetIndexSize("books", 2*nodeSize)
+	if got, want := fc.mem.total, 4*nodeSize; got != want {
+		t.Errorf("total = %d, want %d", got, want)
+	}
+
+	// A new tree resets the index size until it is set again.
+	fc.Put("books", sizedTree("root"))
+	if got, want := fc.mem.total, nodeSize; got != want {
+		t.Errorf("after Put: total = %d, want %d", got, want)
+	}
+
+	fc.Remove("books")
+	fc.SetIndexSize("books", 0)
+	if got := fc.mem.total; got != 0 {
+		t.Errorf("after Remove: total = %d, want 0", got)
+	}
+	if _, ok := fc.mem.bySource["books"]; ok {
+		t.Error("removed source still accounted")
+	}
+}
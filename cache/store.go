@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store persists cached feeds so they survive restarts.
+type Store interface {
+	// Save writes the snapshot for a single source, replacing any previous one.
+	Save(slug string, feed *CachedFeed) error
+	// LoadAll returns every snapshot found in the store, keyed by slug.
+	LoadAll() (map[string]*CachedFeed, error)
+	// Delete removes the snapshot for a source. Deleting a missing slug is not an error.
+	Delete(slug string) error
+}
+
+// FileStore is a Store backed by a directory of JSON snapshots, one file per source.
+type FileStore struct {
+	dir string
+}
+
+const snapshotExt = ".json"
+
+// NewFileStore creates a FileStore rooted at dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cache: create snapshot dir %s: %w", dir, err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Save writes the snapshot atomically (temp file + rename) so a crash mid-write
+// never leaves a truncated snapshot behind.
+func (s *FileStore) Save(slug string, feed *CachedFeed) error {
+	tmp, err := os.CreateTemp(s.dir, slug+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cache: create temp snapshot for %s: %w", slug, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(feed); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cache: encode snapshot for %s: %w", slug, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cache: write snapshot for %s: %w", slug, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(slug)); err != nil {
+		return fmt.Errorf("cache: commit snapshot for %s: %w", slug, err)
+	}
+	return nil
+}
+
+// LoadAll reads every snapshot in the directory. Unreadable snapshots are
+// reported as an error after all readable ones have been loaded.
+func (s *FileStore) LoadAll() (map[string]*CachedFeed, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cache: read snapshot dir %s: %w", s.dir, err)
+	}
+
+	result := make(map[string]*CachedFeed)
+	var errs []error
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), snapshotExt) {
+			continue
+		}
+		slug := strings.TrimSuffix(f.Name(), snapshotExt)
+		feed, err := s.load(slug)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result[slug] = feed
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("cache: load snapshots: %v", errs)
+	}
+	return result, nil
+}
+
+// Delete removes the snapshot for slug.
+func (s *FileStore) Delete(slug string) error {
+	if err := os.Remove(s.path(slug)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cache: delete snapshot for %s: %w", slug, err)
+	}
+	return nil
+}
+
+func (s *FileStore) load(slug string) (*CachedFeed, error) {
+	f, err := os.Open(s.path(slug))
+	if err != nil {
+		return nil, fmt.Errorf("cache: open snapshot for %s: %w", slug, err)
+	}
+	defer f.Close()
+
+	var feed CachedFeed
+	if err := json.NewDecoder(f).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("cache: decode snapshot for %s: %w", slug, err)
+	}
+	if feed.Tree == nil {
+		return nil, fmt.Errorf("cache: snapshot for %s has no feed tree", slug)
+	}
+	return &feed, nil
+}
+
+func (s *FileStore) path(slug string) string {
+	return filepath.Join(s.dir, slug+snapshotExt)
+}
@@ -5,17 +5,32 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/madeddie/opds-aggregator/auth"
+	"github.com/madeddie/opds-aggregator/convert"
+	"github.com/madeddie/opds-aggregator/cron"
 )
 
 // Config is the top-level configuration.
 type Config struct {
-	Server  ServerConfig  `yaml:"server"`
-	Polling PollingConfig `yaml:"polling"`
-	Feeds   []FeedConfig  `yaml:"feeds"`
+	Server     ServerConfig     `yaml:"server"`
+	Polling    PollingConfig    `yaml:"polling"`
+	Upstream   UpstreamConfig   `yaml:"upstream"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Feeds      []FeedConfig     `yaml:"feeds"`
+	Users      []UserConfig     `yaml:"users"`
+	Thumbnails ThumbnailConfig  `yaml:"thumbnails"`
+	Conversion ConversionConfig `yaml:"conversion"`
+	Admin      AdminConfig      `yaml:"admin"`
+
+	fileFeeds      []FeedConfig // feeds from the config file and environment, before the admin state file
+	stateOverrides []string     // slugs of those feeds the admin state file replaces or deletes
 }
 
 // ServerConfig configures the HTTP server.
@@ -24,17 +39,113 @@ type ServerConfig struct {
 	Title             string      `yaml:"title"`
 	Auth              *AuthConfig `yaml:"auth,omitempty"`
 	DefaultMaxEntries int         `yaml:"default_max_entries"` // default entries per page (0 = unlimited)
+	HideDownSources   bool        `yaml:"hide_down_sources"`   // omit sources from the root whose crawl failed and that have nothing cached
 }
 
 // AuthConfig holds Basic Auth credentials.
 type AuthConfig struct {
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password,omitempty"`
+}
+
+// UserConfig describes an account allowed to use the aggregator.
+type UserConfig struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"` // plain text, or a bcrypt ($2b$...) or argon2 ($argon2id$...) hash
+	Feeds    []string `yaml:"feeds"`    // feed slugs this user may see (empty = all)
+	Admin    bool     `yaml:"admin"`    // may manage feeds through the admin API
+}
+
+// AllowsFeed reports whether the user may see the feed with the given slug.
+func (u UserConfig) AllowsFeed(slug string) bool {
+	if len(u.Feeds) == 0 {
+		return true
+	}
+	for _, s := range u.Feeds {
+		if s == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// Accounts returns every account that may log in: the single server.auth
+// credential (which sees all feeds and is an admin), followed by the users
+// section.
+func (c *Config) Accounts() []UserConfig {
+	var accounts []UserConfig
+	if a := c.Server.Auth; a != nil && a.Username != "" {
+		accounts = append(accounts, UserConfig{Username: a.Username, Password: a.Password, Admin: true})
+	}
+	return append(accounts, c.Users...)
+}
+
+// ThumbnailConfig controls resizing of cover images served through the
+// download proxy.
+type ThumbnailConfig struct {
+	Default  string             `yaml:"default"` // profile for clients no profile matches ("" = original covers)
+	Profiles []ThumbnailProfile `yaml:"profiles"`
+}
+
+// ThumbnailProfile is a named cover size, selected with ?thumb=<name> on
+// download URLs or automatically by the client's User-Agent.
+type ThumbnailProfile struct {
+	Name       string   `yaml:"name"`
+	Width      int      `yaml:"width"`       // max width in pixels (0 = unbounded)
+	Height     int      `yaml:"height"`      // max height in pixels (0 = unbounded)
+	Grayscale  bool     `yaml:"grayscale"`   // convert to grayscale for e-ink screens
+	Quality    int      `yaml:"quality"`     // JPEG quality 1-100 (0 = 75)
+	UserAgents []string `yaml:"user_agents"` // clients whose User-Agent contains any of these get this profile
+}
+
+// Profile returns the thumbnail profile with the given name.
+func (t ThumbnailConfig) Profile(name string) (ThumbnailProfile, bool) {
+	for _, p := range t.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ThumbnailProfile{}, false
+}
+
+// ProfileFor returns the name of the thumbnail profile for a client with the
+// given User-Agent: the first profile matching it, else the default.
+func (t ThumbnailConfig) ProfileFor(userAgent string) string {
+	for _, p := range t.Profiles {
+		for _, ua := range p.UserAgents {
+			if ua != "" && strings.Contains(userAgent, ua) {
+				return p.Name
+			}
+		}
+	}
+	return t.Default
+}
+
+// ConversionConfig controls on-the-fly ebook format conversion of downloads.
+type ConversionConfig struct {
+	Command string   `yaml:"command"` // converter program, e.g. ebook-convert ("" = disabled)
+	Args    []string `yaml:"args"`    // arguments; {input} and {output} are replaced with file paths
+	Timeout string   `yaml:"timeout"` // max duration of one conversion
+	From    []string `yaml:"from"`    // formats that may be converted, in order of preference
+	To      []string `yaml:"to"`      // formats offered as conversions, e.g. mobi, azw3, kepub
+
+	MaxConcurrent int `yaml:"max_concurrent"` // converter processes run at once
+	MaxInputMB    int `yaml:"max_input_mb"`   // largest book converted, in MiB
+}
+
+// ParsedTimeout returns the conversion timeout as a time.Duration.
+func (c ConversionConfig) ParsedTimeout() (time.Duration, error) {
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("config: invalid conversion timeout %q: %w", c.Timeout, err)
+	}
+	return d, nil
 }
 
 // PollingConfig controls feed polling.
 type PollingConfig struct {
 	Interval string `yaml:"interval"`
+	Jitter   string `yaml:"jitter"` // max random delay added to each scheduled refresh
 }
 
 // ParsedInterval returns the polling interval as a time.Duration.
@@ -49,14 +160,97 @@ func (p PollingConfig) ParsedInterval() (time.Duration, error) {
 	return d, nil
 }
 
+// ParsedJitter returns the maximum scheduling jitter as a time.Duration.
+func (p PollingConfig) ParsedJitter() (time.Duration, error) {
+	if p.Jitter == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(p.Jitter)
+	if err != nil {
+		return 0, fmt.Errorf("config: invalid polling jitter %q: %w", p.Jitter, err)
+	}
+	return d, nil
+}
+
+// UpstreamConfig limits how hard the aggregator hits upstream servers.
+type UpstreamConfig struct {
+	MaxPerHost   int     `yaml:"max_per_host"`   // concurrent requests per upstream host
+	RateLimit    float64 `yaml:"rate_limit"`     // requests per second per feed (0 = unlimited)
+	RateBurst    int     `yaml:"rate_burst"`     // requests a feed may make back to back before rate_limit applies
+	MaxRetryWait string  `yaml:"max_retry_wait"` // longest Retry-After delay waited out before a request fails
+	CrawlWorkers int     `yaml:"crawl_workers"`  // feeds of one source fetched in parallel during a crawl
+}
+
+// ParsedMaxRetryWait returns the longest Retry-After delay to wait out.
+func (u UpstreamConfig) ParsedMaxRetryWait() (time.Duration, error) {
+	if u.MaxRetryWait == "" {
+		return time.Minute, nil
+	}
+	d, err := time.ParseDuration(u.MaxRetryWait)
+	if err != nil {
+		return 0, fmt.Errorf("config: invalid upstream max_retry_wait %q: %w", u.MaxRetryWait, err)
+	}
+	return d, nil
+}
+
+// CacheConfig controls persistence of crawled feeds.
+type CacheConfig struct {
+	Dir           string `yaml:"dir"`             // directory for feed snapshots ("" = memory only)
+	DownloadDir   string `yaml:"download_dir"`    // directory for cached downloads and covers ("" = disabled)
+	DownloadMaxMB int    `yaml:"download_max_mb"` // size limit of the download cache in MiB
+	MemoryMaxMB   int    `yaml:"memory_max_mb"`   // approximate memory budget for cached feeds and the search index in MiB (0 = unlimited)
+	EvictCrawled  bool   `yaml:"evict_crawled"`   // let sub-feeds pre-crawled with poll_depth be evicted too
+}
+
+// Download caching modes for FeedConfig.CacheDownloads.
+const (
+	CacheDownloadsImages = "images" // cache covers and thumbnails only
+	CacheDownloadsAll    = "all"    // cache books as well as images
+)
+
 // FeedConfig describes a single upstream OPDS feed.
 type FeedConfig struct {
-	Name        string      `yaml:"name"`
-	URL         string      `yaml:"url"`
-	Auth        *AuthConfig `yaml:"auth,omitempty"`
-	PollDepth   int         `yaml:"poll_depth"`
-	MaxEntries  int         `yaml:"max_entries"`  // max entries per page (0 = use server default)
-	MaxPaginate int         `yaml:"max_paginate"` // max upstream pages to follow (0 = all)
+	Name         string      `yaml:"name" json:"name"`
+	URL          string      `yaml:"url" json:"url"`
+	Auth         *AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
+	PollDepth    int         `yaml:"poll_depth" json:"poll_depth"`
+	MaxEntries   int         `yaml:"max_entries" json:"max_entries"`     // max entries per page (0 = use server default)
+	MaxPaginate  int         `yaml:"max_paginate" json:"max_paginate"`   // max upstream pages to follow (0 = all)
+	PollInterval string      `yaml:"poll_interval" json:"poll_interval"` // overrides polling.interval for this feed
+	Schedule     string      `yaml:"schedule" json:"schedule"`           // cron expression; overrides poll_interval
+	// CacheDownloads opts this feed into the download cache: "images", "all" or "" (off).
+	CacheDownloads string `yaml:"cache_downloads" json:"cache_downloads"`
+	// RateLimit overrides upstream.rate_limit for this feed (0 = use the global limit).
+	RateLimit float64 `yaml:"rate_limit" json:"rate_limit"`
+	// ChildTTL is how long a sub-feed fetched on demand is served before it
+	// is refreshed in the background ("" = until the next crawl replaces it).
+	ChildTTL string `yaml:"child_ttl" json:"child_ttl"`
+}
+
+// ParsedPollInterval returns the feed's polling interval, falling back to
+// the given global interval when the feed does not set its own.
+func (f FeedConfig) ParsedPollInterval(global time.Duration) (time.Duration, error) {
+	if f.PollInterval == "" {
+		return global, nil
+	}
+	d, err := time.ParseDuration(f.PollInterval)
+	if err != nil {
+		return 0, fmt.Errorf("config: feed %s: invalid poll_interval %q: %w", f.Name, f.PollInterval, err)
+	}
+	return d, nil
+}
+
+// ParsedChildTTL returns how long sub-feeds fetched on demand stay fresh,
+// or 0 if they do not expire.
+func (f FeedConfig) ParsedChildTTL() (time.Duration, error) {
+	if f.ChildTTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(f.ChildTTL)
+	if err != nil {
+		return 0, fmt.Errorf("config: feed %s: invalid child_ttl %q: %w", f.Name, f.ChildTTL, err)
+	}
+	return d, nil
 }
 
 // Slug returns a URL-safe identifier for the feed.
@@ -83,6 +277,47 @@ func (f FeedConfig) Slug() string {
 	return string(slug)
 }
 
+// FeedDiff describes how the feeds of two configurations differ, matched by slug.
+type FeedDiff struct {
+	Added   []FeedConfig // only in the new configuration
+	Changed []FeedConfig // in both with different settings; the new version
+	Removed []FeedConfig // only in the old configuration
+}
+
+// Empty reports whether the two feed lists are equivalent.
+func (d FeedDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// DiffFeeds compares two feed lists by slug. Results keep the order of the
+// list they were taken from.
+func DiffFeeds(old, new []FeedConfig) FeedDiff {
+	oldBySlug := make(map[string]FeedConfig, len(old))
+	for _, f := range old {
+		oldBySlug[f.Slug()] = f
+	}
+	newSlugs := make(map[string]bool, len(new))
+
+	var d FeedDiff
+	for _, f := range new {
+		slug := f.Slug()
+		newSlugs[slug] = true
+		prev, ok := oldBySlug[slug]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, f)
+		case !reflect.DeepEqual(prev, f):
+			d.Changed = append(d.Changed, f)
+		}
+	}
+	for _, f := range old {
+		if !newSlugs[f.Slug()] {
+			d.Removed = append(d.Removed, f)
+		}
+	}
+	return d
+}
+
 // Load reads config from the given YAML file path, applies environment
 // variable overrides, then applies defaults and validates.
 func Load(path string) (*Config, error) {
@@ -90,11 +325,14 @@ func Load(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("config: read %s: %w", path, err)
 	}
-	var cfg Config
+	cfg := newConfig()
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("config: parse %s: %w", path, err)
 	}
 	cfg.ApplyEnv()
+	if err := cfg.applyFeedState(); err != nil {
+		return nil, err
+	}
 	cfg.applyDefaults()
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -105,8 +343,11 @@ func Load(path string) (*Config, error) {
 // LoadFromEnv builds a Config entirely from environment variables,
 // applies defaults, and validates. Used when no YAML file is available.
 func LoadFromEnv() (*Config, error) {
-	var cfg Config
+	cfg := newConfig()
 	cfg.ApplyEnv()
+	if err := cfg.applyFeedState(); err != nil {
+		return nil, err
+	}
 	cfg.applyDefaults()
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -129,9 +370,91 @@ func (c *Config) ApplyEnv() {
 			c.Server.DefaultMaxEntries = n
 		}
 	}
+	if v := os.Getenv("OPDS_SERVER_HIDE_DOWN_SOURCES"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Server.HideDownSources = b
+		}
+	}
 	if v := os.Getenv("OPDS_POLLING_INTERVAL"); v != "" {
 		c.Polling.Interval = v
 	}
+	if v := os.Getenv("OPDS_POLLING_JITTER"); v != "" {
+		c.Polling.Jitter = v
+	}
+	if v := os.Getenv("OPDS_UPSTREAM_MAX_PER_HOST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Upstream.MaxPerHost = n
+		}
+	}
+	if v := os.Getenv("OPDS_UPSTREAM_RATE_LIMIT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			c.Upstream.RateLimit = f
+		}
+	}
+	if v := os.Getenv("OPDS_UPSTREAM_RATE_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Upstream.RateBurst = n
+		}
+	}
+	if v := os.Getenv("OPDS_UPSTREAM_MAX_RETRY_WAIT"); v != "" {
+		c.Upstream.MaxRetryWait = v
+	}
+	if v := os.Getenv("OPDS_UPSTREAM_CRAWL_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Upstream.CrawlWorkers = n
+		}
+	}
+	if v := os.Getenv("OPDS_CACHE_DIR"); v != "" {
+		c.Cache.Dir = v
+	}
+	if v := os.Getenv("OPDS_CACHE_DOWNLOAD_DIR"); v != "" {
+		c.Cache.DownloadDir = v
+	}
+	if v := os.Getenv("OPDS_CACHE_DOWNLOAD_MAX_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Cache.DownloadMaxMB = n
+		}
+	}
+	if v := os.Getenv("OPDS_CACHE_MEMORY_MAX_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Cache.MemoryMaxMB = n
+		}
+	}
+	if v := os.Getenv("OPDS_CACHE_EVICT_CRAWLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Cache.EvictCrawled = b
+		}
+	}
+
+	if v := os.Getenv("OPDS_ADMIN_STATE_FILE"); v != "" {
+		c.Admin.StateFile = v
+	}
+
+	if v := os.Getenv("OPDS_THUMBNAILS_DEFAULT"); v != "" {
+		c.Thumbnails.Default = v
+	}
+	if v := os.Getenv("OPDS_CONVERSION_COMMAND"); v != "" {
+		c.Conversion.Command = v
+	}
+	if v := os.Getenv("OPDS_CONVERSION_TIMEOUT"); v != "" {
+		c.Conversion.Timeout = v
+	}
+	if v := os.Getenv("OPDS_CONVERSION_MAX_CONCURRENT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Conversion.MaxConcurrent = n
+		}
+	}
+	if v := os.Getenv("OPDS_CONVERSION_MAX_INPUT_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Conversion.MaxInputMB = n
+		}
+	}
+	if v := os.Getenv("OPDS_CONVERSION_FROM"); v != "" {
+		c.Conversion.From = splitList(v)
+	}
+	if v := os.Getenv("OPDS_CONVERSION_TO"); v != "" {
+		c.Conversion.To = splitList(v)
+	}
 
 	// Server auth from env.
 	authUser := os.Getenv("OPDS_AUTH_USERNAME")
@@ -144,6 +467,43 @@ func (c *Config) ApplyEnv() {
 	if feeds := feedsFromEnv(); len(feeds) > 0 {
 		c.Feeds = feeds
 	}
+
+	// Users from env (indexed, replaces YAML users if any are defined).
+	if users := usersFromEnv(); len(users) > 0 {
+		c.Users = users
+	}
+}
+
+// usersFromEnv scans OPDS_USER_0_USERNAME, OPDS_USER_1_USERNAME, ... and
+// builds UserConfig entries. Stops at the first index where _USERNAME is not set.
+func usersFromEnv() []UserConfig {
+	var users []UserConfig
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("OPDS_USER_%d_", i)
+		username := os.Getenv(prefix + "USERNAME")
+		if username == "" {
+			break
+		}
+		u := UserConfig{
+			Username: username,
+			Password: os.Getenv(prefix + "PASSWORD"),
+		}
+		u.Feeds = splitList(os.Getenv(prefix + "FEEDS"))
+		u.Admin, _ = strconv.ParseBool(os.Getenv(prefix + "ADMIN"))
+		users = append(users, u)
+	}
+	return users
+}
+
+// splitList splits a comma-separated env value, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // feedsFromEnv scans OPDS_FEED_0_NAME, OPDS_FEED_1_NAME, ... and builds
@@ -175,6 +535,15 @@ func feedsFromEnv() []FeedConfig {
 				fc.MaxPaginate = n
 			}
 		}
+		fc.PollInterval = os.Getenv(prefix + "POLL_INTERVAL")
+		fc.Schedule = os.Getenv(prefix + "SCHEDULE")
+		fc.CacheDownloads = os.Getenv(prefix + "CACHE_DOWNLOADS")
+		fc.ChildTTL = os.Getenv(prefix + "CHILD_TTL")
+		if v := os.Getenv(prefix + "RATE_LIMIT"); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				fc.RateLimit = f
+			}
+		}
 		feedUser := os.Getenv(prefix + "AUTH_USERNAME")
 		feedPass := os.Getenv(prefix + "AUTH_PASSWORD")
 		if feedUser != "" || feedPass != "" {
@@ -185,6 +554,13 @@ func feedsFromEnv() []FeedConfig {
 	return feeds
 }
 
+// newConfig returns a Config holding the defaults whose zero value means
+// something else, so they must be in place before the file and environment
+// are read instead of filling in zeroes afterwards.
+func newConfig() Config {
+	return Config{Cache: CacheConfig{MemoryMaxMB: 256}}
+}
+
 func (c *Config) applyDefaults() {
 	if c.Server.Addr == "" {
 		c.Server.Addr = ":8080"
@@ -195,9 +571,61 @@ func (c *Config) applyDefaults() {
 	if c.Polling.Interval == "" {
 		c.Polling.Interval = "6h"
 	}
+	if c.Cache.DownloadMaxMB == 0 {
+		c.Cache.DownloadMaxMB = 1024
+	}
+	if c.Upstream.MaxPerHost == 0 {
+		c.Upstream.MaxPerHost = 4
+	}
+	if c.Upstream.RateBurst == 0 {
+		c.Upstream.RateBurst = 1
+	}
+	if c.Upstream.CrawlWorkers == 0 {
+		c.Upstream.CrawlWorkers = 4
+	}
+	if c.Conversion.Timeout == "" {
+		c.Conversion.Timeout = "5m"
+	}
+	if c.Conversion.MaxConcurrent == 0 {
+		c.Conversion.MaxConcurrent = 2
+	}
+	if c.Conversion.MaxInputMB == 0 {
+		c.Conversion.MaxInputMB = 100
+	}
+	if len(c.Conversion.From) == 0 {
+		c.Conversion.From = []string{"epub"}
+	}
 }
 
 func (c *Config) validate() error {
+	interval, err := c.Polling.ParsedInterval()
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("config: polling interval must be positive")
+	}
+	if _, err := c.Polling.ParsedJitter(); err != nil {
+		return err
+	}
+	if c.Upstream.MaxPerHost < 0 {
+		return fmt.Errorf("config: upstream max_per_host must not be negative")
+	}
+	if c.Upstream.RateLimit < 0 || c.Upstream.RateBurst < 0 {
+		return fmt.Errorf("config: upstream rate_limit and rate_burst must not be negative")
+	}
+	if _, err := c.Upstream.ParsedMaxRetryWait(); err != nil {
+		return err
+	}
+	if c.Upstream.CrawlWorkers < 0 {
+		return fmt.Errorf("config: upstream crawl_workers must not be negative")
+	}
+	if c.Cache.DownloadMaxMB < 0 {
+		return fmt.Errorf("config: cache download_max_mb must not be negative")
+	}
+	if c.Cache.MemoryMaxMB < 0 {
+		return fmt.Errorf("config: cache memory_max_mb must not be negative")
+	}
 	if len(c.Feeds) == 0 {
 		return fmt.Errorf("config: at least one feed must be configured")
 	}
@@ -214,6 +642,108 @@ func (c *Config) validate() error {
 			return fmt.Errorf("config: feed[%d] (%s): duplicate slug %q", i, f.Name, slug)
 		}
 		slugs[slug] = true
+		if d, err := f.ParsedPollInterval(interval); err != nil {
+			return err
+		} else if d <= 0 {
+			return fmt.Errorf("config: feed[%d] (%s): poll_interval must be positive", i, f.Name)
+		}
+		if f.Schedule != "" {
+			if _, err := cron.Parse(f.Schedule); err != nil {
+				return fmt.Errorf("config: feed[%d] (%s): invalid schedule: %w", i, f.Name, err)
+			}
+		}
+		if f.RateLimit < 0 {
+			return fmt.Errorf("config: feed[%d] (%s): rate_limit must not be negative", i, f.Name)
+		}
+		if d, err := f.ParsedChildTTL(); err != nil {
+			return err
+		} else if d < 0 {
+			return fmt.Errorf("config: feed[%d] (%s): child_ttl must not be negative", i, f.Name)
+		}
+		switch f.CacheDownloads {
+		case "":
+		case CacheDownloadsImages, CacheDownloadsAll:
+			if c.Cache.DownloadDir == "" {
+				return fmt.Errorf("config: feed[%d] (%s): cache_downloads requires cache.download_dir", i, f.Name)
+			}
+		default:
+			return fmt.Errorf("config: feed[%d] (%s): cache_downloads must be %q or %q", i, f.Name, CacheDownloadsImages, CacheDownloadsAll)
+		}
+	}
+	for i, u := range c.Users {
+		if u.Username == "" {
+			return fmt.Errorf("config: user[%d]: username is required", i)
+		}
+		if u.Password == "" {
+			return fmt.Errorf("config: user %q: password is required", u.Username)
+		}
+	}
+	if err := c.Thumbnails.validate(); err != nil {
+		return err
+	}
+	if err := c.Conversion.validate(); err != nil {
+		return err
+	}
+	usernames := make(map[string]bool)
+	for _, u := range c.Accounts() {
+		if usernames[u.Username] {
+			return fmt.Errorf("config: user %q: duplicate username", u.Username)
+		}
+		usernames[u.Username] = true
+		if err := auth.ValidateHash(u.Password); err != nil {
+			return fmt.Errorf("config: user %q: %w", u.Username, err)
+		}
+		for _, slug := range u.Feeds {
+			if !slugs[slug] {
+				return fmt.Errorf("config: user %q: unknown feed slug %q", u.Username, slug)
+			}
+		}
+	}
+	return nil
+}
+
+func (t ThumbnailConfig) validate() error {
+	names := make(map[string]bool)
+	for i, p := range t.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("config: thumbnails.profiles[%d]: name is required", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("config: thumbnail profile %q: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		if p.Width < 0 || p.Height < 0 || (p.Width == 0 && p.Height == 0) {
+			return fmt.Errorf("config: thumbnail profile %q: width or height must be positive", p.Name)
+		}
+		if p.Quality < 0 || p.Quality > 100 {
+			return fmt.Errorf("config: thumbnail profile %q: quality must be between 1 and 100", p.Name)
+		}
+	}
+	if t.Default != "" && !names[t.Default] {
+		return fmt.Errorf("config: thumbnails.default: unknown profile %q", t.Default)
+	}
+	return nil
+}
+
+func (c ConversionConfig) validate() error {
+	if d, err := c.ParsedTimeout(); err != nil {
+		return err
+	} else if d <= 0 {
+		return fmt.Errorf("config: conversion timeout must be positive")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("config: conversion max_concurrent must not be negative")
+	}
+	if c.MaxInputMB < 0 {
+		return fmt.Errorf("config: conversion max_input_mb must not be negative")
+	}
+	for _, name := range append(append([]string(nil), c.From...), c.To...) {
+		if _, ok := convert.Lookup(name); !ok {
+			return fmt.Errorf("config: conversion: unknown format %q", name)
+		}
+	}
+	if c.Command != "" && len(c.To) == 0 {
+		return fmt.Errorf("config: conversion: command is set but no target formats are listed in to")
 	}
 	return nil
 }
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  string
+	}{
+		{"", ""},
+		{"0 4 * * *", ""},
+		{"@daily", ""},
+		{"0 25 * * *", "invalid schedule"},
+		{"every day", "invalid schedule"},
+	}
+	for _, tt := range tests {
+		c := &Config{Feeds: []FeedConfig{{Name: "Books", URL: "http://example.com/opds", Schedule: tt.schedule}}}
+		c.applyDefaults()
+		err := c.validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("schedule %q: unexpected error %v", tt.schedule, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("schedule %q: error %v, want %q", tt.schedule, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDefaultJitter(t *testing.T) {
+	c := &Config{Feeds: []FeedConfig{{Name: "Books", URL: "http://example.com/opds"}}}
+	c.applyDefaults()
+	if d, err := c.Polling.ParsedJitter(); err != nil || d != 0 {
+		t.Errorf("default jitter = %v, %v; want 0", d, err)
+	}
+}
+
+func TestMemoryMaxMB(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want int
+	}{
+		{"missing", "", "", 256},
+		{"set", "cache:\n  memory_max_mb: 64\n", "", 64},
+		{"unlimited", "cache:\n  memory_max_mb: 0\n", "", 0},
+		{"unlimited from env", "", "0", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			data := tt.yaml + "feeds:\n  - name: Books\n    url: http://example.com/opds\n"
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.env != "" {
+				t.Setenv("OPDS_CACHE_MEMORY_MAX_MB", tt.env)
+			}
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Cache.MemoryMaxMB != tt.want {
+				t.Errorf("memory_max_mb = %d, want %d", cfg.Cache.MemoryMaxMB, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// AdminConfig configures the admin API.
+type AdminConfig struct {
+	// StateFile stores the feed changes made through the admin API. They are
+	// merged over the feeds from the config file and environment, winning
+	// for the feeds they touch ("" = admin changes are kept in memory only).
+	StateFile string `yaml:"state_file"`
+}
+
+// feedStateVersion is the current format of the admin state file. Version 1
+// files (without a version) hold the complete feed list instead of changes.
+const feedStateVersion = 2
+
+// feedState is the on-disk format of the admin state file: the changes made
+// through the admin API to the configured feeds.
+type feedState struct {
+	Version int          `json:"version"`
+	Feeds   []FeedConfig `json:"feeds"`             // added feeds, and replacements for configured feeds with the same slug
+	Deleted []string     `json:"deleted,omitempty"` // slugs of configured feeds that were removed
+}
+
+// applyFeedState merges the changes from the admin state file, if one has
+// been written, over the configured feeds. Configured feeds the admin API
+// did not touch keep following the config file.
+func (c *Config) applyFeedState() error {
+	c.fileFeeds = c.Feeds
+	c.stateOverrides = nil
+	if c.Admin.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.Admin.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: read state file %s: %w", c.Admin.StateFile, err)
+	}
+	var st feedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("config: parse state file %s: %w", c.Admin.StateFile, err)
+	}
+	if st.Version < feedStateVersion {
+		// A complete feed list: configured feeds missing from it were deleted.
+		st.Deleted = nil
+		for _, f := range c.Feeds {
+			if _, i := findFeed(st.Feeds, f.Slug()); i < 0 {
+				st.Deleted = append(st.Deleted, f.Slug())
+			}
+		}
+	}
+	c.Feeds, c.stateOverrides = mergeFeedState(c.Feeds, st)
+	return nil
+}
+
+// mergeFeedState applies st to the configured feeds. Replaced feeds keep
+// their place and added ones are appended. It also returns the slugs of the
+// configured feeds that st replaced or deleted.
+func mergeFeedState(feeds []FeedConfig, st feedState) ([]FeedConfig, []string) {
+	deleted := make(map[string]bool, len(st.Deleted))
+	for _, slug := range st.Deleted {
+		deleted[slug] = true
+	}
+	changed := make(map[string]FeedConfig, len(st.Feeds))
+	for _, f := range st.Feeds {
+		changed[f.Slug()] = f
+	}
+
+	var merged []FeedConfig
+	var overridden []string
+	for _, f := range feeds {
+		slug := f.Slug()
+		if deleted[slug] {
+			overridden = append(overridden, slug)
+			continue
+		}
+		if g, ok := changed[slug]; ok {
+			if !reflect.DeepEqual(f, g) {
+				overridden = append(overridden, slug)
+			}
+			f = g
+			delete(changed, slug)
+		}
+		merged = append(merged, f)
+	}
+	for _, f := range st.Feeds {
+		if _, ok := changed[f.Slug()]; ok {
+			merged = append(merged, f)
+		}
+	}
+	return merged, overridden
+}
+
+// diffFeedState returns the changes that turn the configured feeds into feeds.
+func diffFeedState(configured, feeds []FeedConfig) feedState {
+	st := feedState{Version: feedStateVersion, Feeds: []FeedConfig{}}
+	for _, f := range feeds {
+		if g, i := findFeed(configured, f.Slug()); i < 0 || !reflect.DeepEqual(f, g) {
+			st.Feeds = append(st.Feeds, f)
+		}
+	}
+	for _, f := range configured {
+		if _, i := findFeed(feeds, f.Slug()); i < 0 {
+			st.Deleted = append(st.Deleted, f.Slug())
+		}
+	}
+	return st
+}
+
+// findFeed returns the feed with the given slug and its index, or -1.
+func findFeed(feeds []FeedConfig, slug string) (FeedConfig, int) {
+	for i, f := range feeds {
+		if f.Slug() == slug {
+			return f, i
+		}
+	}
+	return FeedConfig{}, -1
+}
+
+// StateOverrides returns the slugs of the feeds from the config file and
+// environment that the admin state file replaces or deletes, so edits to
+// them in the config file have no effect.
+func (c *Config) StateOverrides() []string {
+	return c.stateOverrides
+}
+
+// SaveFeedState writes how the feeds differ from the configured ones to the
+// admin state file atomically (temp file + rename). It is a no-op when no
+// state file is configured.
+func (c *Config) SaveFeedState() error {
+	path := c.Admin.StateFile
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(diffFeedState(c.fileFeeds, c.Feeds), "", "  ")
+	if err != nil {
+		return fmt.Errorf("config: encode state file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("config: create temp state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("config: write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("config: write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("config: commit state file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ValidationError reports a configuration that failed validation.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// WithFeeds returns a copy of the configuration with its feed list replaced,
+// validated with the same rules as a loaded configuration. Validation
+// failures are returned as a *ValidationError.
+func (c *Config) WithFeeds(feeds []FeedConfig) (*Config, error) {
+	next := *c
+	next.Feeds = feeds
+	next.applyDefaults()
+	if err := next.validate(); err != nil {
+		return nil, &ValidationError{Err: err}
+	}
+	return &next, nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeConfig writes a config file with the given feeds ("name url" pairs)
+// and the admin state file at state.
+func writeConfig(t *testing.T, path, state string, feeds ...string) {
+	t.Helper()
+	data := "admin:\n  state_file: " + state + "\nfeeds:\n"
+	for i := 0; i < len(feeds); i += 2 {
+		data += "  - name: " + feeds[i] + "\n    url: " + feeds[i+1] + "\n"
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func feedURLs(feeds []FeedConfig) []string {
+	var out []string
+	for _, f := range feeds {
+		out = append(out, f.Slug()+"="+f.URL)
+	}
+	return out
+}
+
+func TestFeedStateMergesWithConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	state := filepath.Join(dir, "feeds.json")
+	writeConfig(t, path, state, "A", "http://a", "B", "http://b", "C", "http://c")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Through the admin API: edit B, delete C, add D.
+	cfg, err = cfg.WithFeeds([]FeedConfig{
+		{Name: "A", URL: "http://a"},
+		{Name: "B", URL: "http://b2"},
+		{Name: "D", URL: "http://d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SaveFeedState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then in the config file: edit A and B, add E.
+	writeConfig(t, path, state, "A", "http://a2", "B", "http://b3", "C", "http://c", "E", "http://e")
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a=http://a2", "b=http://b2", "e=http://e", "d=http://d"}
+	if got := feedURLs(cfg.Feeds); !slices.Equal(got, want) {
+		t.Errorf("feeds = %v, want %v", got, want)
+	}
+	if got, want := cfg.StateOverrides(), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("StateOverrides() = %v, want %v", got, want)
+	}
+
+	// Saving again only records the admin changes.
+	if err := cfg.SaveFeedState(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := feedURLs(cfg.Feeds); !slices.Equal(got, want) {
+		t.Errorf("after resave: feeds = %v, want %v", got, want)
+	}
+}
+
+func TestLegacyFeedState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	state := filepath.Join(dir, "feeds.json")
+	writeConfig(t, path, state, "A", "http://a", "B", "http://b")
+	// Written before the state file held changes: the complete feed list.
+	legacy := `{"feeds": [{"name": "B", "url": "http://b2"}, {"name": "C", "url": "http://c"}]}`
+	if err := os.WriteFile(state, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"b=http://b2", "c=http://c"}
+	if got := feedURLs(cfg.Feeds); !slices.Equal(got, want) {
+		t.Errorf("feeds = %v, want %v", got, want)
+	}
+}
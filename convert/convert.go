@@ -0,0 +1,129 @@
+// Package convert turns downloaded ebooks into other formats by running a
+// local converter program such as Calibre's ebook-convert or kepubify.
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format is an ebook format that can be offered as a conversion target.
+type Format struct {
+	Name      string // short name used in config and URLs, e.g. "mobi"
+	MediaType string
+	Ext       string // file extension, including the leading dot
+}
+
+var formats = []Format{
+	{Name: "epub", MediaType: "application/epub+zip", Ext: ".epub"},
+	{Name: "kepub", MediaType: "application/kepub+zip", Ext: ".kepub.epub"},
+	{Name: "mobi", MediaType: "application/x-mobipocket-ebook", Ext: ".mobi"},
+	{Name: "azw3", MediaType: "application/x-mobi8-ebook", Ext: ".azw3"},
+	{Name: "pdf", MediaType: "application/pdf", Ext: ".pdf"},
+	{Name: "fb2", MediaType: "application/x-fictionbook+xml", Ext: ".fb2"},
+}
+
+// Lookup returns the format with the given short name.
+func Lookup(name string) (Format, bool) {
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// ForMediaType returns the format with the given media type, ignoring parameters.
+func ForMediaType(mediaType string) (Format, bool) {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return Format{}, false
+	}
+	for _, f := range formats {
+		if f.MediaType == mt {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Converter converts the ebook at src into the file dst, whose format is
+// given by its extension.
+type Converter interface {
+	Convert(ctx context.Context, src, dst string) error
+}
+
+// DefaultArgs are the Command arguments used when none are configured.
+var DefaultArgs = []string{"{input}", "{output}"}
+
+// maxOutput bounds how much converter output is included in errors.
+const maxOutput = 512
+
+// Command is a Converter that runs an external program. In Args, {input}
+// and {output} are replaced with the source and destination paths.
+type Command struct {
+	Path          string
+	Args          []string
+	Timeout       time.Duration // 0 = no limit beyond ctx
+	MaxConcurrent int           // processes run at once; 0 = unlimited
+
+	once  sync.Once
+	slots chan struct{}
+}
+
+// Convert runs the command and checks that it produced dst. When
+// MaxConcurrent processes are already running, it waits for one of them to
+// finish first; the wait does not count towards Timeout.
+func (c *Command) Convert(ctx context.Context, src, dst string) error {
+	c.once.Do(func() {
+		if c.MaxConcurrent > 0 {
+			c.slots = make(chan struct{}, c.MaxConcurrent)
+		}
+	})
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+			defer func() { <-c.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	args := c.Args
+	if len(args) == 0 {
+		args = DefaultArgs
+	}
+	expanded := make([]string, len(args))
+	r := strings.NewReplacer("{input}", src, "{output}", dst)
+	for i, a := range args {
+		expanded[i] = r.Replace(a)
+	}
+
+	out, err := exec.CommandContext(ctx, c.Path, expanded...).CombinedOutput()
+	if err != nil {
+		if len(out) > maxOutput {
+			out = out[len(out)-maxOutput:]
+		}
+		return fmt.Errorf("convert: %s: %w: %s", c.Path, err, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(dst); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("convert: %s produced no output file", c.Path)
+		}
+		return fmt.Errorf("convert: %w", err)
+	}
+	return nil
+}
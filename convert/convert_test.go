@@ -0,0 +1,70 @@
+package convert
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCommandMaxConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Each run registers itself in running, records how many runs it sees
+	// there, and copies its input once the others had time to start.
+	script := `mkdir "$2/$$"; ls "$2" | wc -l >> "$2.log"; sleep 0.2; rmdir "$2/$$"; cp "$0" "$1"`
+	c := &Command{
+		Path:          "sh",
+		Args:          []string{"-c", script, "{input}", "{output}", running},
+		MaxConcurrent: 2,
+	}
+	src := filepath.Join(dir, "book.epub")
+	if err := os.WriteFile(src, []byte("book"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dst := filepath.Join(dir, "out"+strconv.Itoa(i)+".mobi")
+			if err := c.Convert(context.Background(), src, dst); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	log, err := os.ReadFile(running + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := strings.Fields(string(log))
+	if len(counts) != 6 {
+		t.Fatalf("got %d runs, want 6", len(counts))
+	}
+	for _, s := range counts {
+		if n, _ := strconv.Atoi(s); n > 2 {
+			t.Fatalf("%d converters ran at once, want at most 2", n)
+		}
+	}
+}
+
+func TestCommandMaxConcurrentCanceled(t *testing.T) {
+	c := &Command{Path: "true", MaxConcurrent: 1}
+	c.once.Do(func() { c.slots = make(chan struct{}, 1) })
+	c.slots <- struct{}{} // the only slot is taken
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Convert(ctx, "in", "out"); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
@@ -2,36 +2,31 @@
 package crawler
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/madeddie/opds-aggregator/config"
 	"github.com/madeddie/opds-aggregator/opds"
 )
 
-// FeedTree represents a cached upstream feed and its navigable children.
-type FeedTree struct {
-	Feed            *opds.Feed
-	URL             string
-	Children        map[string]*FeedTree // keyed by path relative to the source root
-	SearchURL       string               // OpenSearch description URL, if found
-	HasMoreUpstream bool                 // true if upstream has more pages available
-	NextUpstreamURL string               // URL for the next upstream page (if HasMoreUpstream)
-}
-
 // Crawler fetches upstream OPDS feeds.
 type Crawler struct {
 	client *http.Client
 	logger *slog.Logger
+	limits *limiter
 }
 
-// New creates a new Crawler with the given HTTP client.
+// New creates a new Crawler with the given HTTP client. Upstream requests
+// are not limited until SetLimits is called.
 func New(client *http.Client, logger *slog.Logger) *Crawler {
 	if client == nil {
 		client = &http.Client{Timeout: 30 * time.Second}
@@ -39,85 +34,245 @@ func New(client *http.Client, logger *slog.Logger) *Crawler {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &Crawler{client: client, logger: logger}
+	return &Crawler{client: client, logger: logger, limits: newLimiter()}
 }
 
 // Crawl fetches the feed tree for a single upstream source, crawling navigation
 // links up to the configured depth.
 func (c *Crawler) Crawl(ctx context.Context, feedCfg config.FeedConfig) (*FeedTree, error) {
-	c.logger.Info("crawling feed", "name", feedCfg.Name, "url", feedCfg.URL, "depth", feedCfg.PollDepth)
+	return c.Recrawl(ctx, feedCfg, nil)
+}
 
-	tree := &FeedTree{
-		URL:      feedCfg.URL,
-		Children: make(map[string]*FeedTree),
-	}
+// Recrawl is like Crawl but revalidates against a previously crawled tree.
+// Every node is fetched with If-None-Match/If-Modified-Since using the
+// validators stored on prev; a 304 response reuses the cached feed for that
+// node instead of downloading and re-parsing it. Pre-crawled children are
+// still revalidated the same way, so unchanged catalogs cost one empty 304
+// per node.
+func (c *Crawler) Recrawl(ctx context.Context, feedCfg config.FeedConfig, prev *FeedTree) (*FeedTree, error) {
+	ctx = WithSource(ctx, feedCfg.Slug())
+	c.logger.Info("crawling feed", "name", feedCfg.Name, "url", feedCfg.URL, "depth", feedCfg.PollDepth)
 
-	feed, err := c.fetchFeed(ctx, feedCfg.URL, feedCfg.Auth)
+	tree, err := c.fetchNode(ctx, feedCfg.URL, feedCfg.Auth, prev)
 	if err != nil {
 		return nil, fmt.Errorf("crawler: fetch root %s: %w", feedCfg.URL, err)
 	}
-	tree.Feed = feed
 
 	// Extract search URL from root feed.
-	if sl := feed.SearchLink(); sl != nil {
-		tree.SearchURL = resolveURL(feedCfg.URL, sl.Href)
+	if sl := tree.Feed.SearchLink(); sl != nil {
+		tree.SearchURL = ResolveURL(feedCfg.URL, sl.Href)
 	}
 
-	// Crawl navigation links recursively.
+	// Crawl navigation links level by level.
 	if feedCfg.PollDepth > 0 {
-		if err := c.crawlChildren(ctx, tree, feedCfg, feedCfg.URL, 1); err != nil {
+		if err := c.crawlChildren(ctx, tree, prev, feedCfg); err != nil {
 			c.logger.Warn("partial crawl failure", "name", feedCfg.Name, "error", err)
 		}
 	}
 
-	c.logger.Info("crawl complete", "name", feedCfg.Name, "children", len(tree.Children))
+	tree.Complete = isComplete(tree, feedCfg.URL)
+	c.logger.Info("crawl complete", "name", feedCfg.Name, "children", len(tree.Children), "complete", tree.Complete)
 	return tree, nil
 }
 
-func (c *Crawler) crawlChildren(ctx context.Context, tree *FeedTree, feedCfg config.FeedConfig, baseURL string, depth int) error {
-	if depth > feedCfg.PollDepth {
-		return nil
-	}
-	if tree.Feed == nil {
-		return nil
+// isComplete reports whether a crawled tree holds the whole catalog: no node
+// has further upstream pages and every navigation link was crawled into a child.
+func isComplete(tree *FeedTree, rootURL string) bool {
+	if tree.Feed == nil || tree.HasMoreUpstream || tree.Feed.NextLink() != nil {
+		return false
 	}
-
 	for _, entry := range tree.Feed.Entries {
 		for _, link := range entry.Links {
 			if !isNavigationLink(link) {
 				continue
 			}
+			child, ok := tree.Children[relativePath(rootURL, ResolveURL(tree.URL, link.Href))]
+			if !ok || !isComplete(child, rootURL) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fetchNode fetches a single feed into a new tree node without children.
+// If prev is non-nil and upstream answers 304 Not Modified, the node reuses
+// prev's feed and pagination state.
+func (c *Crawler) fetchNode(ctx context.Context, feedURL string, auth *config.AuthConfig, prev *FeedTree) (*FeedTree, error) {
+	var (
+		prevFeed           *opds.Feed
+		prevMore           bool
+		prevNext           string
+		etag, lastModified string
+	)
+	if prev != nil {
+		prevFeed, prevMore, prevNext = prev.Snapshot()
+	}
+	if prevFeed != nil {
+		etag, lastModified = prev.ETag, prev.LastModified
+	}
+
+	res, err := c.fetchFeedConditional(ctx, feedURL, auth, etag, lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.NotModified {
+		c.logger.Debug("feed not modified, reusing cached copy", "url", feedURL)
+		return &FeedTree{
+			Feed:            prevFeed,
+			URL:             feedURL,
+			Children:        make(map[string]*FeedTree),
+			HasMoreUpstream: prevMore,
+			NextUpstreamURL: prevNext,
+			ETag:            prev.ETag,
+			LastModified:    prev.LastModified,
+		}, nil
+	}
+
+	return &FeedTree{
+		Feed:         res.Feed,
+		URL:          feedURL,
+		Children:     make(map[string]*FeedTree),
+		ETag:         res.ETag,
+		LastModified: res.LastModified,
+	}, nil
+}
 
-			absURL := resolveURL(baseURL, link.Href)
-			relPath := relativePath(feedCfg.URL, absURL)
+// crawlJob is a feed fetched during a crawl.
+type crawlJob struct {
+	key  string // path relative to the source root
+	url  string
+	prev *FeedTree // the node last crawled for key, for conditional requests
+	node *FeedTree // the fetched node; nil if the fetch failed
+}
+
+// crawlLink is a navigation link found during a crawl: the child of parent
+// stored under key.
+type crawlLink struct {
+	parent *FeedTree
+	key    string
+}
 
-			// Avoid re-crawling.
-			if _, exists := tree.Children[relPath]; exists {
+// crawlChildren crawls the navigation links below tree up to the configured
+// depth, one level at a time: the links of every feed on a level are fetched
+// in parallel by a pool of workers before the next level is discovered.
+// Each URL is fetched once per crawl, but every feed linking to it gets it
+// as a child of its own, so the tree has the same shape as when each link
+// was fetched separately. It returns an error only if ctx was cancelled.
+func (c *Crawler) crawlChildren(ctx context.Context, tree, prev *FeedTree, feedCfg config.FeedConfig) error {
+	prevNodes := make(map[string]*FeedTree)
+	if prev != nil {
+		indexNodes(prev, prevNodes)
+	}
+	// Fetched feeds by key, for the whole crawl. Links back to the root reuse it.
+	rootKey := relativePath(feedCfg.URL, tree.URL)
+	fetched := map[string]*crawlJob{rootKey: {key: rootKey, url: tree.URL, node: tree}}
+
+	level := []*FeedTree{tree}
+	for depth := 1; depth <= feedCfg.PollDepth && len(level) > 0; depth++ {
+		var links []crawlLink
+		var jobs []*crawlJob
+		linked := make(map[crawlLink]bool)
+		for _, parent := range level {
+			if parent.Feed == nil {
 				continue
 			}
+			for _, entry := range parent.Feed.Entries {
+				for _, link := range entry.Links {
+					if !isNavigationLink(link) {
+						continue
+					}
+					absURL := ResolveURL(parent.URL, link.Href)
+					l := crawlLink{parent: parent, key: relativePath(feedCfg.URL, absURL)}
+					if linked[l] {
+						continue
+					}
+					linked[l] = true
+					links = append(links, l)
+					if _, ok := fetched[l.key]; !ok {
+						job := &crawlJob{key: l.key, url: absURL, prev: prevNodes[l.key]}
+						fetched[l.key] = job
+						jobs = append(jobs, job)
+					}
+				}
+			}
+		}
 
-			child, err := c.fetchFeed(ctx, absURL, feedCfg.Auth)
-			if err != nil {
-				c.logger.Warn("skipping child feed", "url", absURL, "error", err)
+		c.fetchJobs(ctx, jobs, feedCfg.Auth)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var next []*FeedTree
+		for _, l := range links {
+			fetchedNode := fetched[l.key].node
+			if fetchedNode == nil {
 				continue
 			}
-
-			childTree := &FeedTree{
-				Feed:     child,
-				URL:      absURL,
-				Children: make(map[string]*FeedTree),
+			// Each parent gets a node of its own: its children are crawled
+			// to the depth left below that parent.
+			node := &FeedTree{
+				Feed:            fetchedNode.Feed,
+				URL:             fetchedNode.URL,
+				Children:        make(map[string]*FeedTree),
+				HasMoreUpstream: fetchedNode.HasMoreUpstream,
+				NextUpstreamURL: fetchedNode.NextUpstreamURL,
+				ETag:            fetchedNode.ETag,
+				LastModified:    fetchedNode.LastModified,
+			}
+			l.parent.Children[l.key] = node
+			// Only navigation feeds are crawled further.
+			if node.Feed.IsNavigationFeed() {
+				next = append(next, node)
 			}
-			tree.Children[relPath] = childTree
+		}
+		level = next
+	}
+	return nil
+}
 
-			// Recurse into navigation feeds.
-			if child.IsNavigationFeed() && depth < feedCfg.PollDepth {
-				if err := c.crawlChildren(ctx, childTree, feedCfg, absURL, depth+1); err != nil {
-					c.logger.Warn("child crawl failed", "url", absURL, "error", err)
+// fetchJobs fetches the nodes for jobs with up to the configured number of
+// crawl workers. Failed fetches are logged and leave job.node nil.
+func (c *Crawler) fetchJobs(ctx context.Context, jobs []*crawlJob, auth *config.AuthConfig) {
+	work := make(chan *crawlJob)
+	var wg sync.WaitGroup
+	for range min(c.limits.workers(), len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				node, err := c.fetchNode(ctx, job.url, auth, job.prev)
+				if err != nil {
+					c.logger.Warn("skipping child feed", "url", job.url, "error", err)
+					continue
 				}
+				job.node = node
 			}
+		}()
+	}
+
+send:
+	for _, job := range jobs {
+		select {
+		case work <- job:
+		case <-ctx.Done():
+			break send
 		}
 	}
-	return nil
+	close(work)
+	wg.Wait()
+}
+
+// indexNodes adds every node below tree to nodes, keyed by the path it is
+// stored under. tree may be shared, so its children are read under lock.
+func indexNodes(tree *FeedTree, nodes map[string]*FeedTree) {
+	for key, child := range tree.ChildNodes() {
+		if _, ok := nodes[key]; !ok {
+			nodes[key] = child
+		}
+		indexNodes(child, nodes)
+	}
 }
 
 // FetchFeedByURL fetches a single feed URL with optional auth (used for on-demand fetching).
@@ -149,13 +304,21 @@ func (c *Crawler) FetchWithLimit(ctx context.Context, feedURL string, auth *conf
 
 	current := feed
 	pageCount := 1
+	seen := map[string]bool{feedURL: true}
 	for {
 		nextLink := current.NextLink()
 		if nextLink == nil {
 			break
 		}
 
-		nextURL := resolveURL(feedURL, nextLink.Href)
+		nextURL := ResolveURL(feedURL, nextLink.Href)
+		// Guard against upstreams whose "next" link loops back to a page we
+		// already fetched.
+		if seen[nextURL] {
+			c.logger.Warn("pagination loop detected", "url", nextURL)
+			break
+		}
+		seen[nextURL] = true
 
 		// If we've reached the page limit, return with hasMore=true and the next URL.
 		if maxPages > 0 && pageCount >= maxPages {
@@ -177,58 +340,181 @@ func (c *Crawler) FetchWithLimit(ctx context.Context, feedURL string, auth *conf
 }
 
 func (c *Crawler) fetchFeed(ctx context.Context, feedURL string, auth *config.AuthConfig) (*opds.Feed, error) {
+	res, err := c.fetchFeedConditional(ctx, feedURL, auth, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Feed, nil
+}
+
+// fetchResult is the outcome of a single, possibly conditional, feed fetch.
+type fetchResult struct {
+	Feed         *opds.Feed // nil when NotModified
+	ETag         string
+	LastModified string
+	NotModified  bool
+}
+
+// fetchFeedConditional fetches and parses a feed. When etag or lastModified
+// are set they are sent as If-None-Match/If-Modified-Since, and a 304 response
+// is reported as NotModified without a feed.
+func (c *Crawler) fetchFeedConditional(ctx context.Context, feedURL string, auth *config.AuthConfig, etag, lastModified string) (*fetchResult, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("build request: %w", err)
 	}
 
-	req.Header.Set("Accept", opds.MediaTypeAtom)
+	req.Header.Set("Accept", acceptFeed)
 	if auth != nil && auth.Username != "" {
 		req.SetBasicAuth(auth.Username, auth.Password)
 	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req, kindFeed)
 	if err != nil {
 		return nil, fmt.Errorf("fetch %s: %w", feedURL, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+		return &fetchResult{ETag: etag, LastModified: lastModified, NotModified: true}, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
 		return nil, fmt.Errorf("fetch %s: HTTP %d: %s", feedURL, resp.StatusCode, string(body))
 	}
 
-	feed, err := opds.Parse(resp.Body)
+	feed, err := parseFeed(resp)
 	if err != nil {
 		return nil, fmt.Errorf("parse %s: %w", feedURL, err)
 	}
 
-	return feed, nil
+	return &fetchResult{
+		Feed:         feed,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// acceptFeed prefers OPDS 1.2 Atom but accepts OPDS 2.0 JSON from servers
+// that only speak the newer format.
+const acceptFeed = opds.MediaTypeAtom + ", " + opds.MediaTypeOPDS2 + ";q=0.9, application/json;q=0.8"
+
+// parseFeed decodes a feed response as OPDS 2.0 JSON or OPDS 1.2 Atom XML.
+// The Content-Type decides; when it is missing or generic, the first
+// non-whitespace byte of the body is sniffed instead.
+func parseFeed(resp *http.Response) (*opds.Feed, error) {
+	body := bufio.NewReader(resp.Body)
+
+	isJSON := false
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasSuffix(mediaType, "+json") || mediaType == "application/json":
+		isJSON = true
+	case strings.Contains(mediaType, "xml"):
+		isJSON = false
+	default:
+		for {
+			b, err := body.Peek(1)
+			if err != nil {
+				break
+			}
+			if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+				body.ReadByte()
+				continue
+			}
+			isJSON = b[0] == '{'
+			break
+		}
+	}
+
+	if isJSON {
+		return opds.ParseJSON(body)
+	}
+	return opds.Parse(body)
 }
 
-// FetchRaw fetches a URL and returns the raw response body and content type.
-// Used for proxying downloads.
-func (c *Crawler) FetchRaw(ctx context.Context, rawURL string, auth *config.AuthConfig) (io.ReadCloser, string, int64, error) {
+// FetchDocument fetches a small upstream document, such as an OpenSearch
+// description, within the upstream limits and returns at most maxBytes of
+// its body. Responses other than 200 OK are errors.
+func (c *Crawler) FetchDocument(ctx context.Context, rawURL string, auth *config.AuthConfig, maxBytes int64) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		return nil, "", 0, fmt.Errorf("build request: %w", err)
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	if auth != nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := c.do(req, kindFeed)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: HTTP %d", rawURL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", rawURL, err)
+	}
+	return body, nil
+}
+
+// RawResponse is an upstream response to a proxied download.
+type RawResponse struct {
+	StatusCode    int // 200, 206 or 416
+	Header        http.Header
+	Body          io.ReadCloser
+	ContentLength int64 // -1 if unknown
+}
+
+// rawRequestHeaders are the client request headers forwarded upstream by FetchRaw.
+var rawRequestHeaders = []string{"Range", "If-Range"}
+
+// FetchRaw fetches a URL and returns the raw response. Used for proxying
+// downloads: method is GET or HEAD, and the Range and If-Range headers from
+// reqHeader are forwarded so partial content and 416 responses come back
+// to the caller as-is.
+func (c *Crawler) FetchRaw(ctx context.Context, method, rawURL string, auth *config.AuthConfig, reqHeader http.Header) (*RawResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
 	}
 
 	if auth != nil && auth.Username != "" {
 		req.SetBasicAuth(auth.Username, auth.Password)
 	}
+	for _, name := range rawRequestHeaders {
+		if v := reqHeader.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req, kindDownload)
 	if err != nil {
-		return nil, "", 0, fmt.Errorf("fetch %s: %w", rawURL, err)
+		return nil, fmt.Errorf("fetch %s: %w", rawURL, err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	default:
 		resp.Body.Close()
-		return nil, "", 0, fmt.Errorf("fetch %s: HTTP %d", rawURL, resp.StatusCode)
+		return nil, fmt.Errorf("fetch %s: HTTP %d", rawURL, resp.StatusCode)
 	}
 
-	return resp.Body, resp.Header.Get("Content-Type"), resp.ContentLength, nil
+	return &RawResponse{
+		StatusCode:    resp.StatusCode,
+		Header:        resp.Header,
+		Body:          resp.Body,
+		ContentLength: resp.ContentLength,
+	}, nil
 }
 
 func isNavigationLink(l opds.Link) bool {
@@ -238,7 +524,9 @@ func isNavigationLink(l opds.Link) bool {
 	return strings.Contains(l.Type, "opds-catalog") || strings.Contains(l.Type, "atom+xml")
 }
 
-func resolveURL(base, ref string) string {
+// ResolveURL resolves ref against base, treating the base path as a directory
+// (the convention used by OPDS catalogs whose root has no trailing slash).
+func ResolveURL(base, ref string) string {
 	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
 		return ref
 	}
@@ -0,0 +1,212 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+// catalog serves navigation feeds linking to the paths in links, and an
+// acquisition feed for every other path. It counts the requests per path.
+type catalog struct {
+	links map[string][]string
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.calls[r.URL.Path]++
+	c.mu.Unlock()
+
+	var entries strings.Builder
+	if links, ok := c.links[r.URL.Path]; ok {
+		for _, l := range links {
+			fmt.Fprintf(&entries, `<entry><id>%[1]s</id><title>%[1]s</title>
+<link rel="subsection" type="application/atom+xml;profile=opds-catalog;kind=navigation" href="%[1]s"/></entry>`, l)
+		}
+	} else {
+		fmt.Fprintf(&entries, `<entry><id>%[1]s</id><title>Book</title>
+<link rel="http://opds-spec.org/acquisition" type="application/epub+zip" href="%[1]s.epub"/></entry>`, r.URL.Path)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>%s</id><title>Feed</title>%s</feed>`, r.URL.Path, entries.String())
+}
+
+// shape lists the path of every node below tree, e.g. "a/shared".
+func shape(tree *FeedTree, prefix string, out *[]string) {
+	for key, child := range tree.Children {
+		if key == "" {
+			key = "(root)"
+		}
+		path := prefix + key
+		*out = append(*out, path)
+		shape(child, path+"/", out)
+	}
+}
+
+func TestCrawlSharedSubFeeds(t *testing.T) {
+	links := map[string][]string{
+		"/opds":        {"/opds/a", "/opds/b"},
+		"/opds/a":      {"/opds/shared"},
+		"/opds/b":      {"/opds/shared", "/opds/shared", "/opds"}, // duplicate and back to the root
+		"/opds/shared": {"/opds/leaf"},
+	}
+	tests := []struct {
+		depth    int
+		want     []string
+		complete bool
+	}{
+		{1, []string{"a", "b"}, false},
+		{2, []string{"a", "a/shared", "b", "b/(root)", "b/shared"}, false},
+		{3, []string{
+			"a", "a/shared", "a/shared/leaf",
+			"b", "b/(root)", "b/(root)/a", "b/(root)/b", "b/shared", "b/shared/leaf",
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("depth %d", tt.depth), func(t *testing.T) {
+			cat := &catalog{links: links, calls: make(map[string]int)}
+			upstream := httptest.NewServer(cat)
+			defer upstream.Close()
+
+			c := New(nil, slog.New(slog.DiscardHandler))
+			c.SetLimits(config.UpstreamConfig{CrawlWorkers: 4}, nil)
+			tree, err := c.Crawl(t.Context(), config.FeedConfig{Name: "Books", URL: upstream.URL + "/opds", PollDepth: tt.depth})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			shape(tree, "", &got)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("tree = %v, want %v", got, tt.want)
+			}
+			if tree.Complete != tt.complete {
+				t.Errorf("Complete = %v, want %v", tree.Complete, tt.complete)
+			}
+			for path, n := range cat.calls {
+				if n != 1 {
+					t.Errorf("%s fetched %d times, want once", path, n)
+				}
+			}
+		})
+	}
+}
+
+func TestCrawlComplete(t *testing.T) {
+	cat := &catalog{
+		links: map[string][]string{
+			"/opds":   {"/opds/a", "/opds/b"},
+			"/opds/a": {"/opds/shared"},
+			"/opds/b": {"/opds/shared"},
+		},
+		calls: make(map[string]int),
+	}
+	upstream := httptest.NewServer(cat)
+	defer upstream.Close()
+
+	c := New(nil, slog.New(slog.DiscardHandler))
+	tree, err := c.Crawl(t.Context(), config.FeedConfig{Name: "Books", URL: upstream.URL + "/opds", PollDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.Complete {
+		t.Error("fully crawled catalog not complete")
+	}
+	for _, parent := range []string{"a", "b"} {
+		if _, ok := tree.Children[parent].Children["shared"]; !ok {
+			t.Errorf("shared sub-feed missing below %s", parent)
+		}
+	}
+	if n := cat.calls["/opds/shared"]; n != 1 {
+		t.Errorf("shared sub-feed fetched %d times, want once", n)
+	}
+}
+
+const (
+	atomFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>urn:atom</id><title>Atom</title></feed>`
+	jsonFeed = `{"metadata": {"title": "JSON"}, "links": []}`
+)
+
+func TestParseFeed(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"opds json", "application/opds+json", jsonFeed, "JSON"},
+		{"plain json", "application/json; charset=utf-8", jsonFeed, "JSON"},
+		{"atom", "application/atom+xml;profile=opds-catalog", atomFeed, "Atom"},
+		{"xml", "text/xml", atomFeed, "Atom"},
+		{"sniffed json", "", "\r\n  " + jsonFeed, "JSON"},
+		{"sniffed json, generic type", "application/octet-stream", jsonFeed, "JSON"},
+		{"sniffed atom", "text/plain", atomFeed, "Atom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if tt.contentType != "" {
+				resp.Header.Set("Content-Type", tt.contentType)
+			}
+			feed, err := parseFeed(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if feed.Title != tt.want {
+				t.Errorf("title = %q, want %q", feed.Title, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrawlOPDS2(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/opds+json")
+		switch r.URL.Path {
+		case "/opds":
+			// Navigation links without a type still lead to feeds.
+			fmt.Fprint(w, `{"metadata": {"title": "Root"}, "links": [],
+"navigation": [{"href": "/opds/fiction", "title": "Fiction"}]}`)
+		case "/opds/fiction":
+			fmt.Fprint(w, `{"metadata": {"title": "Fiction"}, "links": [],
+"publications": [{"metadata": {"identifier": "urn:book", "title": "Book"},
+"links": [{"rel": "http://opds-spec.org/acquisition", "href": "/book.epub", "type": "application/epub+zip"}]}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	c := New(nil, slog.New(slog.DiscardHandler))
+	tree, err := c.Crawl(t.Context(), config.FeedConfig{Name: "Books", URL: upstream.URL + "/opds", PollDepth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Feed.Title != "Root" {
+		t.Errorf("root title = %q, want Root", tree.Feed.Title)
+	}
+	child, ok := tree.Children["fiction"]
+	if !ok {
+		t.Fatalf("typeless navigation link not crawled; children: %v", tree.Children)
+	}
+	if len(child.Feed.Entries) != 1 || !child.Feed.Entries[0].HasAcquisitionLinks() {
+		t.Errorf("fiction entries = %+v, want one publication", child.Feed.Entries)
+	}
+	if !tree.Complete {
+		t.Error("fully crawled catalog not complete")
+	}
+}
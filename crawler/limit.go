@@ -0,0 +1,227 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+// maxRetries is how many times a request is retried after the upstream
+// answered 429 or 503 with a Retry-After header.
+const maxRetries = 2
+
+// limiter enforces the upstream limits on every request the crawler makes:
+// a cap on concurrent requests per host, a token bucket per source, and the
+// back-off upstreams ask for with Retry-After.
+type limiter struct {
+	mu           sync.Mutex
+	maxPerHost   int             // 0 = unlimited
+	rates        map[string]rate // by source slug; missing = unlimited
+	maxRetryWait time.Duration
+	crawlWorkers int // feeds of one source fetched in parallel by a crawl
+	hosts        map[string]*hostLimit
+	buckets      map[string]*tokenBucket
+}
+
+type rate struct {
+	perSecond float64
+	burst     int
+}
+
+type hostLimit struct {
+	slots      chan struct{} // one element per request in flight; nil = unlimited
+	retryUntil time.Time     // no requests before this, as asked by Retry-After
+}
+
+// tokenBucket holds up to rate.burst tokens and refills at rate.perSecond.
+// Tokens may go negative: each waiting request reserves the next token.
+type tokenBucket struct {
+	rate   rate
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		rates:        make(map[string]rate),
+		maxRetryWait: time.Minute,
+		crawlWorkers: 1,
+		hosts:        make(map[string]*hostLimit),
+		buckets:      make(map[string]*tokenBucket),
+	}
+}
+
+// SetLimits configures the upstream limits: at most up.MaxPerHost
+// concurrent requests to any one host, and a token bucket per feed (the
+// feed's rate_limit, else up.RateLimit), and lets crawls fetch up to
+// up.CrawlWorkers feeds of a source in parallel. It can be called again to apply a
+// reloaded configuration; requests in flight are not affected.
+func (c *Crawler) SetLimits(up config.UpstreamConfig, feeds []config.FeedConfig) {
+	maxRetryWait, _ := up.ParsedMaxRetryWait()
+	rates := make(map[string]rate)
+	for _, fc := range feeds {
+		r := rate{perSecond: up.RateLimit, burst: max(up.RateBurst, 1)}
+		if fc.RateLimit > 0 {
+			r.perSecond = fc.RateLimit
+		}
+		if r.perSecond > 0 {
+			rates[fc.Slug()] = r
+		}
+	}
+
+	l := c.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if up.MaxPerHost != l.maxPerHost {
+		l.maxPerHost = up.MaxPerHost
+		for _, hl := range l.hosts {
+			hl.slots = newSlots(l.maxPerHost)
+		}
+	}
+	l.rates = rates
+	l.maxRetryWait = maxRetryWait
+	l.crawlWorkers = max(up.CrawlWorkers, 1)
+	for slug, b := range l.buckets {
+		if r, ok := rates[slug]; !ok || r != b.rate {
+			delete(l.buckets, slug)
+		}
+	}
+}
+
+func newSlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquire waits until a request from source to host may be sent: until any
+// Retry-After back-off for the host has passed, the source's token bucket
+// has a token, and the host has a free slot. The returned function releases
+// the slot. Back-offs longer than max_retry_wait fail immediately.
+func (l *limiter) acquire(ctx context.Context, source, host string) (func(), error) {
+	l.mu.Lock()
+	hl := l.host(host)
+	until := hl.retryUntil
+	maxRetryWait := l.maxRetryWait
+	l.mu.Unlock()
+	wait := time.Until(until)
+	if wait > maxRetryWait {
+		return nil, fmt.Errorf("%s asked to retry after %s", host, until.Format(time.RFC3339))
+	}
+	if err := sleep(ctx, wait); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	wait = l.reserve(source)
+	slots := hl.slots
+	l.mu.Unlock()
+	if err := sleep(ctx, wait); err != nil {
+		return nil, err
+	}
+
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// retryWait returns the longest Retry-After delay that is waited out.
+func (l *limiter) retryWait() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxRetryWait
+}
+
+// workers returns how many feeds a crawl may fetch in parallel.
+func (l *limiter) workers() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.crawlWorkers
+}
+
+// backoff pauses requests to host for d, as asked by a Retry-After header.
+func (l *limiter) backoff(host string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hl := l.host(host)
+	if until := time.Now().Add(d); until.After(hl.retryUntil) {
+		hl.retryUntil = until
+	}
+}
+
+// host returns the state for host, creating it if needed. l.mu must be held.
+func (l *limiter) host(host string) *hostLimit {
+	hl, ok := l.hosts[host]
+	if !ok {
+		hl = &hostLimit{slots: newSlots(l.maxPerHost)}
+		l.hosts[host] = hl
+	}
+	return hl
+}
+
+// reserve takes a token from source's bucket and returns how long to wait
+// before it becomes available. l.mu must be held.
+func (l *limiter) reserve(source string) time.Duration {
+	r, ok := l.rates[source]
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	b, ok := l.buckets[source]
+	if !ok {
+		b = &tokenBucket{rate: r, tokens: float64(r.burst), last: now}
+		l.buckets[source] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*r.perSecond, float64(r.burst))
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / r.perSecond * float64(time.Second))
+}
+
+// retryAfter returns the delay a 429 or 503 response asks for in its
+// Retry-After header, given either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
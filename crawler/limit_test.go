@@ -0,0 +1,191 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{"seconds", http.StatusTooManyRequests, "120", 120 * time.Second, 120 * time.Second, true},
+		{"unavailable", http.StatusServiceUnavailable, "5", 5 * time.Second, 5 * time.Second, true},
+		{"zero", http.StatusTooManyRequests, "0", 0, 0, true},
+		{"negative", http.StatusTooManyRequests, "-3", 0, 0, true},
+		{"http date", http.StatusTooManyRequests, time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute, true},
+		{"past date", http.StatusTooManyRequests, "Mon, 02 Jan 2006 15:04:05 GMT", 0, 0, true},
+		{"garbage", http.StatusTooManyRequests, "soon", 0, 0, false},
+		{"missing", http.StatusTooManyRequests, "", 0, 0, false},
+		{"other status", http.StatusInternalServerError, "10", 0, 0, false},
+		{"ok", http.StatusOK, "10", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			got, ok := retryAfter(resp)
+			if ok != tt.ok || got < tt.min || got > tt.max {
+				t.Errorf("retryAfter = %v, %v; want %v..%v, %v", got, ok, tt.min, tt.max, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64
+		burst  int
+		source string
+		want   []time.Duration // waits for consecutive requests
+	}{
+		{"unlimited source", 10, 2, "other", []time.Duration{0, 0, 0, 0}},
+		{"burst then rate", 10, 2, "books", []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{"burst of one", 2, 1, "books", []time.Duration{0, 500 * time.Millisecond, time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(nil, slog.New(slog.DiscardHandler))
+			c.SetLimits(config.UpstreamConfig{RateLimit: tt.rate, RateBurst: tt.burst},
+				[]config.FeedConfig{{Name: "Books", URL: "http://books.test"}})
+			for i, want := range tt.want {
+				got := c.limits.reserve(tt.source)
+				// Allow for the time that passes between calls.
+				if got > want || got < want-10*time.Millisecond {
+					t.Errorf("request %d: wait %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		wantErr bool
+	}{
+		{"none", 0, false},
+		{"waited out", 20 * time.Millisecond, false},
+		{"longer than max_retry_wait", time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(nil, slog.New(slog.DiscardHandler))
+			c.SetLimits(config.UpstreamConfig{MaxRetryWait: "1s"}, nil)
+			c.limits.backoff("books.test", tt.backoff)
+
+			start := time.Now()
+			release, err := c.limits.acquire(context.Background(), "books", "books.test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquire error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if time.Since(start) > 100*time.Millisecond {
+					t.Error("long back-off was waited for instead of failing fast")
+				}
+				return
+			}
+			release()
+			if waited := time.Since(start); waited < tt.backoff {
+				t.Errorf("waited %v, want at least %v", waited, tt.backoff)
+			}
+		})
+	}
+}
+
+func TestDoRetriesAfterRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"short delay is retried", "0", http.StatusOK, 2},
+		{"long delay is returned", "3600", http.StatusTooManyRequests, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+
+			c := New(nil, slog.New(slog.DiscardHandler))
+			c.SetLimits(config.UpstreamConfig{MaxRetryWait: "1s"}, nil)
+			req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+			resp, err := c.do(req, kindFeed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus || calls.Load() != tt.wantCalls {
+				t.Errorf("got HTTP %d after %d calls, want HTTP %d after %d", resp.StatusCode, calls.Load(), tt.wantStatus, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHostSlotWhileStreaming(t *testing.T) {
+	tests := []struct {
+		kind    string
+		blocked bool // whether an open body keeps other requests to the host waiting
+	}{
+		{kindFeed, true},
+		{kindDownload, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			done := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					w.WriteHeader(http.StatusOK)
+					w.(http.Flusher).Flush()
+					<-done
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer upstream.Close()
+			defer close(done)
+
+			c := New(nil, slog.New(slog.DiscardHandler))
+			c.SetLimits(config.UpstreamConfig{MaxPerHost: 1}, nil)
+			req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/slow", nil)
+			slow, err := c.do(req, tt.kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer slow.Body.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err = c.FetchDocument(ctx, upstream.URL+"/doc", nil, 1024)
+			if blocked := errors.Is(err, context.DeadlineExceeded); blocked != tt.blocked {
+				t.Errorf("second request error = %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/metrics"
+)
+
+type sourceKey struct{}
+
+// WithSource returns a context that attributes upstream requests made with
+// it to the feed with the given slug, for metrics.
+func WithSource(ctx context.Context, slug string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, slug)
+}
+
+// SourceFromContext returns the feed slug set by WithSource, or "".
+func SourceFromContext(ctx context.Context) string {
+	slug, _ := ctx.Value(sourceKey{}).(string)
+	return slug
+}
+
+// Request kinds used as the "kind" metrics label.
+const (
+	kindFeed     = "feed"
+	kindDownload = "download"
+)
+
+// do sends req within the upstream limits (see SetLimits) and records its
+// latency, status code and body size. The host slot taken for a feed request
+// is held until the response body is closed; downloads give it back as soon
+// as the response headers arrive, so long transfers don't hold up crawls.
+//
+// A 429 or 503 response with a Retry-After header pauses every request to
+// the host for that long, and req is retried once the delay has passed, up
+// to maxRetries times. Delays longer than upstream.max_retry_wait are not
+// waited out: the response is returned as is, and further requests to the
+// host fail until the delay is over.
+func (c *Crawler) do(req *http.Request, kind string) (*http.Response, error) {
+	ctx := req.Context()
+	source := SourceFromContext(ctx)
+	host := req.URL.Host
+	for attempt := 0; ; attempt++ {
+		release, err := c.limits.acquire(ctx, source, host)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		metrics.UpstreamDuration.WithLabelValues(source, kind).Observe(time.Since(start).Seconds())
+		if err != nil {
+			release()
+			metrics.UpstreamRequests.WithLabelValues(source, kind, "error").Inc()
+			return nil, err
+		}
+		metrics.UpstreamRequests.WithLabelValues(source, kind, strconv.Itoa(resp.StatusCode)).Inc()
+
+		if delay, ok := retryAfter(resp); ok {
+			c.limits.backoff(host, delay)
+			c.logger.Warn("upstream asked to retry later", "host", host, "status", resp.StatusCode, "retryAfter", delay)
+			if attempt < maxRetries && delay <= c.limits.retryWait() {
+				resp.Body.Close()
+				release()
+				continue
+			}
+		}
+
+		if kind == kindDownload {
+			release()
+			release = func() {}
+		}
+		resp.Body = &countingBody{ReadCloser: resp.Body, source: source, kind: kind, release: release}
+		return resp, nil
+	}
+}
+
+// countingBody adds the bytes read from a response body to UpstreamBytes,
+// and releases the request's host slot when closed.
+type countingBody struct {
+	io.ReadCloser
+	source, kind string
+	release      func()
+	once         sync.Once
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		metrics.UpstreamBytes.WithLabelValues(b.source, b.kind).Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,167 @@
+package crawler
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// FeedTree represents a cached upstream feed and its navigable children.
+//
+// The crawler builds a tree on its own goroutine; once stored in the feed
+// cache it is shared, and request handlers keep growing it: on-demand
+// fetches add children and lazy loading appends upstream pages. From then
+// on Feed, Children, HasMoreUpstream and NextUpstreamURL must only be
+// accessed through the methods below, which lock the node. Feeds are
+// copy-on-write: a feed returned by Snapshot is never modified afterwards,
+// so callers can read it without holding any lock.
+type FeedTree struct {
+	Feed            *opds.Feed
+	URL             string
+	Children        map[string]*FeedTree // keyed by path relative to the source root
+	SearchURL       string               // OpenSearch description URL, if found
+	HasMoreUpstream bool                 // true if upstream has more pages available
+	NextUpstreamURL string               // URL for the next upstream page (if HasMoreUpstream)
+	ETag            string               // validator from the last fetch of URL, for conditional requests
+	LastModified    string               // Last-Modified from the last fetch of URL, for conditional requests
+	Complete        bool                 // root only: every navigation link and upstream page was crawled
+	FetchedAt       time.Time            // when the node was fetched on demand; zero for nodes crawled with their tree
+
+	mu sync.RWMutex // guards Feed, Children, HasMoreUpstream and NextUpstreamURL
+}
+
+// Snapshot returns the node's feed and upstream pagination state.
+func (t *FeedTree) Snapshot() (feed *opds.Feed, hasMore bool, nextURL string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.Feed, t.HasMoreUpstream, t.NextUpstreamURL
+}
+
+// Child returns the child stored under key.
+func (t *FeedTree) Child(key string) (*FeedTree, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	child, ok := t.Children[key]
+	return child, ok
+}
+
+// ChildNodes returns a copy of the node's children.
+func (t *FeedTree) ChildNodes() map[string]*FeedTree {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	children := make(map[string]*FeedTree, len(t.Children))
+	for k, v := range t.Children {
+		children[k] = v
+	}
+	return children
+}
+
+// AddChild stores child under key and returns it. If another child was
+// stored under key first, that one is kept and returned instead.
+func (t *FeedTree) AddChild(key string, child *FeedTree) *FeedTree {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing, ok := t.Children[key]; ok {
+		return existing
+	}
+	if t.Children == nil {
+		t.Children = make(map[string]*FeedTree)
+	}
+	t.Children[key] = child
+	return child
+}
+
+// ReplaceChild stores child under key in place of old and reports whether
+// it did. It does nothing if key no longer holds old, e.g. because a crawl
+// replaced the tree or old was evicted.
+func (t *FeedTree) ReplaceChild(key string, old, child *FeedTree) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Children[key] != old {
+		return false
+	}
+	t.Children[key] = child
+	return true
+}
+
+// RemoveChild removes child from under key. It does nothing if key now
+// holds a different node.
+func (t *FeedTree) RemoveChild(key string, child *FeedTree) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Children[key] == child {
+		delete(t.Children, key)
+	}
+}
+
+// AppendPage adds the entries of the upstream page fetched from `from` to the
+// node's feed and records the pagination state that follows it. The page is
+// only appended if `from` is still the node's next upstream URL, so a page
+// loaded twice by concurrent requests is not duplicated. It reports whether
+// the page was appended.
+func (t *FeedTree) AppendPage(from string, page *opds.Feed, hasMore bool, nextURL string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Feed == nil || !t.HasMoreUpstream || t.NextUpstreamURL != from {
+		return false
+	}
+	feed := *t.Feed
+	feed.Entries = append(slices.Clip(t.Feed.Entries), page.Entries...)
+	t.Feed = &feed
+	t.HasMoreUpstream = hasMore
+	t.NextUpstreamURL = nextURL
+	return true
+}
+
+// Stale reports whether a node fetched on demand is older than ttl. Nodes
+// crawled with their tree are refreshed with it and never stale; a ttl of 0
+// disables expiry.
+func (t *FeedTree) Stale(ttl time.Duration) bool {
+	return ttl > 0 && !t.FetchedAt.IsZero() && time.Since(t.FetchedAt) > ttl
+}
+
+// Walk calls fn for the node and all of its descendants with a snapshot of
+// each node's feed (which may be nil).
+func (t *FeedTree) Walk(fn func(node *FeedTree, feed *opds.Feed)) {
+	feed, _, _ := t.Snapshot()
+	fn(t, feed)
+	for _, child := range t.ChildNodes() {
+		child.Walk(fn)
+	}
+}
+
+// feedTreeJSON is the snapshot encoding of a FeedTree, with the same field
+// names as the struct itself.
+type feedTreeJSON struct {
+	Feed            *opds.Feed
+	URL             string
+	Children        map[string]*FeedTree
+	SearchURL       string
+	HasMoreUpstream bool
+	NextUpstreamURL string
+	ETag            string
+	LastModified    string
+	Complete        bool
+	FetchedAt       time.Time `json:",omitzero"`
+}
+
+// MarshalJSON encodes the tree while holding each node's lock in turn, so a
+// snapshot can be written while handlers are adding to the tree.
+func (t *FeedTree) MarshalJSON() ([]byte, error) {
+	feed, hasMore, nextURL := t.Snapshot()
+	return json.Marshal(feedTreeJSON{
+		Feed:            feed,
+		URL:             t.URL,
+		Children:        t.ChildNodes(),
+		SearchURL:       t.SearchURL,
+		HasMoreUpstream: hasMore,
+		NextUpstreamURL: nextURL,
+		ETag:            t.ETag,
+		LastModified:    t.LastModified,
+		Complete:        t.Complete,
+		FetchedAt:       t.FetchedAt,
+	})
+}
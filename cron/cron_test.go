@@ -0,0 +1,71 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"0 0 31 2 *",
+		"@fortnightly",
+	}
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// 2026-01-01 is a Thursday.
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		{"* * * * *", "2026-01-01 10:00", "2026-01-01 10:01"},
+		{"*/15 * * * *", "2026-01-01 10:07", "2026-01-01 10:15"},
+		{"0 4 * * *", "2026-01-01 04:00", "2026-01-02 04:00"},
+		{"0 4 * * *", "2026-01-01 03:59", "2026-01-01 04:00"},
+		{"30 9 * * 1-5", "2026-01-02 10:00", "2026-01-05 09:30"},
+		{"0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 0 1 * *", "2026-01-15 12:00", "2026-02-01 00:00"},
+		{"0 0 13 * 5", "2026-01-01 00:00", "2026-01-02 00:00"},
+		{"0 12 29 2 *", "2026-01-01 00:00", "2028-02-29 12:00"},
+		{"5/20 * * * *", "2026-01-01 10:06", "2026-01-01 10:25"},
+		{"0 8,20 * * *", "2026-01-01 09:00", "2026-01-01 20:00"},
+		{"@hourly", "2026-01-01 10:30", "2026-01-01 11:00"},
+		{"@weekly", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"@yearly", "2026-03-01 00:00", "2027-01-01 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if got, want := s.Next(at(tt.after)), at(tt.want); !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.after, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
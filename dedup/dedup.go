@@ -0,0 +1,297 @@
+// Package dedup identifies entries from different sources that describe the
+// same work and merges them into a single entry.
+package dedup
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// Item is an entry together with the name of the source it came from.
+type Item struct {
+	Source string
+	Entry  opds.Entry
+}
+
+// Merge collapses items that describe the same work. Two items are the same
+// work if they share an identifier (ISBN, UUID or DOI, taken from the entry
+// id or dc:identifier), or, when neither has one, the same normalized title
+// and author. Items from the same source are never merged: a source listing
+// two entries means two works or editions. The merged entry keeps the metadata of the first item and carries
+// the acquisition links of every item, each titled with its source name.
+// Entries are returned in order of first appearance.
+func Merge(items []Item) []opds.Entry {
+	parent := make([]int, len(items))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// Sources of the items in each group, by root. Items without a source
+	// name cannot be told apart and count as sources of their own.
+	sources := make([]map[string]bool, len(items))
+	for i, it := range items {
+		sources[i] = map[string]bool{}
+		if it.Source != "" {
+			sources[i][it.Source] = true
+		}
+	}
+	union := func(a, b int) {
+		ra, rb := find(a), find(b)
+		if ra == rb {
+			return
+		}
+		for src := range sources[rb] {
+			if sources[ra][src] {
+				return
+			}
+		}
+		// Keep the earliest item as the root so it supplies the metadata.
+		if rb < ra {
+			ra, rb = rb, ra
+		}
+		parent[rb] = ra
+		for src := range sources[rb] {
+			sources[ra][src] = true
+		}
+		sources[rb] = nil
+	}
+
+	owner := make(map[string]int)
+	for i, it := range items {
+		for _, k := range Keys(it.Entry) {
+			if j, ok := owner[k]; ok {
+				union(i, j)
+			} else {
+				owner[k] = i
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	var roots []int
+	for i := range items {
+		r := find(i)
+		if _, ok := groups[r]; !ok {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], i)
+	}
+
+	out := make([]opds.Entry, 0, len(roots))
+	for _, r := range roots {
+		out = append(out, mergeGroup(items, groups[r]))
+	}
+	return out
+}
+
+// Keys returns the identity keys of an entry: its normalized identifiers,
+// or, for entries without any, a key made of the full title (subtitle
+// included) and first author. Entries with neither an identifier nor both a
+// title and an author have no keys.
+func Keys(e opds.Entry) []string {
+	var keys []string
+	for _, id := range append([]string{e.ID}, e.Identifiers...) {
+		if k := identifierKey(id); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 || len(e.Authors) == 0 {
+		return keys
+	}
+	title := normalizeText(stripArticle(e.Title))
+	author := authorKey(e.Authors[0].Name)
+	if title == "" || author == "" {
+		return nil
+	}
+	return []string{"title:" + title + "|" + author}
+}
+
+// identifierKey normalizes a cross-source identifier such as
+// "urn:isbn:978-0-14-143951-8" or "urn:uuid:…". Source-specific ids (URLs,
+// database ids) are ignored and return "".
+func identifierKey(id string) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	id = strings.TrimPrefix(id, "urn:")
+	switch {
+	case strings.HasPrefix(id, "isbn:"), strings.HasPrefix(id, "isbn "):
+		if isbn := normalizeISBN(id[5:]); isbn != "" {
+			return "isbn:" + isbn
+		}
+	case strings.HasPrefix(id, "uuid:"):
+		if u := strings.TrimSpace(id[5:]); u != "" {
+			return "uuid:" + u
+		}
+	case strings.HasPrefix(id, "doi:"):
+		if d := strings.TrimSpace(id[4:]); d != "" {
+			return "doi:" + d
+		}
+	}
+	return ""
+}
+
+// normalizeISBN strips separators and converts ISBN-10 to ISBN-13 so both
+// forms of the same book compare equal. Invalid lengths return "".
+func normalizeISBN(s string) string {
+	var digits []byte
+	for _, c := range []byte(s) {
+		if (c >= '0' && c <= '9') || c == 'x' || c == 'X' {
+			digits = append(digits, c)
+		}
+	}
+	switch len(digits) {
+	case 13:
+		return string(digits)
+	case 10:
+		isbn := append([]byte("978"), digits[:9]...)
+		sum := 0
+		for i, c := range isbn {
+			w := 1
+			if i%2 == 1 {
+				w = 3
+			}
+			sum += int(c-'0') * w
+		}
+		return string(append(isbn, byte('0'+(10-sum%10)%10)))
+	}
+	return ""
+}
+
+// normalizeText lowercases, strips punctuation, and collapses whitespace.
+func normalizeText(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+func stripArticle(title string) string {
+	lower := strings.ToLower(title)
+	for _, a := range []string{"the ", "a ", "an "} {
+		if strings.HasPrefix(lower, a) {
+			return title[len(a):]
+		}
+	}
+	return title
+}
+
+// authorKey normalizes an author name independently of word order, so
+// "Austen, Jane" and "Jane Austen" compare equal.
+func authorKey(name string) string {
+	words := strings.Fields(normalizeText(name))
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+func mergeGroup(items []Item, idx []int) opds.Entry {
+	first := items[idx[0]]
+	merged := first.Entry
+	merged.Links = nil
+	merged.Categories = append([]opds.Category(nil), first.Entry.Categories...)
+	merged.Identifiers = append([]string(nil), first.Entry.Identifiers...)
+
+	seenLinks := make(map[string]bool)
+	seenCats := make(map[string]bool)
+	seenIDs := make(map[string]bool)
+	for _, c := range merged.Categories {
+		seenCats[c.Scheme+"|"+c.Term] = true
+	}
+	for _, id := range merged.Identifiers {
+		seenIDs[id] = true
+	}
+	hasImage := false
+
+	for n, i := range idx {
+		it := items[i]
+		for _, l := range it.Entry.Links {
+			if seenLinks[l.Rel+"|"+l.Href] {
+				continue
+			}
+			switch {
+			case isAcquisitionRel(l.Rel):
+				if len(idx) > 1 && it.Source != "" {
+					l.Title = labelFor(l, it.Source)
+				}
+			case opds.IsImageRel(l.Rel):
+				// Covers come from the first source that has any.
+				if hasImage && n > 0 {
+					continue
+				}
+			case n > 0:
+				// Navigation and other links of later sources point into
+				// their own trees; the primary entry's links are enough.
+				continue
+			}
+			seenLinks[l.Rel+"|"+l.Href] = true
+			merged.Links = append(merged.Links, l)
+		}
+		for _, l := range merged.Links {
+			if opds.IsImageRel(l.Rel) {
+				hasImage = true
+			}
+		}
+
+		if n == 0 {
+			continue
+		}
+		for _, c := range it.Entry.Categories {
+			if !seenCats[c.Scheme+"|"+c.Term] {
+				seenCats[c.Scheme+"|"+c.Term] = true
+				merged.Categories = append(merged.Categories, c)
+			}
+		}
+		for _, id := range append([]string{it.Entry.ID}, it.Entry.Identifiers...) {
+			if identifierKey(id) != "" && id != merged.ID && !seenIDs[id] {
+				seenIDs[id] = true
+				merged.Identifiers = append(merged.Identifiers, id)
+			}
+		}
+		if merged.Summary == nil && it.Entry.Summary != nil {
+			merged.Summary = it.Entry.Summary
+		}
+		if merged.Language == "" {
+			merged.Language = it.Entry.Language
+		}
+		if merged.Publisher == "" {
+			merged.Publisher = it.Entry.Publisher
+		}
+	}
+	return merged
+}
+
+// labelFor titles an acquisition link with its source, keeping any existing
+// title (e.g. a format name) in front.
+func labelFor(l opds.Link, source string) string {
+	if l.Title == "" {
+		return source
+	}
+	return l.Title + " (" + source + ")"
+}
+
+func isAcquisitionRel(rel string) bool {
+	switch rel {
+	case opds.RelAcquisition, opds.RelOpenAccess, opds.RelBorrow,
+		opds.RelBuy, opds.RelSample, opds.RelSubscribe:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package dedup
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+func entry(title, author string, ids ...string) opds.Entry {
+	e := opds.Entry{Title: title, Identifiers: ids}
+	if author != "" {
+		e.Authors = []opds.Author{{Name: author}}
+	}
+	return e
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []Item
+		want  []string // titles of the merged entries
+	}{
+		{
+			name: "same isbn across sources",
+			items: []Item{
+				{"A", entry("Emma", "Jane Austen", "urn:isbn:978-0-14-143958-7")},
+				{"B", entry("Emma (Penguin)", "Austen, Jane", "urn:isbn:9780141439587")},
+			},
+			want: []string{"Emma"},
+		},
+		{
+			name: "isbn-10 matches isbn-13",
+			items: []Item{
+				{"A", entry("Emma", "", "urn:isbn:0-14-143958-X")},
+				{"B", entry("Emma", "", "urn:isbn:978-0-14-143958-7")},
+			},
+			want: []string{"Emma"},
+		},
+		{
+			name: "different isbns stay apart",
+			items: []Item{
+				{"A", entry("Emma", "Jane Austen", "urn:isbn:9780141439587")},
+				{"B", entry("Emma", "Jane Austen", "urn:isbn:9780199535521")},
+			},
+			want: []string{"Emma", "Emma"},
+		},
+		{
+			name: "title and author without identifiers",
+			items: []Item{
+				{"A", entry("The Time Machine", "H. G. Wells")},
+				{"B", entry("Time Machine", "Wells, H. G.")},
+			},
+			want: []string{"The Time Machine"},
+		},
+		{
+			name: "subtitles keep volumes apart",
+			items: []Item{
+				{"A", entry("The Lord of the Rings: The Fellowship of the Ring", "J. R. R. Tolkien")},
+				{"B", entry("The Lord of the Rings: The Two Towers", "J. R. R. Tolkien")},
+			},
+			want: []string{"The Lord of the Rings: The Fellowship of the Ring", "The Lord of the Rings: The Two Towers"},
+		},
+		{
+			name: "no author no title match",
+			items: []Item{
+				{"A", entry("Poems", "")},
+				{"B", entry("Poems", "")},
+			},
+			want: []string{"Poems", "Poems"},
+		},
+		{
+			name: "identifier entry not matched by title",
+			items: []Item{
+				{"A", entry("Emma", "Jane Austen", "urn:isbn:9780141439587")},
+				{"B", entry("Emma", "Jane Austen")},
+			},
+			want: []string{"Emma", "Emma"},
+		},
+		{
+			name: "same source never merged",
+			items: []Item{
+				{"A", entry("Emma", "Jane Austen", "urn:isbn:9780141439587")},
+				{"A", entry("Emma (annotated)", "Jane Austen", "urn:isbn:9780141439587")},
+			},
+			want: []string{"Emma", "Emma (annotated)"},
+		},
+		{
+			name: "same source not merged through another",
+			items: []Item{
+				{"A", entry("Emma", "", "urn:uuid:1")},
+				{"B", entry("Emma", "", "urn:uuid:1", "urn:uuid:2")},
+				{"A", entry("Emma 2", "", "urn:uuid:2")},
+			},
+			want: []string{"Emma", "Emma 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range Merge(tt.items) {
+				got = append(got, e.Title)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Merge = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeLinks(t *testing.T) {
+	a := entry("Emma", "", "urn:isbn:9780141439587")
+	a.Links = []opds.Link{
+		{Rel: opds.RelAcquisition, Href: "http://a/emma.epub", Title: "EPUB"},
+		{Rel: opds.RelImage, Href: "http://a/cover.jpg"},
+	}
+	b := entry("Emma", "", "urn:isbn:9780141439587")
+	b.Links = []opds.Link{
+		{Rel: opds.RelAcquisition, Href: "http://b/emma.epub"},
+		{Rel: opds.RelImage, Href: "http://b/cover.jpg"},
+	}
+	merged := Merge([]Item{{"A", a}, {"B", b}})
+	if len(merged) != 1 {
+		t.Fatalf("got %d entries, want 1", len(merged))
+	}
+	var got []string
+	for _, l := range merged[0].Links {
+		got = append(got, l.Href+" "+l.Title)
+	}
+	want := []string{"http://a/emma.epub EPUB (A)", "http://a/cover.jpg ", "http://b/emma.epub B"}
+	if !slices.Equal(got, want) {
+		t.Errorf("links = %q, want %q", got, want)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry opds.Entry
+		want  []string
+	}{
+		{"identifiers only", entry("Emma", "Jane Austen", "urn:isbn:978-0-14-143958-7", "urn:uuid:ABC"),
+			[]string{"isbn:9780141439587", "uuid:abc"}},
+		{"id from entry id", opds.Entry{ID: "urn:doi:10.1000/182", Title: "Handbook"}, []string{"doi:10.1000/182"}},
+		{"title and author", entry("The Time Machine", "Wells, H. G."), []string{"title:time machine|g h wells"}},
+		{"subtitle kept", entry("Dune: Messiah", "Frank Herbert"), []string{"title:dune messiah|frank herbert"}},
+		{"no author", entry("Poems", ""), nil},
+		{"no title", entry("", "Anonymous"), nil},
+		{"source ids ignored", opds.Entry{ID: "https://example.com/book/1", Title: "Emma"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Keys(tt.entry); !slices.Equal(got, tt.want) {
+				t.Errorf("Keys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Package index maintains an in-process full-text index over the books in
+// cached catalogs, so searches can be answered without upstream round trips.
+package index
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unsafe"
+
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// Field weights used when scoring a match.
+const (
+	weightTitle     = 3.0
+	weightAuthor    = 2.0
+	weightCategory  = 1.5
+	weightPublisher = 1.0
+	weightSummary   = 1.0
+)
+
+// Hit is a search result.
+type Hit struct {
+	Slug  string     // source the entry came from
+	Entry opds.Entry // links are absolute upstream URLs
+	Score float64
+}
+
+// Index is a per-source inverted index. Each source is rebuilt as a whole
+// when its tree changes, so searches always see a consistent snapshot.
+type Index struct {
+	mu      sync.RWMutex
+	sources map[string]*sourceIndex
+}
+
+type sourceIndex struct {
+	entries  []opds.Entry
+	postings map[string][]posting // term → entries containing it
+	complete bool
+	size     int64 // approximate bytes held
+}
+
+type posting struct {
+	doc    int
+	weight float64 // field-weighted term frequency
+}
+
+// New creates an empty index.
+func New() *Index {
+	return &Index{sources: make(map[string]*sourceIndex)}
+}
+
+// Update replaces the indexed entries of a source with the books (entries
+// with acquisition links) found anywhere in tree. Entry links are resolved
+// against the URL of the feed they were found in.
+func (ix *Index) Update(slug string, tree *crawler.FeedTree) {
+	si := &sourceIndex{
+		postings: make(map[string][]posting),
+		complete: tree.Complete,
+	}
+	seen := make(map[string]bool)
+	tree.Walk(func(node *crawler.FeedTree, feed *opds.Feed) {
+		if feed == nil {
+			return
+		}
+		for _, e := range feed.Entries {
+			if !e.HasAcquisitionLinks() {
+				continue
+			}
+			id := e.ID
+			if id == "" {
+				id = e.Title
+			}
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			si.add(absoluteLinks(e, node.URL))
+		}
+	})
+
+	ix.mu.Lock()
+	ix.sources[slug] = si
+	ix.mu.Unlock()
+}
+
+// Size returns the approximate memory held by a source's index: the entry
+// copies with their resolved links, and the postings. Strings shared with the
+// cached tree are not counted again.
+func (ix *Index) Size(slug string) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if si, ok := ix.sources[slug]; ok {
+		return si.size
+	}
+	return 0
+}
+
+// Remove drops a source from the index.
+func (ix *Index) Remove(slug string) {
+	ix.mu.Lock()
+	delete(ix.sources, slug)
+	ix.mu.Unlock()
+}
+
+// Complete reports whether a source was fully crawled when it was indexed,
+// i.e. whether local results cover its whole catalog.
+func (ix *Index) Complete(slug string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	si, ok := ix.sources[slug]
+	return ok && si.complete
+}
+
+// Search returns up to limit entries matching query from the given sources
+// (all sources if slugs is nil), best match first. Entries are scored by
+// field-weighted term frequency times inverse document frequency, and
+// entries matching more of the query terms rank higher.
+func (ix *Index) Search(query string, slugs []string, limit int) []Hit {
+	terms := uniqueTokens(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	sources := slugs
+	if sources == nil {
+		for slug := range ix.sources {
+			sources = append(sources, slug)
+		}
+	}
+
+	// Document frequencies across all searched sources.
+	total := 0
+	df := make(map[string]int, len(terms))
+	for _, slug := range sources {
+		si, ok := ix.sources[slug]
+		if !ok {
+			continue
+		}
+		total += len(si.entries)
+		for _, t := range terms {
+			df[t] += len(si.postings[t])
+		}
+	}
+
+	var hits []Hit
+	for _, slug := range sources {
+		si, ok := ix.sources[slug]
+		if !ok {
+			continue
+		}
+		scores := make(map[int]float64)
+		matched := make(map[int]int)
+		for _, t := range terms {
+			if df[t] == 0 {
+				continue
+			}
+			idf := math.Log(1 + float64(total)/float64(df[t]))
+			for _, p := range si.postings[t] {
+				scores[p.doc] += p.weight * idf
+				matched[p.doc]++
+			}
+		}
+		for doc, score := range scores {
+			coverage := float64(matched[doc]) / float64(len(terms))
+			hits = append(hits, Hit{
+				Slug:  slug,
+				Entry: si.entries[doc],
+				Score: score * coverage * coverage,
+			})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Entry.Title < hits[j].Entry.Title
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+func (si *sourceIndex) add(e opds.Entry) {
+	doc := len(si.entries)
+	si.entries = append(si.entries, e)
+	si.size += int64(unsafe.Sizeof(e)) + opds.LinksSize(e.Links)
+
+	weights := make(map[string]float64)
+	addField := func(text string, w float64) {
+		for _, t := range tokenize(text) {
+			weights[t] += w
+		}
+	}
+	addField(e.Title, weightTitle)
+	for _, a := range e.Authors {
+		addField(a.Name, weightAuthor)
+	}
+	for _, c := range e.Categories {
+		addField(c.Label, weightCategory)
+		if c.Label == "" {
+			addField(c.Term, weightCategory)
+		}
+	}
+	addField(e.Publisher, weightPublisher)
+	if e.Summary != nil {
+		addField(stripTags(e.Summary.Body), weightSummary)
+	} else if e.Content != nil {
+		addField(stripTags(e.Content.Body), weightSummary)
+	}
+
+	for t, w := range weights {
+		if _, ok := si.postings[t]; !ok {
+			si.size += int64(len(t)) + int64(unsafe.Sizeof(t)) + int64(unsafe.Sizeof([]posting(nil)))
+		}
+		// Dampen repeated terms so long summaries don't dominate titles.
+		si.postings[t] = append(si.postings[t], posting{doc: doc, weight: 1 + math.Log(w)})
+		si.size += int64(unsafe.Sizeof(posting{}))
+	}
+}
+
+// absoluteLinks returns a copy of e with link hrefs resolved against base.
+func absoluteLinks(e opds.Entry, base string) opds.Entry {
+	links := make([]opds.Link, len(e.Links))
+	for i, l := range e.Links {
+		links[i] = l
+		links[i].Href = crawler.ResolveURL(base, l.Href)
+	}
+	e.Links = links
+	return e
+}
+
+// tokenize lowercases text and splits it into letter/digit runs.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func uniqueTokens(text string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, t := range tokenize(text) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func stripTags(s string) string {
+	return tagPattern.ReplaceAllString(s, " ")
+}
@@ -0,0 +1,126 @@
+package index
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// book returns an acquisition entry linking to a relative download.
+func book(id, title, author, summary string) opds.Entry {
+	href := strings.TrimPrefix(id, "urn:") + ".epub"
+	e := opds.Entry{
+		ID:      id,
+		Title:   title,
+		Authors: []opds.Author{{Name: author}},
+		Links:   []opds.Link{{Rel: opds.RelAcquisition, Href: href, Type: "application/epub+zip"}},
+	}
+	if summary != "" {
+		e.Summary = &opds.Text{Body: summary}
+	}
+	return e
+}
+
+// tree returns a source root at url holding entries, with a "more" sub-feed
+// holding more.
+func tree(url string, complete bool, entries []opds.Entry, more ...opds.Entry) *crawler.FeedTree {
+	root := &crawler.FeedTree{
+		URL:      url,
+		Feed:     &opds.Feed{Title: "Root", Entries: entries},
+		Children: make(map[string]*crawler.FeedTree),
+		Complete: complete,
+	}
+	if len(more) > 0 {
+		root.Children["more"] = &crawler.FeedTree{URL: url + "/more/", Feed: &opds.Feed{Title: "More", Entries: more}}
+	}
+	return root
+}
+
+func titles(hits []Hit) []string {
+	var out []string
+	for _, h := range hits {
+		out = append(out, h.Entry.Title)
+	}
+	return out
+}
+
+func TestSearchRanking(t *testing.T) {
+	ix := New()
+	ix.Update("books", tree("http://example.com/opds", true, []opds.Entry{
+		book("urn:1", "Dune", "Frank Herbert", ""),
+		book("urn:2", "Dune Messiah", "Frank Herbert", ""),
+		book("urn:3", "Arrakis", "Someone Else", "<p>A sequel to <b>Dune</b>.</p>"),
+		book("urn:4", "Messiah", "Handel", ""),
+		book("urn:5", "Children of Dune", "Frank Herbert", ""),
+	}))
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// Title matches outrank summary matches; equal scores sort by title.
+		{"dune", []string{"Children of Dune", "Dune", "Dune Messiah", "Arrakis"}},
+		// Entries matching every term come first, then rarer terms.
+		{"Dune Messiah", []string{"Dune Messiah", "Messiah", "Children of Dune", "Dune", "Arrakis"}},
+		{"herbert", []string{"Children of Dune", "Dune", "Dune Messiah"}},
+		// Markup in summaries is not indexed.
+		{"b", nil},
+		{"nothing", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := titles(ix.Search(tt.query, nil, 0)); !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	if got := titles(ix.Search("dune", nil, 2)); !slices.Equal(got, []string{"Children of Dune", "Dune"}) {
+		t.Errorf("limited search = %q", got)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	nav := opds.Entry{
+		ID:    "urn:nav",
+		Title: "Dune collection",
+		Links: []opds.Link{{Rel: opds.RelSubsection, Href: "dune", Type: opds.MediaTypeOPDSNav}},
+	}
+	ix := New()
+	ix.Update("one", tree("http://one.example.com/opds", false,
+		[]opds.Entry{nav, book("urn:dune", "Dune", "Frank Herbert", "")},
+		book("urn:dune", "Dune", "Frank Herbert", ""), // also listed in a sub-feed
+		book("urn:emma", "Emma", "Jane Austen", ""),
+	))
+	ix.Update("two", tree("http://two.example.com/opds", true, []opds.Entry{book("urn:other", "Dune", "Frank Herbert", "")}))
+
+	hits := ix.Search("dune", []string{"one"}, 0)
+	if len(hits) != 1 || hits[0].Slug != "one" {
+		t.Fatalf("hits = %+v, want the book once and without the navigation entry", hits)
+	}
+	if href := hits[0].Entry.Links[0].Href; href != "http://one.example.com/opds/dune.epub" {
+		t.Errorf("link = %q, want it resolved against its feed", href)
+	}
+	if hits := ix.Search("emma", nil, 0); len(hits) != 1 || hits[0].Entry.Links[0].Href != "http://one.example.com/opds/more/emma.epub" {
+		t.Errorf("sub-feed hits = %+v", hits)
+	}
+	if hits := ix.Search("dune", nil, 0); len(hits) != 2 {
+		t.Errorf("got %d hits across sources, want 2", len(hits))
+	}
+
+	if ix.Complete("one") || !ix.Complete("two") || ix.Complete("missing") {
+		t.Error("Complete does not follow the indexed trees")
+	}
+	if ix.Size("one") <= ix.Size("two") || ix.Size("two") <= 0 {
+		t.Errorf("sizes = %d, %d; want the larger index to be bigger", ix.Size("one"), ix.Size("two"))
+	}
+
+	ix.Remove("one")
+	if hits := ix.Search("emma", nil, 0); len(hits) != 0 || ix.Size("one") != 0 {
+		t.Errorf("removed source still indexed: %+v", hits)
+	}
+}
@@ -3,18 +3,20 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
+	"github.com/madeddie/opds-aggregator/blobcache"
 	"github.com/madeddie/opds-aggregator/cache"
 	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/convert"
 	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/index"
+	"github.com/madeddie/opds-aggregator/poller"
 	"github.com/madeddie/opds-aggregator/search"
 	"github.com/madeddie/opds-aggregator/server"
 )
@@ -36,69 +38,137 @@ func main() {
 		cfgPath = config.FindConfig()
 	}
 
-	var cfg *config.Config
-	var err error
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		logger.Error("failed to load config", "path", cfgPath, "error", err)
+		os.Exit(1)
+	}
 	if cfgPath != "" {
-		cfg, err = config.Load(cfgPath)
-		if err != nil {
-			logger.Error("failed to load config", "error", err)
-			os.Exit(1)
-		}
 		logger.Info("config loaded", "path", cfgPath, "feeds", len(cfg.Feeds))
 	} else {
-		cfg, err = config.LoadFromEnv()
+		logger.Info("config loaded from environment variables", "feeds", len(cfg.Feeds))
+	}
+
+	// Initialize components.
+	var store cache.Store
+	if cfg.Cache.Dir != "" {
+		fileStore, err := cache.NewFileStore(cfg.Cache.Dir)
 		if err != nil {
-			logger.Error("failed to load config from environment", "error", err)
+			logger.Error("failed to open cache directory", "error", err)
 			os.Exit(1)
 		}
-		logger.Info("config loaded from environment variables", "feeds", len(cfg.Feeds))
+		store = fileStore
 	}
 
-	// Initialize components.
 	httpClient := &http.Client{Timeout: 60 * time.Second}
 	crawl := crawler.New(httpClient, logger)
-	feedCache := cache.NewFeedCache(logger)
-	searcher := search.New(cfg, feedCache, crawl, logger)
+	crawl.SetLimits(cfg.Upstream, cfg.Feeds)
+	feedCache := cache.NewFeedCache(logger, store)
+
+	// Keep the local search index in sync with every cache update, and count
+	// it towards the cache's memory budget.
+	searchIndex := index.New()
+	feedCache.OnChange(func(slug string, cached *cache.CachedFeed) {
+		if cached == nil {
+			searchIndex.Remove(slug)
+			return
+		}
+		searchIndex.Update(slug, cached.Tree)
+		feedCache.SetIndexSize(slug, searchIndex.Size(slug))
+	})
+	searcher := search.New(cfg, feedCache, searchIndex, crawl, logger)
 
-	// Build refresh function.
-	refreshFunc := func(ctx context.Context, slug string) error {
-		return refreshFeeds(ctx, cfg, crawl, feedCache, logger, slug)
+	// Warm-start from the last snapshots so the server can serve immediately.
+	restored, err := feedCache.Restore()
+	if err != nil {
+		logger.Warn("some feed snapshots could not be restored", "error", err)
 	}
+	if restored > 0 {
+		logger.Info("feed cache restored from snapshots", "feeds", restored, "dir", cfg.Cache.Dir)
+	}
+	pruneUnconfigured(cfg, feedCache, logger)
 
-	// Create HTTP server.
-	srv := server.New(cfg, feedCache, crawl, searcher, logger)
+	// The poller owns the per-feed crawl loops. Its first pass is the initial
+	// crawl; until it finishes, requests are served from restored snapshots or
+	// fetched on demand.
+	poll, err := poller.New(cfg, crawl, feedCache, logger)
+	if err != nil {
+		logger.Error("invalid polling configuration", "error", err)
+		os.Exit(1)
+	}
 
-	// Set the refresh function on the handler (need to get it through the server).
-	// We'll do initial poll, then set up the ticker.
+	// Disk cache for proxied downloads and covers, used by feeds that opt in.
+	var downloads *blobcache.Cache
+	if cfg.Cache.DownloadDir != "" {
+		downloads, err = blobcache.New(cfg.Cache.DownloadDir, int64(cfg.Cache.DownloadMaxMB)<<20, logger)
+		if err != nil {
+			logger.Error("failed to open download cache", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	// Initial crawl of all feeds.
-	logger.Info("performing initial feed crawl...")
-	if err := refreshFunc(context.Background(), ""); err != nil {
-		logger.Warn("initial crawl had errors", "error", err)
+	// Optional ebook format conversion through an external program.
+	var converter convert.Converter
+	if cfg.Conversion.Command != "" {
+		timeout, _ := cfg.Conversion.ParsedTimeout() // validated by config.Load
+		converter = &convert.Command{
+			Path:          cfg.Conversion.Command,
+			Args:          cfg.Conversion.Args,
+			Timeout:       timeout,
+			MaxConcurrent: cfg.Conversion.MaxConcurrent,
+		}
+		logger.Info("ebook conversion enabled", "command", cfg.Conversion.Command, "to", cfg.Conversion.To)
 	}
 
-	// Set up periodic polling.
-	pollInterval, err := cfg.Polling.ParsedInterval()
-	if err != nil {
-		logger.Error("invalid polling interval", "error", err)
-		os.Exit(1)
+	// Converted downloads are cached so each book is converted once per
+	// format: in the download cache, or in a temporary one without it.
+	conversions := downloads
+	if converter != nil && conversions == nil {
+		dir, err := os.MkdirTemp("", "opds-conversions-")
+		if err == nil {
+			defer os.RemoveAll(dir)
+			conversions, err = blobcache.New(dir, int64(cfg.Cache.DownloadMaxMB)<<20, logger)
+		}
+		if err != nil {
+			logger.Error("failed to create conversion cache", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	logger.Info("starting feed poller")
+	go poll.Run(ctx)
+
+	// Apply config changes without a restart: on SIGHUP, when the file
+	// changes, and through the admin API.
+	handler := server.NewHandler(cfg, feedCache, crawl, searcher, poll, downloads, converter, conversions, logger)
+	rl := &reloader{
+		path:     cfgPath,
+		logger:   logger,
+		handler:  handler,
+		searcher: searcher,
+		crawler:  crawl,
+		poller:   poll,
+		cfg:      cfg,
+	}
+	if cfg.Admin.StateFile == "" {
+		logger.Info("admin.state_file not set; feed changes made through the admin API will not survive a restart")
+	}
+	warnStateOverrides(cfg, logger)
+
+	// Create HTTP server.
+	srv := server.New(cfg, handler, server.NewAdminHandler(handler, rl, logger), logger)
+
+	go rl.watch(ctx)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 	go func() {
-		ticker := time.NewTicker(pollInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				logger.Info("periodic feed refresh starting")
-				if err := refreshFunc(ctx, ""); err != nil {
-					logger.Warn("periodic refresh had errors", "error", err)
-				}
-			case <-ctx.Done():
-				return
+		for range hupCh {
+			logger.Info("received SIGHUP, reloading config")
+			if err := rl.reload(); err != nil {
+				logger.Error("config reload failed, keeping current config", "error", err)
 			}
 		}
 	}()
@@ -124,38 +194,24 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		logger.Error("shutdown error", "error", err)
 	}
+	if downloads != nil {
+		if err := downloads.Close(); err != nil {
+			logger.Error("failed to write download cache index", "error", err)
+		}
+	}
 	logger.Info("server stopped")
 }
 
-// refreshFeeds crawls one or all feeds. If slug is empty, all feeds are refreshed.
-func refreshFeeds(ctx context.Context, cfg *config.Config, crawl *crawler.Crawler, feedCache *cache.FeedCache, logger *slog.Logger, slug string) error {
-	var errs []error
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	for _, feedCfg := range cfg.Feeds {
-		if slug != "" && feedCfg.Slug() != slug {
-			continue
-		}
-
-		wg.Add(1)
-		go func(fc config.FeedConfig) {
-			defer wg.Done()
-			tree, err := crawl.Crawl(ctx, fc)
-			if err != nil {
-				mu.Lock()
-				errs = append(errs, fmt.Errorf("%s: %w", fc.Name, err))
-				mu.Unlock()
-				return
-			}
-			feedCache.Put(fc.Slug(), tree)
-		}(feedCfg)
+// pruneUnconfigured drops restored snapshots for feeds that are no longer in the config.
+func pruneUnconfigured(cfg *config.Config, feedCache *cache.FeedCache, logger *slog.Logger) {
+	configured := make(map[string]bool, len(cfg.Feeds))
+	for _, fc := range cfg.Feeds {
+		configured[fc.Slug()] = true
 	}
-
-	wg.Wait()
-
-	if len(errs) > 0 {
-		return fmt.Errorf("refresh errors: %v", errs)
+	for slug := range feedCache.All() {
+		if !configured[slug] {
+			logger.Info("dropping snapshot for unconfigured feed", "slug", slug)
+			feedCache.Remove(slug)
+		}
 	}
-	return nil
 }
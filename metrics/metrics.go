@@ -0,0 +1,129 @@
+// Package metrics defines the Prometheus metrics exported on /metrics.
+// Metrics are package-level so any component can record them without
+// extra wiring; they are registered on a private registry together with
+// the standard Go runtime and process collectors.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "opds"
+
+var (
+	// UpstreamRequests counts upstream HTTP requests by source, kind
+	// ("feed" or "download") and status code ("error" for transport failures).
+	UpstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Upstream HTTP requests by source, kind and status code.",
+	}, []string{"source", "kind", "code"})
+
+	// UpstreamDuration observes the time until upstream response headers arrive.
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time until upstream response headers arrive, by source and kind.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source", "kind"})
+
+	// UpstreamBytes counts response body bytes read from upstreams.
+	UpstreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_response_bytes_total",
+		Help:      "Response body bytes read from upstreams, by source and kind.",
+	}, []string{"source", "kind"})
+
+	// FeedCacheLookups counts feed cache lookups when serving source feeds,
+	// by result ("hit" or "miss").
+	FeedCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "feed_cache_lookups_total",
+		Help:      "Cached feed tree lookups when serving source feeds, by source and result.",
+	}, []string{"source", "result"})
+
+	// OnDemandFetches counts feeds fetched while serving a request, by kind:
+	// "on_demand" (uncached sub-feed), "external" (ext?url=), "lazy_load"
+	// (further upstream pages) or "revalidate" (sub-feed past its child_ttl).
+	OnDemandFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "on_demand_fetches_total",
+		Help:      "Upstream feeds fetched while serving a request, by source and kind.",
+	}, []string{"source", "kind"})
+
+	// FeedCacheBytes is the approximate memory held by each source's cached
+	// feed tree, including sub-feeds fetched on demand, and its search index.
+	FeedCacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "feed_cache_bytes",
+		Help:      "Approximate memory held by cached feeds, by source.",
+	}, []string{"source"})
+
+	// FeedCacheEvictions counts cached sub-feeds dropped to stay within the
+	// memory budget, by source.
+	FeedCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "feed_cache_evictions_total",
+		Help:      "Cached sub-feeds evicted to stay within the memory budget, by source.",
+	}, []string{"source"})
+
+	// SearchDuration observes upstream OpenSearch queries during fan-out search.
+	SearchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "search_upstream_duration_seconds",
+		Help:      "Duration of upstream OpenSearch queries, by source.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source"})
+
+	// DownloadBytes counts bytes sent to clients by the download proxy,
+	// including covers, thumbnails and converted books.
+	DownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes sent to clients by the download endpoint, by source.",
+	}, []string{"source"})
+
+	// CrawlDuration observes complete feed refreshes.
+	CrawlDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "crawl_duration_seconds",
+		Help:      "Duration of feed refreshes, by source and result.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"source", "result"})
+
+	// CrawlLastSuccess records when each feed was last refreshed successfully.
+	CrawlLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "crawl_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful refresh, by source.",
+	}, []string{"source"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UpstreamRequests,
+		UpstreamDuration,
+		UpstreamBytes,
+		FeedCacheLookups,
+		OnDemandFetches,
+		FeedCacheBytes,
+		FeedCacheEvictions,
+		SearchDuration,
+		DownloadBytes,
+		CrawlDuration,
+		CrawlLastSuccess,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
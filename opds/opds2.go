@@ -0,0 +1,731 @@
+package opds
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OPDS 2.0 media types and relations.
+const (
+	MediaTypeOPDS2            = "application/opds+json"
+	MediaTypeOPDS2Publication = "application/opds-publication+json"
+
+	// RelCollection groups entries of an OPDS 1.2 feed into named collections,
+	// which map to OPDS 2.0 groups.
+	RelCollection = "collection"
+
+	schemaBook = "http://schema.org/Book"
+)
+
+// V2Feed is an OPDS 2.0 catalog feed.
+type V2Feed struct {
+	Metadata     V2FeedMetadata  `json:"metadata"`
+	Links        []V2Link        `json:"links"`
+	Navigation   []V2Link        `json:"navigation,omitempty"`
+	Publications []V2Publication `json:"publications,omitempty"`
+	Facets       []V2Group       `json:"facets,omitempty"`
+	Groups       []V2Group       `json:"groups,omitempty"`
+}
+
+// V2FeedMetadata is the metadata object of an OPDS 2.0 feed or group.
+type V2FeedMetadata struct {
+	Title         V2Text `json:"title"`
+	Identifier    string `json:"identifier,omitempty"`
+	Modified      string `json:"modified,omitempty"`
+	NumberOfItems int    `json:"numberOfItems,omitempty"`
+	ItemsPerPage  int    `json:"itemsPerPage,omitempty"`
+	CurrentPage   int    `json:"currentPage,omitempty"`
+}
+
+// V2Group is a titled collection of navigation links, publications, or
+// (for facets) plain links.
+type V2Group struct {
+	Metadata     V2FeedMetadata  `json:"metadata"`
+	Links        []V2Link        `json:"links,omitempty"`
+	Navigation   []V2Link        `json:"navigation,omitempty"`
+	Publications []V2Publication `json:"publications,omitempty"`
+}
+
+// V2Link is a Readium Web Publication Manifest link object.
+type V2Link struct {
+	Href       string        `json:"href"`
+	Type       string        `json:"type,omitempty"`
+	Rel        V2Rels        `json:"rel,omitempty"`
+	Title      string        `json:"title,omitempty"`
+	Templated  bool          `json:"templated,omitempty"`
+	Properties *V2Properties `json:"properties,omitempty"`
+}
+
+// V2Rels is a link's relation list. It is encoded as a single string when it
+// holds one relation, and as an array otherwise.
+type V2Rels []string
+
+// MarshalJSON implements json.Marshaler.
+func (r V2Rels) MarshalJSON() ([]byte, error) {
+	if len(r) == 1 {
+		return json.Marshal(r[0])
+	}
+	return json.Marshal([]string(r))
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting a string or an array.
+func (r *V2Rels) UnmarshalJSON(data []byte) error {
+	var list V2Strings
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*r = V2Rels(list)
+	return nil
+}
+
+// V2Strings is a list of strings that may also be encoded as a single string
+// (e.g. a publication's language).
+type V2Strings []string
+
+// UnmarshalJSON implements json.Unmarshaler, accepting a string or an array.
+func (s *V2Strings) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = V2Strings{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*s = many
+	return nil
+}
+
+// V2Text is a string that may be encoded either as a plain string or as a
+// language map ({"en": "...", "fr": "..."}). Language maps are flattened to
+// the English value, or the first value in key order if there is none.
+type V2Text string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *V2Text) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = V2Text(one)
+		return nil
+	}
+	var byLang map[string]string
+	if err := json.Unmarshal(data, &byLang); err != nil {
+		return err
+	}
+	for _, lang := range []string{"en", "und"} {
+		if v, ok := byLang[lang]; ok {
+			*t = V2Text(v)
+			return nil
+		}
+	}
+	keys := make([]string, 0, len(byLang))
+	for k := range byLang {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		*t = V2Text(byLang[keys[0]])
+	}
+	return nil
+}
+
+// V2Properties holds OPDS-specific link properties.
+type V2Properties struct {
+	NumberOfItems       int                     `json:"numberOfItems,omitempty"`
+	Price               *V2Price                `json:"price,omitempty"`
+	IndirectAcquisition []V2IndirectAcquisition `json:"indirectAcquisition,omitempty"`
+}
+
+// V2Price is the price of an acquisition link.
+type V2Price struct {
+	Currency string  `json:"currency"`
+	Value    float64 `json:"value"`
+}
+
+// V2IndirectAcquisition describes the media type chain of an indirect acquisition.
+type V2IndirectAcquisition struct {
+	Type  string                  `json:"type"`
+	Child []V2IndirectAcquisition `json:"child,omitempty"`
+}
+
+// V2Publication is an OPDS 2.0 publication.
+type V2Publication struct {
+	Metadata V2PublicationMetadata `json:"metadata"`
+	Links    []V2Link              `json:"links"`
+	Images   []V2Link              `json:"images,omitempty"`
+}
+
+// V2PublicationMetadata is the metadata of an OPDS 2.0 publication.
+type V2PublicationMetadata struct {
+	Type        string         `json:"@type,omitempty"`
+	Identifier  string         `json:"identifier,omitempty"`
+	Title       V2Text         `json:"title"`
+	Author      V2Contributors `json:"author,omitempty"`
+	Publisher   V2Contributors `json:"publisher,omitempty"`
+	Language    V2Strings      `json:"language,omitempty"`
+	Modified    string         `json:"modified,omitempty"`
+	Published   string         `json:"published,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Subject     V2Subjects     `json:"subject,omitempty"`
+}
+
+// V2Contributor is an author, publisher, or other contributor.
+type V2Contributor struct {
+	Name  V2Text   `json:"name"`
+	Links []V2Link `json:"links,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting a bare name string.
+func (c *V2Contributor) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*c = V2Contributor{Name: V2Text(name)}
+		return nil
+	}
+	type plain V2Contributor
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// V2Contributors is a contributor list that may also be encoded as a single
+// contributor (string or object).
+type V2Contributors []V2Contributor
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (cs *V2Contributors) UnmarshalJSON(data []byte) error {
+	var many []V2Contributor
+	if err := json.Unmarshal(data, &many); err == nil {
+		*cs = many
+		return nil
+	}
+	var one V2Contributor
+	if err := json.Unmarshal(data, &one); err != nil {
+		return err
+	}
+	*cs = V2Contributors{one}
+	return nil
+}
+
+// V2Subject is a publication subject (an Atom category).
+type V2Subject struct {
+	Name   V2Text `json:"name"`
+	Code   string `json:"code,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting a bare name string.
+func (s *V2Subject) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = V2Subject{Name: V2Text(name)}
+		return nil
+	}
+	type plain V2Subject
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// V2Subjects is a subject list that may also be encoded as a single subject.
+type V2Subjects []V2Subject
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ss *V2Subjects) UnmarshalJSON(data []byte) error {
+	var many []V2Subject
+	if err := json.Unmarshal(data, &many); err == nil {
+		*ss = many
+		return nil
+	}
+	var one V2Subject
+	if err := json.Unmarshal(data, &one); err != nil {
+		return err
+	}
+	*ss = V2Subjects{one}
+	return nil
+}
+
+// ToV2 converts an OPDS 1.2 feed into an OPDS 2.0 feed. Entries with
+// acquisition links become publications, entries that only link to other
+// feeds become navigation links, facet links become facet groups, and
+// entries carrying a "collection" link are gathered into groups.
+func ToV2(feed *Feed) *V2Feed {
+	out := &V2Feed{
+		Metadata: V2FeedMetadata{
+			Title:         V2Text(feed.Title),
+			Identifier:    feed.ID,
+			Modified:      feed.Updated,
+			NumberOfItems: feed.TotalResults,
+			ItemsPerPage:  feed.ItemsPerPage,
+		},
+		Links: []V2Link{},
+	}
+	if feed.ItemsPerPage > 0 && feed.StartIndex > 0 {
+		out.Metadata.CurrentPage = (feed.StartIndex-1)/feed.ItemsPerPage + 1
+	}
+
+	facetIdx := make(map[string]int)
+	for _, l := range feed.Links {
+		if l.Rel != RelFacet {
+			out.Links = append(out.Links, toV2Link(l))
+			continue
+		}
+		group := l.FacetGroup
+		if group == "" {
+			group = "Facets"
+		}
+		i, ok := facetIdx[group]
+		if !ok {
+			i = len(out.Facets)
+			facetIdx[group] = i
+			out.Facets = append(out.Facets, V2Group{Metadata: V2FeedMetadata{Title: V2Text(group)}})
+		}
+		fl := toV2Link(l)
+		fl.Rel = nil
+		if l.ActiveFacet == "true" {
+			fl.Rel = V2Rels{RelSelf}
+		}
+		out.Facets[i].Links = append(out.Facets[i].Links, fl)
+	}
+
+	groupIdx := make(map[string]int)
+	for _, e := range feed.Entries {
+		if nav, ok := entryNavigationLink(e); ok {
+			out.Navigation = append(out.Navigation, nav)
+			continue
+		}
+
+		pub := toV2Publication(e)
+		coll := collectionLink(e)
+		if coll == nil {
+			out.Publications = append(out.Publications, pub)
+			continue
+		}
+		i, ok := groupIdx[coll.Href]
+		if !ok {
+			i = len(out.Groups)
+			groupIdx[coll.Href] = i
+			title := coll.Title
+			if title == "" {
+				title = coll.Href
+			}
+			out.Groups = append(out.Groups, V2Group{
+				Metadata: V2FeedMetadata{Title: V2Text(title)},
+				Links:    []V2Link{{Href: coll.Href, Type: MediaTypeOPDS2, Rel: V2Rels{RelSelf}}},
+			})
+		}
+		out.Groups[i].Publications = append(out.Groups[i].Publications, pub)
+	}
+
+	return out
+}
+
+// entryNavigationLink returns the OPDS 2.0 navigation link for an entry that
+// has no acquisition links but points to another feed.
+func entryNavigationLink(e Entry) (V2Link, bool) {
+	if e.HasAcquisitionLinks() {
+		return V2Link{}, false
+	}
+	for _, l := range e.Links {
+		if l.Rel == RelSubsection || (isFeedType(l.Type) && IsNavigationRel(l.Rel)) {
+			nav := toV2Link(l)
+			nav.Title = e.Title
+			if l.Rel == RelSubsection {
+				nav.Rel = nil
+			}
+			return nav, true
+		}
+	}
+	return V2Link{}, false
+}
+
+func collectionLink(e Entry) *Link {
+	for i, l := range e.Links {
+		if l.Rel == RelCollection {
+			return &e.Links[i]
+		}
+	}
+	return nil
+}
+
+func toV2Publication(e Entry) V2Publication {
+	pub := V2Publication{
+		Metadata: V2PublicationMetadata{
+			Type:       schemaBook,
+			Identifier: e.ID,
+			Title:      V2Text(e.Title),
+			Modified:   e.Updated,
+			Published:  e.Published,
+		},
+		Links: []V2Link{},
+	}
+	if pub.Metadata.Published == "" {
+		pub.Metadata.Published = e.Issued
+	}
+	if e.Language != "" {
+		pub.Metadata.Language = V2Strings{e.Language}
+	}
+	if e.Publisher != "" {
+		pub.Metadata.Publisher = V2Contributors{{Name: V2Text(e.Publisher)}}
+	}
+	switch {
+	case e.Summary != nil && e.Summary.Body != "":
+		pub.Metadata.Description = e.Summary.Body
+	case e.Content != nil:
+		pub.Metadata.Description = e.Content.Body
+	}
+	for _, a := range e.Authors {
+		c := V2Contributor{Name: V2Text(a.Name)}
+		if a.URI != "" {
+			c.Links = []V2Link{{Href: a.URI}}
+		}
+		pub.Metadata.Author = append(pub.Metadata.Author, c)
+	}
+	for _, c := range e.Categories {
+		name := c.Label
+		if name == "" {
+			name = c.Term
+		}
+		pub.Metadata.Subject = append(pub.Metadata.Subject, V2Subject{Name: V2Text(name), Code: c.Term, Scheme: c.Scheme})
+	}
+
+	for _, l := range e.Links {
+		switch {
+		case l.Rel == RelCollection:
+			continue
+		case IsImageRel(l.Rel):
+			pub.Images = append(pub.Images, toV2Link(l))
+		default:
+			pl := toV2Link(l)
+			if price := entryPrice(e); price != nil && isAcquisitionRel(l.Rel) {
+				if pl.Properties == nil {
+					pl.Properties = &V2Properties{}
+				}
+				pl.Properties.Price = price
+			}
+			pub.Links = append(pub.Links, pl)
+		}
+	}
+	return pub
+}
+
+// entryPrice returns the entry's first parseable opds:price, or nil.
+func entryPrice(e Entry) *V2Price {
+	for _, p := range e.Prices {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(p.Value), 64); err == nil {
+			return &V2Price{Currency: p.CurrencyCode, Value: v}
+		}
+	}
+	return nil
+}
+
+func toV2Link(l Link) V2Link {
+	out := V2Link{
+		Href:  l.Href,
+		Type:  l.Type,
+		Title: l.Title,
+	}
+	if l.Rel != "" {
+		out.Rel = V2Rels{l.Rel}
+	}
+	if isFeedType(l.Type) {
+		out.Type = MediaTypeOPDS2
+		if strings.Contains(l.Type, "type=entry") {
+			out.Type = MediaTypeOPDS2Publication
+		}
+	}
+	// OpenSearch templates become RFC 6570 URI templates.
+	if strings.Contains(l.Href, "{searchTerms}") {
+		out.Href = strings.ReplaceAll(l.Href, "{searchTerms}", "{query}")
+		out.Templated = true
+		out.Type = MediaTypeOPDS2
+	}
+
+	var props V2Properties
+	if l.Count > 0 {
+		props.NumberOfItems = l.Count
+	}
+	for _, ia := range l.IndirectAcq {
+		props.IndirectAcquisition = append(props.IndirectAcquisition, toV2Indirect(ia))
+	}
+	if props.NumberOfItems > 0 || props.Price != nil || len(props.IndirectAcquisition) > 0 {
+		out.Properties = &props
+	}
+	return out
+}
+
+func toV2Indirect(ia IndirectAcquisition) V2IndirectAcquisition {
+	out := V2IndirectAcquisition{Type: ia.Type}
+	for _, c := range ia.Children {
+		out.Child = append(out.Child, toV2Indirect(c))
+	}
+	return out
+}
+
+// isFeedType returns true if mediaType is an OPDS 1.x Atom feed or entry type.
+func isFeedType(mediaType string) bool {
+	return strings.Contains(mediaType, "opds-catalog") || strings.Contains(mediaType, "atom+xml")
+}
+
+// FromV2 converts an OPDS 2.0 feed into the internal OPDS 1.2 model so that
+// it can be cached, rewritten, and served like any Atom upstream. Feed link
+// types are mapped to their Atom equivalents, navigation links become
+// navigation entries, publications become acquisition entries, groups are
+// flattened into entries tagged with a "collection" link, and facets become
+// facet links.
+func FromV2(v2 *V2Feed) *Feed {
+	feed := &Feed{
+		ID:           v2.Metadata.Identifier,
+		Title:        string(v2.Metadata.Title),
+		Updated:      v2.Metadata.Modified,
+		TotalResults: v2.Metadata.NumberOfItems,
+		ItemsPerPage: v2.Metadata.ItemsPerPage,
+	}
+	if v2.Metadata.CurrentPage > 0 && v2.Metadata.ItemsPerPage > 0 {
+		feed.StartIndex = (v2.Metadata.CurrentPage-1)*v2.Metadata.ItemsPerPage + 1
+	}
+
+	for _, l := range v2.Links {
+		feed.Links = append(feed.Links, fromV2Links(l, "")...)
+	}
+	if feed.ID == "" {
+		if self := feed.SelfLink(); self != nil {
+			feed.ID = self.Href
+		}
+	}
+
+	for _, g := range v2.Facets {
+		for _, l := range g.Links {
+			fl := fromV2Link(l, RelFacet)
+			fl.Rel = RelFacet
+			fl.FacetGroup = string(g.Metadata.Title)
+			if containsRel(l.Rel, RelSelf) {
+				fl.ActiveFacet = "true"
+			}
+			feed.Links = append(feed.Links, fl)
+		}
+	}
+
+	for _, nav := range v2.Navigation {
+		feed.Entries = append(feed.Entries, fromV2Navigation(nav, feed.Updated))
+	}
+	for _, pub := range v2.Publications {
+		feed.Entries = append(feed.Entries, fromV2Publication(pub, feed.Updated))
+	}
+
+	for _, g := range v2.Groups {
+		var coll *Link
+		for _, l := range g.Links {
+			if containsRel(l.Rel, RelSelf) || len(g.Links) == 1 {
+				cl := fromV2Link(l, RelCollection)
+				cl.Rel = RelCollection
+				cl.Title = string(g.Metadata.Title)
+				coll = &cl
+				break
+			}
+		}
+		for _, nav := range g.Navigation {
+			feed.Entries = append(feed.Entries, fromV2Navigation(nav, feed.Updated))
+		}
+		for _, pub := range g.Publications {
+			e := fromV2Publication(pub, feed.Updated)
+			if coll != nil {
+				e.Links = append(e.Links, *coll)
+			}
+			feed.Entries = append(feed.Entries, e)
+		}
+	}
+
+	return feed
+}
+
+func fromV2Navigation(nav V2Link, updated string) Entry {
+	l := fromV2Link(nav, RelSubsection)
+	if l.Rel != RelSubsection && !IsNavigationRel(l.Rel) {
+		l.Rel = RelSubsection
+	}
+	// Navigation links lead to other feeds even when they carry no type (or
+	// a generic JSON one), so give them the catalog type the crawler follows.
+	if l.Type == "" || l.Type == "application/json" {
+		l.Type = MediaTypeAtom + ";profile=opds-catalog"
+	}
+	return Entry{
+		ID:      nav.Href,
+		Title:   nav.Title,
+		Updated: updated,
+		Links:   []Link{l},
+	}
+}
+
+func fromV2Publication(pub V2Publication, updated string) Entry {
+	md := pub.Metadata
+	e := Entry{
+		ID:        md.Identifier,
+		Title:     string(md.Title),
+		Updated:   md.Modified,
+		Published: md.Published,
+	}
+	if e.Updated == "" {
+		e.Updated = updated
+	}
+	if len(md.Language) > 0 {
+		e.Language = md.Language[0]
+	}
+	if len(md.Publisher) > 0 {
+		e.Publisher = string(md.Publisher[0].Name)
+	}
+	if md.Description != "" {
+		e.Summary = &Text{Type: "html", Body: md.Description}
+	}
+	for _, a := range md.Author {
+		author := Author{Name: string(a.Name)}
+		if len(a.Links) > 0 {
+			author.URI = a.Links[0].Href
+		}
+		e.Authors = append(e.Authors, author)
+	}
+	for _, s := range md.Subject {
+		term := s.Code
+		if term == "" {
+			term = string(s.Name)
+		}
+		e.Categories = append(e.Categories, Category{Term: term, Label: string(s.Name), Scheme: s.Scheme})
+	}
+
+	for _, l := range pub.Links {
+		for _, el := range fromV2Links(l, "") {
+			// A publication's self link points at its OPDS 2.0 publication
+			// document, which is the Atom "alternate" entry link.
+			if el.Rel == RelSelf {
+				el.Rel = RelAlternate
+			}
+			e.Links = append(e.Links, el)
+		}
+		if l.Properties != nil && l.Properties.Price != nil && len(e.Prices) == 0 {
+			e.Prices = append(e.Prices, Price{
+				CurrencyCode: l.Properties.Price.Currency,
+				Value:        strconv.FormatFloat(l.Properties.Price.Value, 'f', -1, 64),
+			})
+		}
+	}
+
+	// Images rarely carry a rel in OPDS 2.0. Treat the first as the cover and
+	// the last (often the smallest) as the thumbnail.
+	for i, img := range pub.Images {
+		switch {
+		case len(img.Rel) > 0:
+			e.Links = append(e.Links, fromV2Links(img, "")...)
+		case i == 0:
+			e.Links = append(e.Links, fromV2Link(img, RelImage))
+			if len(pub.Images) == 1 {
+				e.Links = append(e.Links, fromV2Link(img, RelThumbnail))
+			}
+		case i == len(pub.Images)-1:
+			e.Links = append(e.Links, fromV2Link(img, RelThumbnail))
+		}
+	}
+
+	// Fall back to the publication's own link, then its first link, so the
+	// entry still has a stable Atom id.
+	if e.ID == "" {
+		for _, l := range e.Links {
+			if l.Rel == RelAlternate {
+				e.ID = l.Href
+				break
+			}
+		}
+	}
+	if e.ID == "" && len(e.Links) > 0 {
+		e.ID = e.Links[0].Href
+	}
+	return e
+}
+
+// fromV2Links converts a link into one Atom link per relation (or a single
+// link with defaultRel when it has none).
+func fromV2Links(l V2Link, defaultRel string) []Link {
+	if len(l.Rel) <= 1 {
+		return []Link{fromV2Link(l, defaultRel)}
+	}
+	out := make([]Link, 0, len(l.Rel))
+	for _, rel := range l.Rel {
+		one := l
+		one.Rel = V2Rels{rel}
+		out = append(out, fromV2Link(one, defaultRel))
+	}
+	return out
+}
+
+// fromV2Link converts a single link, using the first relation or defaultRel.
+func fromV2Link(l V2Link, defaultRel string) Link {
+	out := Link{
+		Rel:   defaultRel,
+		Href:  l.Href,
+		Type:  l.Type,
+		Title: l.Title,
+	}
+	if len(l.Rel) > 0 {
+		out.Rel = l.Rel[0]
+	}
+
+	switch {
+	case strings.HasPrefix(l.Type, MediaTypeOPDS2Publication):
+		out.Type = MediaTypeOPDSEntry
+	case strings.HasPrefix(l.Type, MediaTypeOPDS2):
+		out.Type = MediaTypeAtom + ";profile=opds-catalog"
+	}
+
+	if l.Templated {
+		out.Href = fromURITemplate(l.Href)
+	}
+
+	if l.Properties != nil {
+		out.Count = l.Properties.NumberOfItems
+		for _, ia := range l.Properties.IndirectAcquisition {
+			out.IndirectAcq = append(out.IndirectAcq, fromV2Indirect(ia))
+		}
+	}
+	return out
+}
+
+func fromV2Indirect(ia V2IndirectAcquisition) IndirectAcquisition {
+	out := IndirectAcquisition{Type: ia.Type}
+	for _, c := range ia.Child {
+		out.Children = append(out.Children, fromV2Indirect(c))
+	}
+	return out
+}
+
+// fromURITemplate turns an RFC 6570 search template ("/search{?query,title}")
+// into an OpenSearch-style template ("/search?query={searchTerms}") so it can
+// be expanded by the existing search code. Only the "query" variable is kept.
+func fromURITemplate(tmpl string) string {
+	start := strings.Index(tmpl, "{")
+	end := strings.Index(tmpl, "}")
+	if start == -1 || end <= start+1 {
+		return tmpl
+	}
+	expr := tmpl[start+1 : end]
+	rest := tmpl[end+1:]
+
+	switch expr[0] {
+	case '?', '&':
+		sep := string(expr[0])
+		for _, name := range strings.Split(expr[1:], ",") {
+			if name == "query" {
+				return tmpl[:start] + sep + "query={searchTerms}" + rest
+			}
+		}
+		return tmpl[:start] + rest
+	default:
+		return tmpl[:start] + "{searchTerms}" + rest
+	}
+}
+
+func containsRel(rels V2Rels, rel string) bool {
+	for _, r := range rels {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
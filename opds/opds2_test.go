@@ -0,0 +1,200 @@
+package opds
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const catalogType = MediaTypeAtom + ";profile=opds-catalog"
+
+func loadV2(t *testing.T, name string) *Feed {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	feed, err := ParseJSON(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+// links returns the links of ls with the given rel.
+func links(ls []Link, rel string) []Link {
+	var out []Link
+	for _, l := range ls {
+		if l.Rel == rel {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func TestFromV2Navigation(t *testing.T) {
+	feed := loadV2(t, "navigation.json")
+
+	if feed.Title != "Example Library" || feed.ID != "http://example.com/opds.json" {
+		t.Errorf("feed = %q (%s), want Example Library with the self link as id", feed.Title, feed.ID)
+	}
+	search := links(feed.Links, RelSearch)
+	if len(search) != 1 || search[0].Href != "http://example.com/search?query={searchTerms}" {
+		t.Errorf("search links = %+v, want an OpenSearch template", search)
+	}
+
+	want := []struct {
+		title, href, rel, typ string
+	}{
+		{"New Publications", "http://example.com/new.json", RelSubsection, catalogType},
+		{"Most Popular", "http://example.com/popular.json", RelSortPopular, catalogType},
+		{"Fiction", "http://example.com/fiction.json", RelSubsection, catalogType},
+		{"Poetry", "http://example.com/poetry.json", RelSubsection, catalogType},
+	}
+	if len(feed.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(feed.Entries), len(want))
+	}
+	for i, w := range want {
+		e := feed.Entries[i]
+		if e.Title != w.title || e.ID != w.href || len(e.Links) != 1 {
+			t.Errorf("entry %d = %q (%s) with %d links, want %q (%s) with one", i, e.Title, e.ID, len(e.Links), w.title, w.href)
+			continue
+		}
+		if l := e.Links[0]; l.Href != w.href || l.Rel != w.rel || l.Type != w.typ {
+			t.Errorf("%s link = %+v, want rel %q type %q", w.title, l, w.rel, w.typ)
+		}
+		if e.HasAcquisitionLinks() {
+			t.Errorf("%s has acquisition links", w.title)
+		}
+	}
+}
+
+func TestFromV2Publications(t *testing.T) {
+	feed := loadV2(t, "publications.json")
+
+	if feed.Title != "Library" || feed.TotalResults != 5000 || feed.ItemsPerPage != 2 || feed.StartIndex != 5 {
+		t.Errorf("feed = %q, %d results, %d per page from %d; want Library, 5000, 2 from 5",
+			feed.Title, feed.TotalResults, feed.ItemsPerPage, feed.StartIndex)
+	}
+	if next := links(feed.Links, RelNext); len(next) != 1 || next[0].Type != catalogType {
+		t.Errorf("next links = %+v, want one catalog link", next)
+	}
+	facets := links(feed.Links, RelFacet)
+	if len(facets) != 2 {
+		t.Fatalf("got %d facet links, want 2", len(facets))
+	}
+	if f := facets[0]; f.FacetGroup != "Language" || f.ActiveFacet != "true" || f.Count != 1200 || f.Title != "French" {
+		t.Errorf("first facet = %+v", f)
+	}
+	if f := facets[1]; f.FacetGroup != "Language" || f.ActiveFacet != "" || f.Count != 3800 {
+		t.Errorf("second facet = %+v", f)
+	}
+
+	byTitle := make(map[string]Entry)
+	for _, e := range feed.Entries {
+		byTitle[e.Title] = e
+	}
+	if len(byTitle) != 4 {
+		t.Fatalf("got %d distinct entries, want 4", len(byTitle))
+	}
+
+	t.Run("images without rels", func(t *testing.T) {
+		e := byTitle["Moby-Dick"]
+		if e.ID != "urn:isbn:978-0-14-243724-7" || e.Language != "en" || e.Updated != "2015-09-29T17:00:00Z" {
+			t.Errorf("metadata = %s, %s, %s", e.ID, e.Language, e.Updated)
+		}
+		if len(e.Authors) != 1 || e.Authors[0].Name != "Herman Melville" {
+			t.Errorf("authors = %+v", e.Authors)
+		}
+		if e.Summary == nil || !strings.Contains(e.Summary.Body, "<i>Pequod</i>") {
+			t.Errorf("summary = %+v", e.Summary)
+		}
+		if len(e.Categories) != 1 || e.Categories[0].Term != "FIC025000" || e.Categories[0].Label != "Sea stories" {
+			t.Errorf("categories = %+v", e.Categories)
+		}
+		if alt := links(e.Links, RelAlternate); len(alt) != 1 || alt[0].Type != MediaTypeOPDSEntry {
+			t.Errorf("alternate links = %+v, want the publication document", alt)
+		}
+		if acq := links(e.Links, RelOpenAccess); len(acq) != 1 || acq[0].Href != "http://example.com/moby-dick.epub" {
+			t.Errorf("acquisition links = %+v", acq)
+		}
+		// The first image is the cover and the last the thumbnail.
+		if img := links(e.Links, RelImage); len(img) != 1 || img[0].Href != "http://example.com/moby-dick/cover.jpg" {
+			t.Errorf("image links = %+v", img)
+		}
+		if thumb := links(e.Links, RelThumbnail); len(thumb) != 1 || thumb[0].Href != "http://example.com/moby-dick/cover-small.jpg" {
+			t.Errorf("thumbnail links = %+v", thumb)
+		}
+	})
+
+	t.Run("indirect acquisition", func(t *testing.T) {
+		e := byTitle["The Protected Book"]
+		if e.ID != "http://example.com/protected/buy" {
+			t.Errorf("id = %q, want the first link", e.ID)
+		}
+		if e.Publisher != "Example House" || len(e.Authors) != 1 || e.Authors[0].URI != "http://example.com/authors/jane-doe.json" {
+			t.Errorf("publisher %q, authors %+v", e.Publisher, e.Authors)
+		}
+		if len(e.Prices) != 1 || e.Prices[0] != (Price{CurrencyCode: "EUR", Value: "7.99"}) {
+			t.Errorf("prices = %+v", e.Prices)
+		}
+		buy := links(e.Links, RelBuy)
+		if len(buy) != 1 {
+			t.Fatalf("buy links = %+v", buy)
+		}
+		want := []IndirectAcquisition{{
+			Type:     "application/vnd.adobe.adept+xml",
+			Children: []IndirectAcquisition{{Type: "application/epub+zip"}},
+		}}
+		if !reflect.DeepEqual(buy[0].IndirectAcq, want) {
+			t.Errorf("indirect acquisition = %+v, want %+v", buy[0].IndirectAcq, want)
+		}
+		// An image with both rels becomes both links.
+		img, thumb := links(e.Links, RelImage), links(e.Links, RelThumbnail)
+		if len(img) != 1 || len(thumb) != 1 || img[0].Href != thumb[0].Href {
+			t.Errorf("image links %+v, thumbnail links %+v", img, thumb)
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		coll := links(byTitle["Walden"].Links, RelCollection)
+		if len(coll) != 1 || coll[0].Href != "http://example.com/featured.json" || coll[0].Title != "Featured" {
+			t.Errorf("collection links = %+v", coll)
+		}
+		nav := byTitle["Authors"]
+		if len(nav.Links) != 1 || nav.Links[0].Rel != RelSubsection || nav.Links[0].Type != catalogType {
+			t.Errorf("group navigation links = %+v", nav.Links)
+		}
+	})
+}
+
+// TestV2RoundTrip checks that converting a parsed OPDS 2.0 feed back to
+// OPDS 2.0 JSON and parsing it again loses nothing.
+func TestV2RoundTrip(t *testing.T) {
+	for _, name := range []string{"navigation.json", "publications.json"} {
+		t.Run(name, func(t *testing.T) {
+			feed := loadV2(t, name)
+			data, err := json.Marshal(ToV2(feed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := ParseJSON(strings.NewReader(string(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// ToV2 lists navigation before publications and groups, so only
+			// the order of the entries may change.
+			byID := func(a, b Entry) int { return strings.Compare(a.ID, b.ID) }
+			slices.SortFunc(feed.Entries, byID)
+			slices.SortFunc(again.Entries, byID)
+			if !reflect.DeepEqual(again, feed) {
+				t.Errorf("round trip changed the feed:\n got %+v\nwant %+v", again, feed)
+			}
+		})
+	}
+}
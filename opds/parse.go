@@ -1,6 +1,7 @@
 package opds
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -25,3 +26,12 @@ func ParseBytes(data []byte) (*Feed, error) {
 	}
 	return &feed, nil
 }
+
+// ParseJSON reads an OPDS 2.0 JSON feed from r and converts it to a Feed.
+func ParseJSON(r io.Reader) (*Feed, error) {
+	var v2 V2Feed
+	if err := json.NewDecoder(r).Decode(&v2); err != nil {
+		return nil, fmt.Errorf("opds: parse OPDS 2.0 feed: %w", err)
+	}
+	return FromV2(&v2), nil
+}
@@ -1,6 +1,7 @@
 package opds
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -27,3 +28,14 @@ func RenderBytes(feed *Feed) ([]byte, error) {
 	}
 	return append([]byte(xml.Header), data...), nil
 }
+
+// RenderJSON writes the feed as an OPDS 2.0 JSON document to w.
+func RenderJSON(w io.Writer, feed *Feed) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ToV2(feed)); err != nil {
+		return fmt.Errorf("opds: encode OPDS 2.0 feed: %w", err)
+	}
+	return nil
+}
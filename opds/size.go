@@ -0,0 +1,52 @@
+package opds
+
+import "unsafe"
+
+// FeedSize approximates the memory held by a parsed feed: the structs
+// themselves plus the strings they point to.
+func FeedSize(feed *Feed) int64 {
+	if feed == nil {
+		return 0
+	}
+	size := int64(unsafe.Sizeof(*feed)) + int64(len(feed.ID)+len(feed.Title)+len(feed.Updated)+len(feed.Icon))
+	size += LinksSize(feed.Links)
+	size += EntriesSize(feed.Entries)
+	return size
+}
+
+// EntriesSize approximates the memory held by entries.
+func EntriesSize(entries []Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += int64(unsafe.Sizeof(e))
+		size += int64(len(e.ID) + len(e.Title) + len(e.Updated) + len(e.Published) + len(e.Rights) +
+			len(e.Language) + len(e.Issued) + len(e.Publisher))
+		for _, t := range []*Text{e.Summary, e.Content} {
+			if t != nil {
+				size += int64(unsafe.Sizeof(*t)) + int64(len(t.Type)+len(t.Body))
+			}
+		}
+		for _, id := range e.Identifiers {
+			size += int64(unsafe.Sizeof(id)) + int64(len(id))
+		}
+		for _, a := range e.Authors {
+			size += int64(unsafe.Sizeof(a)) + int64(len(a.Name)+len(a.URI))
+		}
+		for _, c := range e.Categories {
+			size += int64(unsafe.Sizeof(c)) + int64(len(c.Term)+len(c.Label)+len(c.Scheme))
+		}
+		size += LinksSize(e.Links)
+		size += int64(len(e.Prices)) * int64(unsafe.Sizeof(Price{}))
+	}
+	return size
+}
+
+// LinksSize approximates the memory held by links.
+func LinksSize(links []Link) int64 {
+	var size int64
+	for _, l := range links {
+		size += int64(unsafe.Sizeof(l)) + int64(len(l.Rel)+len(l.Href)+len(l.Type)+len(l.Title)+
+			len(l.FacetGroup)+len(l.ActiveFacet))
+	}
+	return size
+}
@@ -0,0 +1,21 @@
+package opds
+
+// SchemeSource is the category scheme the aggregator tags entries with to
+// record the source feed they came from.
+const SchemeSource = "urn:opds-aggregator:source"
+
+// TagSource returns a copy of e with a category naming its source feed. An
+// entry already tagged with that source is returned as is.
+func TagSource(e Entry, slug, name string) Entry {
+	for _, c := range e.Categories {
+		if c.Scheme == SchemeSource && c.Term == slug {
+			return e
+		}
+	}
+	e.Categories = append(append([]Category(nil), e.Categories...), Category{
+		Term:   slug,
+		Label:  name,
+		Scheme: SchemeSource,
+	})
+	return e
+}
@@ -1,4 +1,5 @@
-// Package opds provides types, parsing, and rendering for OPDS 1.2 Atom feeds.
+// Package opds provides types, parsing, and rendering for OPDS 1.2 Atom feeds,
+// with conversion to OPDS 2.0 JSON.
 package opds
 
 import "encoding/xml"
@@ -80,6 +81,7 @@ type Entry struct {
 	Language  string     `xml:"http://purl.org/dc/terms/ language,omitempty"`
 	Issued    string     `xml:"http://purl.org/dc/terms/ issued,omitempty"`
 	Publisher string     `xml:"http://purl.org/dc/terms/ publisher,omitempty"`
+	Identifiers []string `xml:"http://purl.org/dc/terms/ identifier,omitempty"`
 	Authors   []Author   `xml:"author,omitempty"`
 	Categories []Category `xml:"category,omitempty"`
 	Links     []Link     `xml:"link"`
@@ -0,0 +1,450 @@
+// Package poller schedules periodic and manually triggered refreshes of upstream feeds.
+package poller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/cron"
+	"github.com/madeddie/opds-aggregator/metrics"
+)
+
+// ErrUnknownFeed is returned when a slug does not match any configured feed.
+var ErrUnknownFeed = errors.New("poller: unknown feed")
+
+// State is the lifecycle state of a feed's refresh job.
+type State string
+
+// Refresh job states.
+const (
+	StateIdle      State = "idle"      // no refresh has run yet
+	StateQueued    State = "queued"    // a refresh is waiting to start
+	StateRunning   State = "running"   // a refresh is in progress
+	StateSucceeded State = "succeeded" // the last refresh completed
+	StateFailed    State = "failed"    // the last refresh returned an error
+)
+
+// Status reports the state of a feed's most recent refresh job.
+type Status struct {
+	Slug          string     `json:"slug"`
+	State         State      `json:"state"`
+	Pending       bool       `json:"pending"` // another refresh is queued behind the running one
+	QueuedAt      *time.Time `json:"queued_at,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	NextRunAt     *time.Time `json:"next_run_at,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	LastError     string     `json:"last_error,omitempty"` // error of the latest failed refresh, kept until one succeeds
+}
+
+// Poller owns one crawl loop per configured feed. Each loop refreshes its feed
+// on startup, on its own schedule (poll_interval or cron expression), and
+// whenever it is triggered manually. Scheduled runs are delayed by a random
+// jitter so that feeds sharing a schedule do not hit their upstreams at once.
+// Triggers for a feed that already has a refresh queued are coalesced.
+// Feeds can be added, changed and removed while the poller runs with Update.
+type Poller struct {
+	crawler   *crawler.Crawler
+	feedCache *cache.FeedCache
+	logger    *slog.Logger
+
+	mu     sync.Mutex
+	jitter time.Duration
+	order  []string // slugs in config order
+	feeds  map[string]*feedLoop
+	ctx    context.Context // set by Run; nil until the loops start
+	wg     sync.WaitGroup
+	ready  bool // every feed had something to serve at some point
+}
+
+type feedLoop struct {
+	cfg       config.FeedConfig
+	schedule  schedule
+	trigger   chan struct{} // holds at most one pending manual trigger
+	status    Status
+	attempted bool // the initial refresh has finished, successfully or not
+	immediate bool // refresh as soon as the loop starts, even if the feed is cached
+
+	cancel context.CancelFunc // stops the loop; nil until it is started
+	done   chan struct{}      // closed when the loop has stopped
+}
+
+func newFeedLoop(fc config.FeedConfig, sched schedule) *feedLoop {
+	return &feedLoop{
+		cfg:      fc,
+		schedule: sched,
+		trigger:  make(chan struct{}, 1),
+		status:   Status{Slug: fc.Slug(), State: StateIdle},
+		done:     make(chan struct{}),
+	}
+}
+
+// New creates a Poller for all feeds in cfg.
+func New(cfg *config.Config, crawl *crawler.Crawler, feedCache *cache.FeedCache, logger *slog.Logger) (*Poller, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	interval, err := cfg.Polling.ParsedInterval()
+	if err != nil {
+		return nil, err
+	}
+	jitter, err := cfg.Polling.ParsedJitter()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Poller{
+		crawler:   crawl,
+		feedCache: feedCache,
+		logger:    logger,
+		jitter:    jitter,
+		feeds:     make(map[string]*feedLoop, len(cfg.Feeds)),
+	}
+	for _, fc := range cfg.Feeds {
+		sched, err := feedSchedule(fc, interval)
+		if err != nil {
+			return nil, err
+		}
+		slug := fc.Slug()
+		p.order = append(p.order, slug)
+		p.feeds[slug] = newFeedLoop(fc, sched)
+	}
+	return p, nil
+}
+
+// feedSchedule builds the refresh schedule for a feed: its cron expression if
+// set, otherwise its poll_interval, otherwise the global polling interval.
+func feedSchedule(fc config.FeedConfig, global time.Duration) (schedule, error) {
+	if fc.Schedule != "" {
+		sched, err := cron.Parse(fc.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("poller: feed %s: %w", fc.Name, err)
+		}
+		return sched, nil
+	}
+	interval, err := fc.ParsedPollInterval(global)
+	if err != nil {
+		return nil, err
+	}
+	return intervalSchedule(interval), nil
+}
+
+// Run starts the crawl loops and blocks until ctx is cancelled and every
+// loop has stopped.
+func (p *Poller) Run(ctx context.Context) {
+	p.mu.Lock()
+	p.ctx = ctx
+	for _, slug := range p.order {
+		p.start(p.feeds[slug])
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	p.wg.Wait()
+}
+
+// start launches a feed's crawl loop. p.mu must be held and Run must have
+// been called.
+func (p *Poller) start(fl *feedLoop) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	fl.cancel = cancel
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(fl.done)
+		p.loop(ctx, fl)
+	}()
+}
+
+// Update applies a new configuration while the poller runs. Loops of removed
+// and changed feeds are stopped, and Update waits for them to finish so that
+// no refresh of an old feed definition can store its result afterwards.
+// The cached trees of removed feeds, and of feeds whose URL changed, are
+// then dropped. Added and changed feeds start new loops that refresh
+// immediately. The schedules of the remaining feeds are recomputed in case
+// the global polling settings changed; their next run is not moved.
+func (p *Poller) Update(cfg *config.Config, diff config.FeedDiff) error {
+	interval, err := cfg.Polling.ParsedInterval()
+	if err != nil {
+		return err
+	}
+	jitter, err := cfg.Polling.ParsedJitter()
+	if err != nil {
+		return err
+	}
+	schedules := make(map[string]schedule, len(cfg.Feeds))
+	for _, fc := range cfg.Feeds {
+		sched, err := feedSchedule(fc, interval)
+		if err != nil {
+			return err
+		}
+		schedules[fc.Slug()] = sched
+	}
+
+	p.mu.Lock()
+	var stopping, starting []*feedLoop
+	var drop []string // slugs whose cached tree no longer matches the config
+	for _, fc := range diff.Removed {
+		if fl, ok := p.feeds[fc.Slug()]; ok {
+			stopping = append(stopping, fl)
+			delete(p.feeds, fc.Slug())
+		}
+		drop = append(drop, fc.Slug())
+	}
+	for _, fc := range diff.Changed {
+		slug := fc.Slug()
+		fl := newFeedLoop(fc, schedules[slug])
+		fl.immediate = true
+		if old, ok := p.feeds[slug]; ok {
+			stopping = append(stopping, old)
+			if old.cfg.URL != fc.URL {
+				drop = append(drop, slug)
+			}
+			fl.status.LastSuccessAt = old.status.LastSuccessAt
+			fl.status.LastError = old.status.LastError
+			fl.attempted = old.attempted
+		}
+		p.feeds[slug] = fl
+		starting = append(starting, fl)
+	}
+	for _, fc := range diff.Added {
+		fl := newFeedLoop(fc, schedules[fc.Slug()])
+		p.feeds[fc.Slug()] = fl
+		starting = append(starting, fl)
+	}
+	p.order = p.order[:0]
+	for _, fc := range cfg.Feeds {
+		slug := fc.Slug()
+		p.order = append(p.order, slug)
+		if fl, ok := p.feeds[slug]; ok {
+			fl.schedule = schedules[slug]
+		}
+	}
+	p.jitter = jitter
+	p.mu.Unlock()
+
+	for _, fl := range stopping {
+		if fl.cancel != nil {
+			fl.cancel()
+			<-fl.done
+		}
+		p.logger.Info("feed loop stopped", "slug", fl.cfg.Slug())
+	}
+	for _, slug := range drop {
+		p.feedCache.Remove(slug)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx != nil {
+		for _, fl := range starting {
+			// A later Update may already have replaced this loop.
+			if p.feeds[fl.cfg.Slug()] == fl && fl.cancel == nil {
+				p.start(fl)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Poller) loop(ctx context.Context, fl *feedLoop) {
+	timer := time.NewTimer(p.initialDelay(fl))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			p.refresh(ctx, fl)
+		case <-fl.trigger:
+			p.refresh(ctx, fl)
+		case <-ctx.Done():
+			return
+		}
+		timer.Reset(p.scheduleNext(fl))
+	}
+}
+
+// initialDelay returns how long to wait before a feed's first refresh. Feeds
+// without a cached tree, and feeds whose configuration just changed, are
+// crawled immediately; feeds restored from a snapshot are staggered by the
+// jitter so a restart does not hit every upstream in the same second.
+func (p *Poller) initialDelay(fl *feedLoop) time.Duration {
+	if _, ok := p.feedCache.Get(fl.cfg.Slug()); !ok || fl.immediate {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delay := p.randomJitter()
+	next := time.Now().Add(delay)
+	fl.status.NextRunAt = &next
+	return delay
+}
+
+// scheduleNext computes the feed's next scheduled refresh, records it in the
+// status, and returns the delay until then.
+func (p *Poller) scheduleNext(fl *feedLoop) time.Duration {
+	now := time.Now()
+
+	p.mu.Lock()
+	next := fl.schedule.Next(now).Add(p.randomJitter())
+	fl.status.NextRunAt = &next
+	p.mu.Unlock()
+	p.logger.Debug("feed refresh scheduled", "slug", fl.cfg.Slug(), "next", next)
+	return next.Sub(now)
+}
+
+// randomJitter returns a random delay up to the configured jitter. p.mu must
+// be held.
+func (p *Poller) randomJitter() time.Duration {
+	if p.jitter <= 0 {
+		return 0
+	}
+	return rand.N(p.jitter)
+}
+
+// refresh crawls a single feed and stores the result in the cache.
+func (p *Poller) refresh(ctx context.Context, fl *feedLoop) {
+	slug := fl.cfg.Slug()
+
+	p.mu.Lock()
+	// The refresh that starts now serves every trigger queued before it,
+	// whether it was started by one of them or by the schedule.
+	select {
+	case <-fl.trigger:
+	default:
+	}
+	started := time.Now()
+	fl.status.State = StateRunning
+	fl.status.StartedAt = &started
+	fl.status.FinishedAt = nil
+	fl.status.NextRunAt = nil
+	fl.status.Error = ""
+	p.mu.Unlock()
+
+	var prev *crawler.FeedTree
+	if cached, ok := p.feedCache.Get(slug); ok {
+		prev = cached.Tree
+	}
+
+	p.logger.Info("feed refresh starting", "slug", slug)
+	tree, err := p.crawler.Recrawl(ctx, fl.cfg, prev)
+	finished := time.Now()
+	if err == nil {
+		p.feedCache.Put(slug, tree)
+		metrics.CrawlDuration.WithLabelValues(slug, "success").Observe(finished.Sub(started).Seconds())
+		metrics.CrawlLastSuccess.WithLabelValues(slug).Set(float64(finished.Unix()))
+	} else {
+		p.logger.Warn("feed refresh failed", "slug", slug, "error", err)
+		metrics.CrawlDuration.WithLabelValues(slug, "failure").Observe(finished.Sub(started).Seconds())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fl.attempted = true
+	fl.status.FinishedAt = &finished
+	switch {
+	case err != nil:
+		fl.status.State = StateFailed
+		fl.status.Error = err.Error()
+		fl.status.LastError = fl.status.Error
+	default:
+		fl.status.State = StateSucceeded
+		fl.status.LastSuccessAt = &finished
+		fl.status.LastError = ""
+	}
+	if fl.status.Pending {
+		fl.status.Pending = false
+		fl.status.State = StateQueued
+	}
+}
+
+// Trigger requests an immediate refresh of one feed and returns its status.
+// If a refresh is already queued the trigger is coalesced into it; if one is
+// running, a single follow-up refresh is queued behind it.
+func (p *Poller) Trigger(slug string) (Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fl, ok := p.feeds[slug]
+	if !ok {
+		return Status{}, fmt.Errorf("%w: %s", ErrUnknownFeed, slug)
+	}
+
+	select {
+	case fl.trigger <- struct{}{}:
+		now := time.Now()
+		if fl.status.State == StateRunning {
+			fl.status.Pending = true
+		} else {
+			fl.status.State = StateQueued
+		}
+		fl.status.QueuedAt = &now
+		p.logger.Info("feed refresh queued", "slug", slug)
+	default:
+		p.logger.Debug("feed refresh already queued, coalescing", "slug", slug)
+	}
+	return fl.status, nil
+}
+
+// TriggerAll requests an immediate refresh of every feed.
+func (p *Poller) TriggerAll() []Status {
+	p.mu.Lock()
+	order := append([]string(nil), p.order...)
+	p.mu.Unlock()
+
+	statuses := make([]Status, 0, len(order))
+	for _, slug := range order {
+		if st, err := p.Trigger(slug); err == nil {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+// Status returns the current refresh status of a feed.
+func (p *Poller) Status(slug string) (Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fl, ok := p.feeds[slug]
+	if !ok {
+		return Status{}, fmt.Errorf("%w: %s", ErrUnknownFeed, slug)
+	}
+	return fl.status, nil
+}
+
+// Ready reports whether every feed has something to serve: either a cached
+// tree (for example one restored from a snapshot) or a finished initial
+// refresh. A feed whose first crawl failed counts as ready so that one dead
+// upstream cannot hold the whole aggregator out of service. The slugs still
+// waiting for their initial crawl are returned in config order. Once the
+// poller has been ready it stays ready: feeds added later by Update do not
+// take the aggregator out of service while they are first crawled.
+func (p *Poller) Ready() (bool, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ready {
+		return true, nil
+	}
+
+	var pending []string
+	for _, slug := range p.order {
+		if p.feeds[slug].attempted {
+			continue
+		}
+		if _, ok := p.feedCache.Get(slug); ok {
+			continue
+		}
+		pending = append(pending, slug)
+	}
+	p.ready = len(pending) == 0
+	return p.ready, pending
+}
@@ -0,0 +1,266 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// upstream serves a small feed on every path but /missing and counts the
+// requests per path. Requests for a path with a gate wait until it is closed.
+type upstream struct {
+	gates map[string]chan struct{}
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.calls[r.URL.Path]++
+	u.mu.Unlock()
+
+	if gate, ok := u.gates[r.URL.Path]; ok {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if r.URL.Path == "/missing" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", opds.MediaTypeAtom)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>%s</id><title>Feed</title></feed>`, r.URL.Path)
+}
+
+func (u *upstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls[path]
+}
+
+// newUpstream starts an upstream whose given paths are gated.
+func newUpstream(t *testing.T, gated ...string) (*upstream, *httptest.Server) {
+	t.Helper()
+	u := &upstream{gates: make(map[string]chan struct{}), calls: make(map[string]int)}
+	for _, path := range gated {
+		u.gates[path] = make(chan struct{})
+	}
+	srv := httptest.NewServer(u)
+	t.Cleanup(srv.Close)
+	return u, srv
+}
+
+// feeds configures a feed named after each upstream path.
+func feeds(base string, paths ...string) []config.FeedConfig {
+	var out []config.FeedConfig
+	for _, path := range paths {
+		out = append(out, config.FeedConfig{Name: path[1:], URL: base + path})
+	}
+	return out
+}
+
+// run starts p until the test ends.
+func run(t *testing.T, p *Poller) {
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func newPoller(t *testing.T, cfg *config.Config, fc *cache.FeedCache) *Poller {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	if fc == nil {
+		fc = cache.NewFeedCache(logger, nil)
+	}
+	p, err := New(cfg, crawler.New(nil, logger), fc, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestScheduledRefreshes(t *testing.T) {
+	u, srv := newUpstream(t)
+	cfg := &config.Config{Feeds: feeds(srv.URL, "/fast", "/slow")}
+	cfg.Feeds[0].PollInterval = "20ms"
+	cfg.Polling.Interval = "1h"
+	p := newPoller(t, cfg, nil)
+	run(t, p)
+
+	waitFor(t, "three refreshes", func() bool { return u.count("/fast") >= 3 })
+	if n := u.count("/slow"); n != 1 {
+		t.Errorf("feed on the global interval refreshed %d times, want once", n)
+	}
+	waitFor(t, "the next run to be scheduled", func() bool {
+		st, _ := p.Status("slow")
+		return st.NextRunAt != nil
+	})
+	st, err := p.Status("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != StateSucceeded || st.LastSuccessAt == nil {
+		t.Errorf("status = %+v, want succeeded", st)
+	}
+	if d := time.Until(*st.NextRunAt); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("next run in %v, want in an hour", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	fc := cache.NewFeedCache(logger, nil)
+	fc.Put("cached", &crawler.FeedTree{Feed: &opds.Feed{}})
+	p := &Poller{feedCache: fc, logger: logger, jitter: 20 * time.Millisecond}
+
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		d := p.randomJitter()
+		if d < 0 || d >= p.jitter {
+			t.Fatalf("jitter %v outside [0, %v)", d, p.jitter)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitter is not random")
+	}
+
+	fl := newFeedLoop(config.FeedConfig{Name: "cached"}, intervalSchedule(time.Hour))
+	if d := p.scheduleNext(fl); d < time.Hour || d >= time.Hour+p.jitter {
+		t.Errorf("next scheduled run in %v, want within the jitter after an hour", d)
+	}
+
+	// Only feeds restored from the cache are staggered on startup.
+	if d := p.initialDelay(fl); d >= p.jitter || fl.status.NextRunAt == nil {
+		t.Errorf("cached feed: initial delay %v, next run %v", d, fl.status.NextRunAt)
+	}
+	fl.immediate = true
+	if d := p.initialDelay(fl); d != 0 {
+		t.Errorf("changed feed: initial delay %v, want 0", d)
+	}
+	uncached := newFeedLoop(config.FeedConfig{Name: "new"}, intervalSchedule(time.Hour))
+	if d := p.initialDelay(uncached); d != 0 {
+		t.Errorf("uncached feed: initial delay %v, want 0", d)
+	}
+}
+
+func TestTriggerCoalesced(t *testing.T) {
+	u, srv := newUpstream(t, "/books")
+	cfg := &config.Config{Feeds: feeds(srv.URL, "/books")}
+	cfg.Polling.Interval = "1h"
+	p := newPoller(t, cfg, nil)
+
+	if _, err := p.Trigger("missing"); !errors.Is(err, ErrUnknownFeed) {
+		t.Errorf("Trigger(missing) error = %v, want ErrUnknownFeed", err)
+	}
+	// Before the loop runs, triggers queue a single refresh.
+	st, _ := p.Trigger("books")
+	again, _ := p.Trigger("books")
+	if st.State != StateQueued || again.QueuedAt != st.QueuedAt {
+		t.Errorf("statuses = %+v, %+v; want one queued refresh", st, again)
+	}
+
+	run(t, p)
+	waitFor(t, "the first refresh", func() bool { return u.count("/books") == 1 })
+	waitFor(t, "the refresh to run", func() bool {
+		st, _ := p.Status("books")
+		return st.State == StateRunning
+	})
+	// While it runs, triggers queue a single follow-up.
+	for range 3 {
+		st, _ = p.Trigger("books")
+		if st.State != StateRunning || !st.Pending {
+			t.Errorf("status while running = %+v, want a pending refresh", st)
+		}
+	}
+
+	close(u.gates["/books"])
+	waitFor(t, "the follow-up refresh", func() bool {
+		st, _ := p.Status("books")
+		return st.State == StateSucceeded && !st.Pending && u.count("/books") == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := u.count("/books"); n != 2 {
+		t.Errorf("feed refreshed %d times, want 2", n)
+	}
+}
+
+func TestReady(t *testing.T) {
+	u, srv := newUpstream(t, "/slow", "/added")
+	logger := slog.New(slog.DiscardHandler)
+	fc := cache.NewFeedCache(logger, nil)
+	fc.Put("cached", &crawler.FeedTree{Feed: &opds.Feed{}})
+	cfg := &config.Config{Feeds: feeds(srv.URL, "/slow", "/missing", "/cached")}
+	cfg.Polling.Interval = "1h"
+	cfg.Polling.Jitter = "1h" // keep the cached feed from refreshing
+	p := newPoller(t, cfg, fc)
+
+	if ready, pending := p.Ready(); ready || !slices.Equal(pending, []string{"slow", "missing"}) {
+		t.Errorf("before Run: Ready() = %t, %v", ready, pending)
+	}
+	run(t, p)
+	// A failed first crawl counts as ready; a running one does not.
+	waitFor(t, "the failing crawl", func() bool {
+		st, _ := p.Status("missing")
+		return st.State == StateFailed
+	})
+	if ready, pending := p.Ready(); ready || !slices.Equal(pending, []string{"slow"}) {
+		t.Errorf("while crawling: Ready() = %t, %v; want slow pending", ready, pending)
+	}
+	if u.count("/cached") != 0 {
+		t.Error("cached feed refreshed on startup despite the jitter")
+	}
+
+	close(u.gates["/slow"])
+	waitFor(t, "readiness", func() bool {
+		ready, _ := p.Ready()
+		return ready
+	})
+
+	// Feeds added later do not take the poller out of service.
+	added := feeds(srv.URL, "/added")
+	next := &config.Config{Polling: cfg.Polling, Feeds: append(slices.Clone(cfg.Feeds), added...)}
+	if err := p.Update(next, config.FeedDiff{Added: added}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the added feed's crawl", func() bool { return u.count("/added") == 1 })
+	if ready, pending := p.Ready(); !ready || len(pending) != 0 {
+		t.Errorf("after Update: Ready() = %t, %v", ready, pending)
+	}
+	close(u.gates["/added"])
+}
@@ -0,0 +1,15 @@
+package poller
+
+import "time"
+
+// schedule computes when a feed should next be refreshed.
+type schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// intervalSchedule refreshes at a fixed interval after the previous run.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/poller"
+	"github.com/madeddie/opds-aggregator/search"
+	"github.com/madeddie/opds-aggregator/server"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 2 * time.Second
+
+// reloader re-reads the configuration and applies it to the running server
+// without a restart.
+type reloader struct {
+	path     string // config file; "" = environment variables only
+	logger   *slog.Logger
+	handler  *server.Handler
+	searcher *search.Searcher
+	crawler  *crawler.Crawler
+	poller   *poller.Poller
+
+	mu  sync.Mutex
+	cfg *config.Config // configuration currently in effect
+}
+
+// reload loads and validates the configuration, then applies it. An invalid
+// configuration is rejected and the previous one stays in effect. Only the
+// feeds that were added or changed are crawled; removed feeds are dropped
+// from the cache.
+func (rl *reloader) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := loadConfig(rl.path)
+	if err != nil {
+		return err
+	}
+	keepStartupSettings(rl.cfg, cfg, rl.logger)
+	warnStateOverrides(cfg, rl.logger)
+	return rl.apply(cfg, "config reloaded")
+}
+
+// UpdateFeeds applies a change to the feed list made through the admin API.
+// update receives a copy of the current feeds and returns the new list; the
+// result is validated, applied like a reload, and saved to the state file.
+func (rl *reloader) UpdateFeeds(update func([]config.FeedConfig) ([]config.FeedConfig, error)) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	feeds, err := update(slices.Clone(rl.cfg.Feeds))
+	if err != nil {
+		return err
+	}
+	cfg, err := rl.cfg.WithFeeds(feeds)
+	if err != nil {
+		return err
+	}
+	if err := rl.apply(cfg, "feeds updated"); err != nil {
+		// The only failures left are feed schedules the poller rejects.
+		return &config.ValidationError{Err: err}
+	}
+	if err := cfg.SaveFeedState(); err != nil {
+		return fmt.Errorf("feeds updated but not saved: %w", err)
+	}
+	return nil
+}
+
+// apply switches the running components to cfg. rl.mu must be held.
+func (rl *reloader) apply(cfg *config.Config, msg string) error {
+	old := rl.cfg
+	diff := config.DiffFeeds(old.Feeds, cfg.Feeds)
+
+	// Swap the request-facing state first so removed feeds stop being served
+	// before their cached trees are dropped.
+	rl.handler.Reload(cfg)
+	rl.searcher.SetConfig(cfg)
+	rl.crawler.SetLimits(cfg.Upstream, cfg.Feeds)
+	if err := rl.poller.Update(cfg, diff); err != nil {
+		rl.handler.Reload(old)
+		rl.searcher.SetConfig(old)
+		rl.crawler.SetLimits(old.Upstream, old.Feeds)
+		return err
+	}
+	rl.cfg = cfg
+
+	rl.logger.Info(msg,
+		"feeds", len(cfg.Feeds),
+		"added", slugs(diff.Added),
+		"changed", slugs(diff.Changed),
+		"removed", slugs(diff.Removed),
+	)
+	return nil
+}
+
+// watch reloads the configuration whenever the config file's modification
+// time or size changes, until ctx is cancelled. The file is polled rather
+// than watched with inotify so that editors replacing the file and
+// Kubernetes ConfigMap symlink swaps are both picked up.
+func (rl *reloader) watch(ctx context.Context) {
+	if rl.path == "" {
+		return
+	}
+	last, _ := os.Stat(rl.path)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		info, err := os.Stat(rl.path)
+		if err != nil {
+			continue // mid-replace, or removed; keep the current config
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		rl.logger.Info("config file changed, reloading", "path", rl.path)
+		if err := rl.reload(); err != nil {
+			rl.logger.Error("config reload failed, keeping current config", "error", err)
+		}
+	}
+}
+
+// loadConfig loads the configuration from path, or from environment
+// variables only when path is empty.
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return config.LoadFromEnv()
+	}
+	return config.Load(path)
+}
+
+// keepStartupSettings carries over the settings that are only read at
+// startup from old to cfg, warning about any that were changed.
+func keepStartupSettings(old, cfg *config.Config, logger *slog.Logger) {
+	keep := func(name string, oldVal, newVal any, restore func()) {
+		if fmt.Sprint(oldVal) != fmt.Sprint(newVal) {
+			logger.Warn("config setting changed but requires a restart", "setting", name)
+			restore()
+		}
+	}
+	keep("server.addr", old.Server.Addr, cfg.Server.Addr, func() { cfg.Server.Addr = old.Server.Addr })
+	keep("cache.dir", old.Cache.Dir, cfg.Cache.Dir, func() { cfg.Cache.Dir = old.Cache.Dir })
+	keep("cache.download_dir", old.Cache.DownloadDir, cfg.Cache.DownloadDir, func() { cfg.Cache.DownloadDir = old.Cache.DownloadDir })
+	keep("cache.download_max_mb", old.Cache.DownloadMaxMB, cfg.Cache.DownloadMaxMB, func() { cfg.Cache.DownloadMaxMB = old.Cache.DownloadMaxMB })
+	keep("conversion.command", old.Conversion.Command, cfg.Conversion.Command, func() { cfg.Conversion.Command = old.Conversion.Command })
+	keep("conversion.args", old.Conversion.Args, cfg.Conversion.Args, func() { cfg.Conversion.Args = old.Conversion.Args })
+	keep("conversion.timeout", old.Conversion.Timeout, cfg.Conversion.Timeout, func() { cfg.Conversion.Timeout = old.Conversion.Timeout })
+	keep("conversion.max_concurrent", old.Conversion.MaxConcurrent, cfg.Conversion.MaxConcurrent, func() { cfg.Conversion.MaxConcurrent = old.Conversion.MaxConcurrent })
+}
+
+// warnStateOverrides logs the configured feeds whose settings the admin
+// state file overrides, since edits to them in the config file are ignored.
+func warnStateOverrides(cfg *config.Config, logger *slog.Logger) {
+	if overridden := cfg.StateOverrides(); len(overridden) > 0 {
+		logger.Warn("admin state file overrides configured feeds; their config file settings are ignored",
+			"stateFile", cfg.Admin.StateFile, "feeds", overridden)
+	}
+}
+
+func slugs(feeds []config.FeedConfig) []string {
+	out := make([]string, len(feeds))
+	for i, fc := range feeds {
+		out[i] = fc.Slug()
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/poller"
+	"github.com/madeddie/opds-aggregator/search"
+	"github.com/madeddie/opds-aggregator/server"
+)
+
+// countingUpstream serves an empty feed on every path and counts the
+// requests per path.
+type countingUpstream struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (u *countingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.calls[r.URL.Path]++
+	u.mu.Unlock()
+	w.Header().Set("Content-Type", "application/atom+xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>%s</id><title>Feed</title></feed>`, r.URL.Path)
+}
+
+func (u *countingUpstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls[path]
+}
+
+// writeTestConfig writes a config listening on addr with a feed per
+// "name path" pair, served by upstream.
+func writeTestConfig(t *testing.T, path, addr, upstream string, feeds ...string) {
+	t.Helper()
+	data := "server:\n  addr: " + addr + "\npolling:\n  interval: 1h\nfeeds:\n"
+	for i := 0; i < len(feeds); i += 2 {
+		data += "  - name: " + feeds[i] + "\n    url: " + upstream + feeds[i+1] + "\n"
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReload(t *testing.T) {
+	up := &countingUpstream{calls: make(map[string]int)}
+	upstream := httptest.NewServer(up)
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, path, ":8080", upstream.URL, "Kept", "/kept", "Moved", "/moved", "Gone", "/gone")
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.DiscardHandler)
+	feedCache := cache.NewFeedCache(logger, nil)
+	crawl := crawler.New(nil, logger)
+	searcher := search.New(cfg, feedCache, nil, crawl, logger)
+	poll, err := poller.New(cfg, crawl, feedCache, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		poll.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	rl := &reloader{
+		path:     path,
+		logger:   logger,
+		handler:  server.NewHandler(cfg, feedCache, crawl, searcher, poll, nil, nil, nil, logger),
+		searcher: searcher,
+		crawler:  crawl,
+		poller:   poll,
+		cfg:      cfg,
+	}
+	waitUntil(t, "the initial crawls", func() bool { return len(feedCache.All()) == 3 })
+
+	// Move one feed, drop one, add one, and change a startup-only setting.
+	writeTestConfig(t, path, ":9090", upstream.URL, "Kept", "/kept", "Moved", "/moved-here", "Added", "/added")
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "the changed and added feeds to be crawled", func() bool {
+		moved, ok := feedCache.Get("moved")
+		_, added := feedCache.Get("added")
+		return ok && moved.Tree.URL == upstream.URL+"/moved-here" && added
+	})
+
+	if _, ok := feedCache.Get("gone"); ok {
+		t.Error("removed feed still cached")
+	}
+	if _, err := poll.Status("gone"); !errors.Is(err, poller.ErrUnknownFeed) {
+		t.Errorf("removed feed still polled: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for path, want := range map[string]int{"/kept": 1, "/moved": 1, "/moved-here": 1, "/added": 1, "/gone": 1} {
+		if n := up.count(path); n != want {
+			t.Errorf("%s fetched %d times, want %d", path, n, want)
+		}
+	}
+	if rl.cfg.Server.Addr != ":8080" {
+		t.Errorf("server.addr = %q, want the startup value kept", rl.cfg.Server.Addr)
+	}
+
+	// An invalid configuration leaves the current one in effect.
+	if err := os.WriteFile(path, []byte("polling:\n  interval: soon\nfeeds: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.reload(); err == nil {
+		t.Error("invalid config accepted")
+	}
+	if len(rl.cfg.Feeds) != 3 {
+		t.Errorf("got %d feeds after a failed reload, want 3", len(rl.cfg.Feeds))
+	}
+	if _, ok := feedCache.Get("kept"); !ok {
+		t.Error("failed reload dropped a feed")
+	}
+}
@@ -1,21 +1,24 @@
-// Package search provides fan-out search across upstream OPDS catalogs.
+// Package search answers searches from the local index of cached catalogs,
+// fanning out to upstream OpenSearch endpoints for sources that were not
+// fully crawled.
 package search
 
 import (
 	"context"
 	"encoding/xml"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/madeddie/opds-aggregator/cache"
 	"github.com/madeddie/opds-aggregator/config"
 	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/index"
+	"github.com/madeddie/opds-aggregator/metrics"
 	"github.com/madeddie/opds-aggregator/opds"
 )
 
@@ -33,26 +36,46 @@ type OpenSearchURL struct {
 	Type     string `xml:"type,attr"`
 }
 
+// maxLocalResults caps the number of entries returned from the local index.
+// Search results are not paginated, so matches past the cap are not shown;
+// a more specific query finds them.
+const maxLocalResults = 200
+
+// maxUpstreamSearches caps how many sources one search queries upstream at
+// the same time.
+const maxUpstreamSearches = 8
+
 // Searcher handles search requests across upstream feeds.
 type Searcher struct {
-	cfg       *config.Config
+	cfg       atomic.Pointer[config.Config]
 	feedCache *cache.FeedCache
+	index     *index.Index // nil = upstream search only
 	crawler   *crawler.Crawler
 	logger    *slog.Logger
 }
 
 // New creates a new Searcher.
-func New(cfg *config.Config, feedCache *cache.FeedCache, crawl *crawler.Crawler, logger *slog.Logger) *Searcher {
-	return &Searcher{
-		cfg:       cfg,
+func New(cfg *config.Config, feedCache *cache.FeedCache, ix *index.Index, crawl *crawler.Crawler, logger *slog.Logger) *Searcher {
+	s := &Searcher{
 		feedCache: feedCache,
+		index:     ix,
 		crawler:   crawl,
 		logger:    logger,
 	}
+	s.cfg.Store(cfg)
+	return s
+}
+
+// SetConfig replaces the configuration used to pick the sources to search.
+func (s *Searcher) SetConfig(cfg *config.Config) {
+	s.cfg.Store(cfg)
 }
 
-// Search performs a fan-out search across all sources that have OpenSearch endpoints.
-func (s *Searcher) Search(ctx context.Context, query string) (*opds.Feed, error) {
+// Search answers a query from the local index, ranked by relevance, then
+// appends upstream OpenSearch results for sources whose cached tree does not
+// cover their whole catalog. Every entry is tagged with its source. slugs
+// restricts the search to those sources; nil searches every configured source.
+func (s *Searcher) Search(ctx context.Context, query string, slugs []string) (*opds.Feed, error) {
 	results := &opds.Feed{
 		ID:      "urn:opds-aggregator:search:" + url.QueryEscape(query),
 		Title:   fmt.Sprintf("Search results for %q", query),
@@ -63,44 +86,87 @@ func (s *Searcher) Search(ctx context.Context, query string) (*opds.Feed, error)
 		},
 	}
 
+	cfg := s.cfg.Load()
+	feedsBySlug := make(map[string]config.FeedConfig, len(cfg.Feeds))
+	for _, fc := range cfg.Feeds {
+		feedsBySlug[fc.Slug()] = fc
+	}
+	if slugs == nil {
+		for _, fc := range cfg.Feeds {
+			slugs = append(slugs, fc.Slug())
+		}
+	}
+	var feeds []config.FeedConfig
+	for _, slug := range slugs {
+		if fc, ok := feedsBySlug[slug]; ok {
+			feeds = append(feeds, fc)
+		}
+	}
+
+	if s.index != nil {
+		for _, hit := range s.index.Search(query, slugs, maxLocalResults) {
+			results.Entries = append(results.Entries, opds.TagSource(hit.Entry, hit.Slug, feedsBySlug[hit.Slug].Name))
+		}
+	}
+
 	var mu sync.Mutex
 	var wg sync.WaitGroup
+	var upstream []opds.Entry
+	slots := make(chan struct{}, maxUpstreamSearches)
 
-	for _, feedCfg := range s.cfg.Feeds {
+feeds:
+	for _, feedCfg := range feeds {
+		if s.index != nil && s.index.Complete(feedCfg.Slug()) {
+			continue
+		}
 		cached, ok := s.feedCache.Get(feedCfg.Slug())
 		if !ok || cached.Tree.SearchURL == "" {
 			continue
 		}
 
+		// Query at most maxUpstreamSearches sources at a time.
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break feeds
+		}
 		wg.Add(1)
 		go func(fc config.FeedConfig, searchURL string) {
 			defer wg.Done()
+			defer func() { <-slots }()
 
-			entries, err := s.searchUpstream(ctx, fc, searchURL, query)
+			start := time.Now()
+			entries, err := s.searchUpstream(crawler.WithSource(ctx, fc.Slug()), fc, searchURL, query)
+			metrics.SearchDuration.WithLabelValues(fc.Slug()).Observe(time.Since(start).Seconds())
 			if err != nil {
 				s.logger.Warn("search failed for source", "name", fc.Name, "error", err)
 				return
 			}
 
 			mu.Lock()
-			results.Entries = append(results.Entries, entries...)
+			upstream = append(upstream, entries...)
 			mu.Unlock()
 		}(feedCfg, cached.Tree.SearchURL)
 	}
 
 	wg.Wait()
+	results.Entries = append(results.Entries, upstream...)
 	return results, nil
 }
 
 // SearchSource searches a specific upstream source.
 func (s *Searcher) SearchSource(ctx context.Context, slug string, feedCfg config.FeedConfig, searchDescURL, query string) (*opds.Feed, error) {
+	ctx = crawler.WithSource(ctx, slug)
+	start := time.Now()
+	defer func() { metrics.SearchDuration.WithLabelValues(slug).Observe(time.Since(start).Seconds()) }()
+
 	// Fetch the OpenSearch description to get the URL template.
 	tmpl, err := s.fetchSearchTemplate(ctx, searchDescURL, feedCfg.Auth)
 	if err != nil {
 		return nil, fmt.Errorf("fetch search template: %w", err)
 	}
 
-	searchURL := expandTemplate(tmpl, query)
+	searchURL := resolveSearchURL(searchDescURL, expandTemplate(tmpl, query))
 	feed, err := s.crawler.FetchPaginated(ctx, searchURL, feedCfg.Auth)
 	if err != nil {
 		return nil, fmt.Errorf("search source %s: %w", slug, err)
@@ -115,47 +181,37 @@ func (s *Searcher) searchUpstream(ctx context.Context, feedCfg config.FeedConfig
 		return nil, err
 	}
 
-	searchURL := expandTemplate(tmpl, query)
+	searchURL := resolveSearchURL(searchDescURL, expandTemplate(tmpl, query))
 	feed, err := s.crawler.FetchFeedByURL(ctx, searchURL, feedCfg.Auth)
 	if err != nil {
 		return nil, err
 	}
 
-	// Tag entries with their source.
+	// Tag entries with their source and make their links absolute, so they
+	// can be rewritten and merged without knowing the search URL.
 	for i := range feed.Entries {
-		feed.Entries[i].Categories = append(feed.Entries[i].Categories, opds.Category{
-			Term:   feedCfg.Slug(),
-			Label:  feedCfg.Name,
-			Scheme: "urn:opds-aggregator:source",
-		})
+		for j, l := range feed.Entries[i].Links {
+			feed.Entries[i].Links[j].Href = crawler.ResolveURL(searchURL, l.Href)
+		}
+		feed.Entries[i] = opds.TagSource(feed.Entries[i], feedCfg.Slug(), feedCfg.Name)
 	}
 
 	return feed.Entries, nil
 }
 
 func (s *Searcher) fetchSearchTemplate(ctx context.Context, descURL string, auth *config.AuthConfig) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, descURL, nil)
-	if err != nil {
-		return "", err
-	}
-	if auth != nil && auth.Username != "" {
-		req.SetBasicAuth(auth.Username, auth.Password)
+	// OPDS 2.0 sources link straight to a search template (converted from
+	// its URI template when the feed was parsed) instead of to an OpenSearch
+	// description document.
+	if strings.Contains(descURL, "{searchTerms}") {
+		return descURL, nil
 	}
 
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	body, err := s.crawler.FetchDocument(ctx, descURL, auth, 64*1024)
 	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("OpenSearch desc HTTP %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
-	if err != nil {
-		return "", err
+		return "", fmt.Errorf("OpenSearch desc: %w", err)
 	}
 
 	// Parse the OpenSearch description XML to extract the URL template.
@@ -187,6 +243,20 @@ func (s *Searcher) fetchSearchTemplate(ctx context.Context, descURL string, auth
 	return "", fmt.Errorf("no URL template in OpenSearch description")
 }
 
+// resolveSearchURL resolves a search URL expanded from a relative template
+// against the OpenSearch description the template came from.
+func resolveSearchURL(descURL, searchURL string) string {
+	base, err := url.Parse(descURL)
+	if err != nil {
+		return searchURL
+	}
+	ref, err := url.Parse(searchURL)
+	if err != nil {
+		return searchURL
+	}
+	return base.ResolveReference(ref).String()
+}
+
 // expandTemplate replaces {searchTerms} in an OpenSearch URL template.
 func expandTemplate(tmpl, query string) string {
 	result := strings.ReplaceAll(tmpl, "{searchTerms}", url.QueryEscape(query))
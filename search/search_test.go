@@ -0,0 +1,164 @@
+package search
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/index"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// openSearch is an upstream answering OpenSearch queries with one book per
+// source, named after the path prefix. It records the most queries it
+// answered at the same time.
+type openSearch struct {
+	delay time.Duration
+
+	mu       sync.Mutex
+	calls    map[string]int
+	inFlight int
+	peak     int
+}
+
+func (u *openSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.calls[r.URL.Path]++
+	u.inFlight++
+	u.peak = max(u.peak, u.inFlight)
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.inFlight--
+		u.mu.Unlock()
+	}()
+
+	source, page, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch page {
+	case "opensearch.xml":
+		w.Header().Set("Content-Type", opds.MediaTypeOpenSearch)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+<ShortName>%[1]s</ShortName>
+<Url type="text/html" template="/%[1]s/html?q={searchTerms}"/>
+<Url type="application/atom+xml;profile=opds-catalog" template="/%[1]s/search?q={searchTerms}&amp;page={startPage?}"/>
+</OpenSearchDescription>`, source)
+	case "search":
+		time.Sleep(u.delay)
+		w.Header().Set("Content-Type", opds.MediaTypeAtom)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>%[1]s</id><title>Results</title>
+<entry><id>urn:%[1]s</id><title>%[2]s from %[1]s</title>
+<link rel="http://opds-spec.org/acquisition" type="application/epub+zip" href="book.epub"/></entry></feed>`, source, r.URL.Query().Get("q"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newSearcher configures a source per slug, caches a root for each linking
+// to the upstream's search, and indexes the books of the complete ones.
+func newSearcher(t *testing.T, upstream string, complete map[string]bool, slugs ...string) *Searcher {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{}
+	fc := cache.NewFeedCache(logger, nil)
+	ix := index.New()
+	for _, slug := range slugs {
+		cfg.Feeds = append(cfg.Feeds, config.FeedConfig{Name: slug, URL: upstream + "/" + slug})
+		tree := &crawler.FeedTree{
+			URL:       upstream + "/" + slug,
+			Children:  make(map[string]*crawler.FeedTree),
+			SearchURL: upstream + "/" + slug + "/opensearch.xml",
+			Complete:  complete[slug],
+			Feed: &opds.Feed{Title: slug, Entries: []opds.Entry{{
+				ID:    "urn:local:" + slug,
+				Title: "Dune in " + slug,
+				Links: []opds.Link{{Rel: opds.RelAcquisition, Href: "local.epub", Type: "application/epub+zip"}},
+			}}},
+		}
+		fc.Put(slug, tree)
+		ix.Update(slug, tree)
+	}
+	return New(cfg, fc, ix, crawler.New(nil, logger), logger)
+}
+
+func TestSearchFanOut(t *testing.T) {
+	up := &openSearch{calls: make(map[string]int)}
+	upstream := httptest.NewServer(up)
+	defer upstream.Close()
+
+	s := newSearcher(t, upstream.URL, map[string]bool{"local": true}, "local", "remote", "hidden")
+	feed, err := s.Search(t.Context(), "dune", []string{"local", "remote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range feed.Entries {
+		got = append(got, e.Title+" ("+e.Links[0].Href+")")
+	}
+	// Local hits come first, best match first; the complete source is not
+	// queried upstream, and the unlisted one not at all.
+	want := []string{
+		"Dune in local (" + upstream.URL + "/local/local.epub)",
+		"Dune in remote (" + upstream.URL + "/remote/local.epub)",
+		"dune from remote (" + upstream.URL + "/remote/search/book.epub)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, e := range feed.Entries {
+		if slug := strings.Fields(e.Title)[2]; !hasSource(e, slug) {
+			t.Errorf("%q not tagged with its source", e.Title)
+		}
+	}
+	if up.calls["/local/search"] != 0 || up.calls["/hidden/search"] != 0 || up.calls["/remote/search"] != 1 {
+		t.Errorf("upstream searches = %v, want only remote's", up.calls)
+	}
+}
+
+func hasSource(e opds.Entry, slug string) bool {
+	for _, c := range e.Categories {
+		if c.Scheme == opds.SchemeSource && c.Term == slug {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSearchFanOutBounded(t *testing.T) {
+	up := &openSearch{delay: 20 * time.Millisecond, calls: make(map[string]int)}
+	upstream := httptest.NewServer(up)
+	defer upstream.Close()
+
+	var slugs []string
+	for i := range 2 * maxUpstreamSearches {
+		slugs = append(slugs, fmt.Sprintf("s%02d", i))
+	}
+	s := newSearcher(t, upstream.URL, nil, slugs...)
+	feed, err := s.Search(t.Context(), "dune", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamHits := 0
+	for _, e := range feed.Entries {
+		if strings.HasPrefix(e.Title, "dune from ") {
+			upstreamHits++
+		}
+	}
+	if upstreamHits != len(slugs) {
+		t.Errorf("got %d upstream results, want %d", upstreamHits, len(slugs))
+	}
+	if up.peak > maxUpstreamSearches {
+		t.Errorf("%d upstream requests at once, want at most %d", up.peak, maxUpstreamSearches)
+	}
+}
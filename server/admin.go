@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+// FeedUpdater changes the configured feeds at runtime. update receives a
+// copy of the current feed list and returns the new one; the implementation
+// validates the result, applies it (crawling added and changed feeds), and
+// persists it. Invalid feed lists are reported as *config.ValidationError.
+type FeedUpdater interface {
+	UpdateFeeds(update func([]config.FeedConfig) ([]config.FeedConfig, error)) error
+}
+
+var (
+	errFeedNotFound = errors.New("unknown feed")
+	errFeedExists   = errors.New("feed already exists")
+)
+
+// AdminHandler serves the JSON admin API for managing feeds.
+type AdminHandler struct {
+	handler *Handler
+	feeds   FeedUpdater
+	logger  *slog.Logger
+}
+
+// NewAdminHandler creates the admin API. Feed lists are read from h and
+// changes are applied through feeds.
+func NewAdminHandler(h *Handler, feeds FeedUpdater, logger *slog.Logger) *AdminHandler {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &AdminHandler{handler: h, feeds: feeds, logger: logger}
+}
+
+// adminFeed is a feed as shown by the admin API: its configuration plus the
+// slug derived from its name. Upstream passwords are never returned.
+type adminFeed struct {
+	Slug string `json:"slug"`
+	config.FeedConfig
+}
+
+func newAdminFeed(fc config.FeedConfig) adminFeed {
+	if fc.Auth != nil {
+		fc.Auth = &config.AuthConfig{Username: fc.Auth.Username}
+	}
+	return adminFeed{Slug: fc.Slug(), FeedConfig: fc}
+}
+
+// RequireAdmin returns middleware that only lets admin accounts through.
+// Without any accounts configured there is nobody to authenticate, so the
+// admin API stays closed.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := UserFromContext(r.Context()); !ok || !u.Admin {
+			http.Error(w, "admin account required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminOnly returns middleware that, like RequireAdmin, only lets admin
+// accounts through, except that while accounts returns none everything stays
+// open, as with BasicAuth. It guards endpoints that are useful without auth
+// but must not be exposed to ordinary users once there are accounts.
+func AdminOnly(accounts func() map[string]config.UserConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		admin := RequireAdmin(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(accounts()) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			admin.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HandleList returns every configured feed.
+func (a *AdminHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	feeds := []adminFeed{}
+	for _, fc := range a.handler.current().cfg.Feeds {
+		feeds = append(feeds, newAdminFeed(fc))
+	}
+	writeJSON(w, http.StatusOK, feeds, a.logger)
+}
+
+// HandleGet returns a single feed.
+func (a *AdminHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	fc, ok := a.handler.current().feedMap[chi.URLParam(r, "slug")]
+	if !ok {
+		http.Error(w, errFeedNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminFeed(fc), a.logger)
+}
+
+// HandleCreate adds a feed and crawls it.
+func (a *AdminHandler) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	fc, ok := a.decodeFeed(w, r)
+	if !ok {
+		return
+	}
+	err := a.feeds.UpdateFeeds(func(feeds []config.FeedConfig) ([]config.FeedConfig, error) {
+		if _, i := findFeed(feeds, fc.Slug()); i >= 0 {
+			return nil, fmt.Errorf("%w: %s", errFeedExists, fc.Slug())
+		}
+		return append(feeds, fc), nil
+	})
+	if a.writeError(w, err) {
+		return
+	}
+	a.logger.Info("feed added through admin API", "slug", fc.Slug())
+	w.Header().Set("Location", "/api/feeds/"+fc.Slug())
+	writeJSON(w, http.StatusCreated, newAdminFeed(fc), a.logger)
+}
+
+// HandleUpdate replaces a feed's configuration and re-crawls it. Renaming a
+// feed changes its slug. An auth block without a password keeps the stored
+// password as long as the username is unchanged.
+func (a *AdminHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+	fc, ok := a.decodeFeed(w, r)
+	if !ok {
+		return
+	}
+	err := a.feeds.UpdateFeeds(func(feeds []config.FeedConfig) ([]config.FeedConfig, error) {
+		old, i := findFeed(feeds, slug)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", errFeedNotFound, slug)
+		}
+		if newSlug := fc.Slug(); newSlug != slug {
+			if _, j := findFeed(feeds, newSlug); j >= 0 {
+				return nil, fmt.Errorf("%w: %s", errFeedExists, newSlug)
+			}
+		}
+		if fc.Auth != nil && fc.Auth.Password == "" && old.Auth != nil && old.Auth.Username == fc.Auth.Username {
+			fc.Auth.Password = old.Auth.Password
+		}
+		feeds[i] = fc
+		return feeds, nil
+	})
+	if a.writeError(w, err) {
+		return
+	}
+	a.logger.Info("feed updated through admin API", "slug", slug, "newSlug", fc.Slug())
+	writeJSON(w, http.StatusOK, newAdminFeed(fc), a.logger)
+}
+
+// HandleDelete removes a feed and drops its cached tree.
+func (a *AdminHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+	err := a.feeds.UpdateFeeds(func(feeds []config.FeedConfig) ([]config.FeedConfig, error) {
+		_, i := findFeed(feeds, slug)
+		if i < 0 {
+			return nil, fmt.Errorf("%w: %s", errFeedNotFound, slug)
+		}
+		return append(feeds[:i], feeds[i+1:]...), nil
+	})
+	if a.writeError(w, err) {
+		return
+	}
+	a.logger.Info("feed deleted through admin API", "slug", slug)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeFeed reads a feed configuration from the request body, writing a
+// 400 response if it is malformed. A slug in the body is ignored, so feeds
+// returned by the API can be sent back as they are.
+func (a *AdminHandler) decodeFeed(w http.ResponseWriter, r *http.Request) (config.FeedConfig, bool) {
+	var f adminFeed
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		http.Error(w, "invalid feed: "+err.Error(), http.StatusBadRequest)
+		return config.FeedConfig{}, false
+	}
+	return f.FeedConfig, true
+}
+
+// writeError writes the response for a failed feed update and reports
+// whether there was an error.
+func (a *AdminHandler) writeError(w http.ResponseWriter, err error) bool {
+	var invalid *config.ValidationError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errFeedNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errFeedExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		a.logger.Error("admin feed update failed", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return true
+}
+
+// findFeed returns the feed with the given slug and its index, or -1.
+func findFeed(feeds []config.FeedConfig, slug string) (config.FeedConfig, int) {
+	for i, fc := range feeds {
+		if fc.Slug() == slug {
+			return fc, i
+		}
+	}
+	return config.FeedConfig{}, -1
+}
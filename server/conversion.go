@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/convert"
+)
+
+// lookupFormats resolves format names; unknown names are skipped (config
+// validation rejects them).
+func lookupFormats(names []string) []convert.Format {
+	var out []convert.Format
+	for _, name := range names {
+		if f, ok := convert.Lookup(name); ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// conversionTarget returns the configured conversion target with the given name.
+func (h *Handler) conversionTarget(name string) (convert.Format, bool) {
+	for _, f := range h.current().convertTo {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return convert.Format{}, false
+}
+
+// serveConverted serves the book at dlURL converted to format. Only books
+// the feed links to are converted. Every conversion goes through the
+// conversion cache, so each book is converted once per format, and
+// concurrent requests for the same conversion share a single converter run.
+func (h *Handler) serveConverted(w http.ResponseWriter, r *http.Request, feedCfg config.FeedConfig, dlURL string, format convert.Format) {
+	slug := feedCfg.Slug()
+	if h.conversions == nil || !h.linkedFrom(slug, dlURL) {
+		http.Error(w, "unknown download", http.StatusNotFound)
+		return
+	}
+
+	key := dlURL + "#convert=" + format.Name
+	if h.serveCachedConversion(w, r, slug, key) {
+		return
+	}
+	_, err := h.converts.do(r.Context(), slug+" "+key, func(ctx context.Context) (struct{}, error) {
+		// A conversion that finished just before this one started.
+		if f, _, ok := h.conversions.Open(slug, key); ok {
+			f.Close()
+			return struct{}{}, nil
+		}
+		dir, dst, err := h.convertDownload(ctx, feedCfg, dlURL, format)
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer os.RemoveAll(dir)
+		out, err := os.Open(dst)
+		if err != nil {
+			return struct{}{}, err
+		}
+		defer out.Close()
+		if err := storeFile(h.conversions, slug, key, format.MediaType, convertedHeader(dlURL, format), out); err != nil {
+			h.logger.Error("failed to cache converted download", "url", dlURL, "error", err)
+			return struct{}{}, err
+		}
+		return struct{}{}, nil
+	})
+	if err != nil {
+		h.conversionError(w, r, err)
+		return
+	}
+	if !h.serveCachedConversion(w, r, slug, key) {
+		// The cache discards files larger than the whole cache.
+		h.logger.Error("converted download too large to cache", "url", dlURL, "format", format.Name)
+		http.Error(w, "conversion failed", http.StatusBadGateway)
+	}
+}
+
+// serveCachedConversion serves a converted download from the cache and
+// reports whether it was there.
+func (h *Handler) serveCachedConversion(w http.ResponseWriter, r *http.Request, slug, key string) bool {
+	f, entry, ok := h.conversions.Open(slug, key)
+	if !ok {
+		return false
+	}
+	defer f.Close()
+	serveCachedDownload(w, r, f, entry)
+	return true
+}
+
+// errConversionSource marks a failure to fetch the book to be converted.
+var errConversionSource = errors.New("fetch conversion source")
+
+// convertDownload fetches the book at dlURL and converts it to format in a
+// new temporary directory. It returns the directory, which the caller must
+// remove, and the path of the converted file.
+func (h *Handler) convertDownload(ctx context.Context, feedCfg config.FeedConfig, dlURL string, format convert.Format) (string, string, error) {
+	dir, err := os.MkdirTemp("", "opds-convert-")
+	if err != nil {
+		h.logger.Error("conversion temp dir failed", "error", err)
+		return "", "", err
+	}
+
+	src, err := h.fetchToFile(ctx, feedCfg, dlURL, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		h.logger.Error("conversion source fetch failed", "url", dlURL, "error", err)
+		return "", "", fmt.Errorf("%w: %w", errConversionSource, err)
+	}
+
+	dst := filepath.Join(dir, "output"+format.Ext)
+	start := time.Now()
+	if err := h.converter.Convert(ctx, src, dst); err != nil {
+		os.RemoveAll(dir)
+		h.logger.Error("conversion failed", "url", dlURL, "format", format.Name, "error", err)
+		return "", "", err
+	}
+	h.logger.Info("converted download", "url", dlURL, "format", format.Name, "duration", time.Since(start))
+	return dir, dst, nil
+}
+
+// conversionError answers a request whose conversion failed.
+func (h *Handler) conversionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		// The client went away; there is nobody to answer.
+	case errors.Is(err, errConversionSource):
+		http.Error(w, "failed to fetch download", http.StatusBadGateway)
+	default:
+		http.Error(w, "conversion failed", http.StatusBadGateway)
+	}
+}
+
+// convertedHeader returns the headers served and cached with a converted
+// download.
+func convertedHeader(dlURL string, format convert.Format) http.Header {
+	header := make(http.Header)
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": convertedFilename(dlURL, format),
+	}))
+	return header
+}
+
+// fetchToFile saves the download at dlURL into dir, from the download cache
+// if present, and returns the file path. The extension follows the upstream
+// media type so the converter can recognise the input format. Books larger
+// than conversion.max_input_mb are rejected.
+func (h *Handler) fetchToFile(ctx context.Context, feedCfg config.FeedConfig, dlURL, dir string) (string, error) {
+	maxBytes := int64(h.current().cfg.Conversion.MaxInputMB) << 20
+	var body io.ReadCloser
+	var contentType string
+	if h.downloads != nil {
+		if f, entry, ok := h.downloads.Open(feedCfg.Slug(), dlURL); ok {
+			body, contentType = f, entry.ContentType
+		}
+	}
+	if body == nil {
+		resp, err := h.crawler.FetchRaw(ctx, http.MethodGet, dlURL, feedCfg.Auth, nil)
+		if err != nil {
+			return "", err
+		}
+		if resp.ContentLength > maxBytes {
+			resp.Body.Close()
+			return "", fmt.Errorf("%s: book of %d bytes exceeds the limit of %d", dlURL, resp.ContentLength, maxBytes)
+		}
+		body, contentType = resp.Body, resp.Header.Get("Content-Type")
+	}
+	defer body.Close()
+
+	ext := path.Ext(urlPath(dlURL))
+	if f, ok := convert.ForMediaType(contentType); ok {
+		ext = f.Ext
+	}
+	name := filepath.Join(dir, "input"+ext)
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		f.Close()
+		return "", fmt.Errorf("read %s: %w", dlURL, err)
+	}
+	if n > maxBytes {
+		f.Close()
+		return "", fmt.Errorf("%s: book exceeds the limit of %d bytes", dlURL, maxBytes)
+	}
+	return name, f.Close()
+}
+
+// convertedFilename names a converted download after the last path segment
+// of its source URL.
+func convertedFilename(dlURL string, format convert.Format) string {
+	base := path.Base(urlPath(dlURL))
+	if i := strings.Index(base, "."); i > 0 {
+		base = base[:i]
+	}
+	if base == "" || base == "." || base == "/" {
+		base = "book"
+	}
+	return base + format.Ext
+}
+
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
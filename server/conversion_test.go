@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/blobcache"
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// countingConverter copies its input after a short delay and counts runs.
+type countingConverter struct {
+	runs atomic.Int32
+}
+
+func (c *countingConverter) Convert(ctx context.Context, src, dst string) error {
+	c.runs.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, append([]byte("converted "), data...), 0o644)
+}
+
+// conversionServer serves a feed linking to /book.epub, and to /big.epub and
+// /stream.epub, which are larger than the 1 MiB input limit (the latter
+// without a Content-Length). No download cache is configured.
+type conversionServer struct {
+	srv       http.Handler
+	upstream  string
+	converter *countingConverter
+	fetches   atomic.Int32
+}
+
+func newConversionServer(t *testing.T) *conversionServer {
+	t.Helper()
+	cs := &conversionServer{converter: &countingConverter{}}
+	big := bytes.Repeat([]byte("x"), 2<<20)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cs.fetches.Add(1)
+		w.Header().Set("Content-Type", "application/epub+zip")
+		switch r.URL.Path {
+		case "/big.epub":
+			w.Write(big)
+		case "/stream.epub":
+			for i := 0; i < len(big); i += 64 << 10 {
+				w.Write(big[i : i+64<<10])
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write([]byte("book"))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	cs.upstream = upstream.URL
+
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{
+		Feeds: []config.FeedConfig{{Name: "Books", URL: upstream.URL}},
+		Conversion: config.ConversionConfig{
+			Command:    "fake",
+			From:       []string{"epub"},
+			To:         []string{"mobi"},
+			MaxInputMB: 1,
+		},
+	}
+	var entries []opds.Entry
+	for _, name := range []string{"book", "big", "stream"} {
+		entries = append(entries, opds.Entry{
+			ID:    name,
+			Links: []opds.Link{{Rel: opds.RelAcquisition, Href: upstream.URL + "/" + name + ".epub", Type: "application/epub+zip"}},
+		})
+	}
+	fc := cache.NewFeedCache(logger, nil)
+	fc.Put("books", &crawler.FeedTree{
+		Feed:     &opds.Feed{Entries: entries},
+		URL:      upstream.URL,
+		Children: make(map[string]*crawler.FeedTree),
+	})
+	conversions, err := blobcache.New(t.TempDir(), 1<<20, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(cfg, fc, crawler.New(nil, logger), nil, nil, nil, cs.converter, conversions, logger)
+	cs.srv = New(cfg, h, nil, logger).Handler
+	return cs
+}
+
+func (cs *conversionServer) download(bookURL string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/opds/download/books?url="+url.QueryEscape(bookURL)+"&convert=mobi", nil)
+	rec := httptest.NewRecorder()
+	cs.srv.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestConversionsSharedAndCached(t *testing.T) {
+	cs := newConversionServer(t)
+	bookURL := cs.upstream + "/book.epub"
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := cs.download(bookURL); rec.Code != http.StatusOK || rec.Body.String() != "converted book" {
+				t.Errorf("got %d %q, want the converted book", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	rec := cs.download(bookURL)
+	if rec.Body.String() != "converted book" {
+		t.Errorf("cached conversion: got %q", rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=book.mobi` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	if n := cs.converter.runs.Load(); n != 1 {
+		t.Errorf("converter ran %d times, want 1", n)
+	}
+	if n := cs.fetches.Load(); n != 1 {
+		t.Errorf("source fetched %d times, want 1", n)
+	}
+}
+
+func TestConversionRejected(t *testing.T) {
+	cs := newConversionServer(t)
+	tests := []struct {
+		name    string
+		url     string
+		want    int
+		fetched bool
+	}{
+		{"not linked by the feed", cs.upstream + "/other.epub", http.StatusNotFound, false},
+		{"elsewhere entirely", "http://example.com/book.epub", http.StatusNotFound, false},
+		{"too large", cs.upstream + "/big.epub", http.StatusBadGateway, true},
+		{"too large without length", cs.upstream + "/stream.epub", http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := cs.fetches.Load()
+			if rec := cs.download(tt.url); rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+			if fetched := cs.fetches.Load() > before; fetched != tt.fetched {
+				t.Errorf("fetched upstream = %v, want %v", fetched, tt.fetched)
+			}
+		})
+	}
+	if n := cs.converter.runs.Load(); n != 0 {
+		t.Errorf("converter ran %d times, want 0", n)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// fetchTimeout bounds an on-demand upstream fetch. Fetches run detached from
+// the requests waiting for them, so nothing else stops one that hangs.
+const fetchTimeout = 5 * time.Minute
+
+// flightGroup collapses concurrent calls for the same key into a single
+// call, so a burst of readers opening the same uncached feed costs one
+// request upstream, and one book is converted once however many readers
+// ask for it at the same time.
+type flightGroup[T any] struct {
+	timeout time.Duration // limit for each call; 0 = none
+
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	done   chan struct{}
+	result T
+	err    error
+}
+
+// do runs fn once for all concurrent callers with the same key and returns
+// its result to each of them. fn runs detached from the cancellation of the
+// caller that started it, so one client hanging up does not fail the others,
+// but it is cancelled after the group's timeout. A caller whose own context
+// is cancelled stops waiting and returns its context's error.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		c = &flightCall[T]{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			fctx := context.WithoutCancel(ctx)
+			if g.timeout > 0 {
+				var cancel context.CancelFunc
+				fctx, cancel = context.WithTimeout(fctx, g.timeout)
+				defer cancel()
+			}
+			c.result, c.err = fn(fctx)
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result, c.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
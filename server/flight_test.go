@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+func TestFlightShared(t *testing.T) {
+	var g flightGroup[int]
+	var runs atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		runs.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	var wg, calling sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		calling.Add(1)
+		go func() {
+			defer wg.Done()
+			calling.Done()
+			results[i], _ = g.do(t.Context(), "key", fn)
+		}()
+	}
+	calling.Wait()
+	time.Sleep(20 * time.Millisecond) // let every caller join the call
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want once", n)
+	}
+	for i, r := range results {
+		if r != 42 {
+			t.Errorf("caller %d got %d", i, r)
+		}
+	}
+	// Finished calls are forgotten.
+	if _, err := g.do(t.Context(), "key", fn); err != nil || runs.Load() != 2 {
+		t.Errorf("second call: err %v, %d runs; want a new run", err, runs.Load())
+	}
+}
+
+func TestFlightCallerCancelled(t *testing.T) {
+	var g flightGroup[string]
+	release := make(chan struct{})
+	fnErr := make(chan error, 2) // a slow second caller may start a call of its own
+	fn := func(ctx context.Context) (string, error) {
+		<-release
+		fnErr <- ctx.Err()
+		return "done", nil
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.do(ctx, "key", fn)
+		first <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	second := make(chan string, 1)
+	go func() {
+		v, _ := g.do(t.Context(), "key", fn)
+		second <- v
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The caller that started the call hangs up; the others still get the
+	// result, and fn is not cancelled.
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v", err)
+	}
+	close(release)
+	if v := <-second; v != "done" {
+		t.Errorf("other caller got %q", v)
+	}
+	if err := <-fnErr; err != nil {
+		t.Errorf("fn saw %v", err)
+	}
+}
+
+func TestFlightTimeout(t *testing.T) {
+	g := flightGroup[int]{timeout: 20 * time.Millisecond}
+	start := time.Now()
+	_, err := g.do(t.Context(), "key", func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the group's deadline", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("call took %v", d)
+	}
+}
+
+// TestLazyLoadPerNode checks that two nodes waiting for the same upstream
+// page each get it appended, instead of one sharing the other's fetch.
+func TestLazyLoadPerNode(t *testing.T) {
+	var requests atomic.Int32
+	gate := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-gate
+		w.Header().Set("Content-Type", opds.MediaTypeAtom)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>page2</id><title>Page 2</title>
+<entry><id>urn:2</id><title>Second</title></entry></feed>`)
+	}))
+	defer upstream.Close()
+
+	logger := slog.New(slog.DiscardHandler)
+	feedCfg := config.FeedConfig{Name: "Books", URL: upstream.URL + "/opds"}
+	cfg := &config.Config{Feeds: []config.FeedConfig{feedCfg}}
+	h := NewHandler(cfg, cache.NewFeedCache(logger, nil), crawler.New(nil, logger), nil, nil, nil, nil, nil, logger)
+
+	node := func() *crawler.FeedTree {
+		return &crawler.FeedTree{
+			URL:             feedCfg.URL + "/shared",
+			Feed:            &opds.Feed{Entries: []opds.Entry{{ID: "urn:1", Title: "First"}}},
+			Children:        make(map[string]*crawler.FeedTree),
+			HasMoreUpstream: true,
+			NextUpstreamURL: upstream.URL + "/page2",
+		}
+	}
+	nodes := []*crawler.FeedTree{node(), node()}
+	results := make([]*resolveFeedResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.resolveFeedWithLazyLoad(t.Context(), n, feedCfg, 0, 10)
+		}()
+		deadline := time.Now().Add(2 * time.Second)
+		for requests.Load() < int32(i+1) {
+			if time.Now().After(deadline) {
+				close(gate)
+				wg.Wait()
+				t.Fatalf("node %d shared another node's page fetch", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	close(gate)
+	wg.Wait()
+
+	for i, r := range results {
+		if r == nil || len(r.Feed.Entries) != 2 || r.HasMoreUpstream {
+			t.Errorf("node %d: %+v, want both pages", i, r)
+		}
+	}
+}
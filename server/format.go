@@ -0,0 +1,80 @@
+package server
+
+import (
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// feedFormat is the serialization used for an OPDS response.
+type feedFormat int
+
+const (
+	formatAtom  feedFormat = iota // OPDS 1.2 Atom XML
+	formatOPDS2                   // OPDS 2.0 JSON
+)
+
+// negotiateFormat picks the response format from the Accept header. OPDS 2.0
+// JSON is served only when the client ranks application/opds+json (or plain
+// application/json) strictly above Atom/XML; ties and wildcards keep Atom so
+// existing OPDS 1.2 readers are unaffected.
+func negotiateFormat(r *http.Request) feedFormat {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatAtom
+	}
+
+	best, bestQ := formatAtom, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+
+		var f feedFormat
+		switch mediaType {
+		case opds.MediaTypeOPDS2, "application/json":
+			f = formatOPDS2
+		case opds.MediaTypeAtom, "application/xml", "text/xml", "*/*":
+			f = formatAtom
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && f == formatAtom) {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// writeOPDS writes feed in the format negotiated with the client.
+// Requests under /web get an HTML page instead.
+func writeOPDS(w http.ResponseWriter, r *http.Request, feed *opds.Feed, logger *slog.Logger) {
+	if wc, ok := webFromContext(r.Context()); ok {
+		writeHTML(w, r, wc, feed, logger)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	if negotiateFormat(r) == formatOPDS2 {
+		w.Header().Set("Content-Type", opds.MediaTypeOPDS2+"; charset=utf-8")
+		if err := opds.RenderJSON(w, feed); err != nil {
+			logger.Error("failed to write OPDS 2.0 response", "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", opds.MediaTypeAtom+"; charset=utf-8")
+	if err := opds.Render(w, feed); err != nil {
+		logger.Error("failed to write OPDS response", "error", err)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   feedFormat
+	}{
+		{"", formatAtom},
+		{"*/*", formatAtom},
+		{"application/atom+xml", formatAtom},
+		{"application/opds+json", formatOPDS2},
+		{"application/json", formatOPDS2},
+		{"application/opds+json, application/atom+xml", formatAtom},
+		{"application/atom+xml, application/opds+json", formatAtom},
+		{"application/opds+json, */*;q=0.8", formatOPDS2},
+		{"application/atom+xml;q=0.5, application/opds+json;q=0.9", formatOPDS2},
+		{"application/opds+json;q=0.5, application/atom+xml;q=0.9", formatAtom},
+		{"text/html, image/png", formatAtom},
+		{"application/opds+json;q=bogus", formatOPDS2},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/opds", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := negotiateFormat(r); got != tt.want {
+			t.Errorf("negotiateFormat(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
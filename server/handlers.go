@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,30 +11,74 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/madeddie/opds-aggregator/blobcache"
 	"github.com/madeddie/opds-aggregator/cache"
 	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/convert"
 	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/dedup"
+	"github.com/madeddie/opds-aggregator/metrics"
 	"github.com/madeddie/opds-aggregator/opds"
+	"github.com/madeddie/opds-aggregator/poller"
 	"github.com/madeddie/opds-aggregator/search"
 )
 
 // Handler holds all dependencies for the HTTP handlers.
 type Handler struct {
-	cfg       *config.Config
 	feedCache *cache.FeedCache
 	crawler   *crawler.Crawler
 	searcher  *search.Searcher
 	logger    *slog.Logger
 
+	// poller schedules feed refreshes; nil disables the refresh endpoints.
+	poller *poller.Poller
+
+	// downloads caches proxied downloads for feeds that opt in; nil disables it.
+	downloads *blobcache.Cache
+
+	// converter derives other ebook formats from downloads; nil disables it.
+	converter convert.Converter
+
+	// state holds everything derived from the configuration. Reload swaps it.
+	state atomic.Pointer[handlerState]
+
+	// fetches collapses concurrent on-demand fetches of the same feed.
+	fetches flightGroup[*crawler.FeedTree]
+
+	// conversions caches converted downloads; it is the download cache, or a
+	// temporary one when that is disabled. nil disables caching them.
+	conversions *blobcache.Cache
+
+	// converts collapses concurrent conversions of the same book.
+	converts flightGroup[struct{}]
+
+	// links records which download URLs each source links to.
+	links feedLinks
+}
+
+// handlerState is the part of a Handler derived from the configuration. It
+// is replaced as a whole on reload, so each lookup sees either the old or
+// the new configuration, never a mix of both.
+type handlerState struct {
+	cfg *config.Config
+
 	// feedMap maps slug → FeedConfig for quick lookup.
 	feedMap map[string]config.FeedConfig
 
-	// RefreshFunc is called to trigger a feed refresh. Set by the poller.
-	RefreshFunc func(ctx context.Context, slug string) error
+	// accounts maps username → account for Basic Auth.
+	accounts map[string]config.UserConfig
+
+	convertFrom []convert.Format
+	convertTo   []convert.Format
+
+	// books memoizes the merged views.
+	books mergedBooksCache
 }
 
 // NewHandler creates a new Handler.
@@ -41,23 +87,109 @@ func NewHandler(
 	feedCache *cache.FeedCache,
 	crawl *crawler.Crawler,
 	searcher *search.Searcher,
+	poll *poller.Poller,
+	downloads *blobcache.Cache,
+	converter convert.Converter,
+	conversions *blobcache.Cache,
 	logger *slog.Logger,
 ) *Handler {
-	fm := make(map[string]config.FeedConfig, len(cfg.Feeds))
+	h := &Handler{
+		feedCache:   feedCache,
+		crawler:     crawl,
+		searcher:    searcher,
+		poller:      poll,
+		downloads:   downloads,
+		converter:   converter,
+		conversions: conversions,
+		logger:      logger,
+	}
+	// A shared conversion fetches the book and then runs the converter,
+	// which has its own timeout; conversion.timeout is read at startup only.
+	h.fetches.timeout = fetchTimeout
+	h.converts.timeout = fetchTimeout
+	if timeout, err := cfg.Conversion.ParsedTimeout(); err == nil {
+		h.converts.timeout += timeout
+	}
+	h.Reload(cfg)
+	return h
+}
+
+// Reload replaces the configuration the handlers serve and applies its
+// memory budget to the feed cache. Requests already in flight finish with
+// the configuration they started with.
+func (h *Handler) Reload(cfg *config.Config) {
+	st := &handlerState{
+		cfg:      cfg,
+		feedMap:  make(map[string]config.FeedConfig, len(cfg.Feeds)),
+		accounts: make(map[string]config.UserConfig),
+	}
 	for _, f := range cfg.Feeds {
-		fm[f.Slug()] = f
+		st.feedMap[f.Slug()] = f
+	}
+	for _, u := range cfg.Accounts() {
+		st.accounts[u.Username] = u
+	}
+	if h.converter != nil {
+		st.convertFrom = lookupFormats(cfg.Conversion.From)
+		st.convertTo = lookupFormats(cfg.Conversion.To)
+	}
+	h.state.Store(st)
+	h.feedCache.SetMemoryBudget(int64(cfg.Cache.MemoryMaxMB)<<20, cfg.Cache.EvictCrawled)
+}
+
+// current returns the configuration-derived state in effect.
+func (h *Handler) current() *handlerState {
+	return h.state.Load()
+}
+
+// Accounts returns the accounts currently allowed to use the aggregator,
+// keyed by username.
+func (h *Handler) Accounts() map[string]config.UserConfig {
+	return h.current().accounts
+}
+
+// lookupFeed returns the configured feed with the given slug, provided the
+// requesting user is allowed to see it.
+func (h *Handler) lookupFeed(r *http.Request, slug string) (config.FeedConfig, bool) {
+	fc, ok := h.current().feedMap[slug]
+	if !ok {
+		return config.FeedConfig{}, false
+	}
+	if u, ok := UserFromContext(r.Context()); ok && !u.AllowsFeed(slug) {
+		return config.FeedConfig{}, false
+	}
+	return fc, true
+}
+
+// rewriteOptions returns the link rewriting choices for the requesting client.
+func (h *Handler) rewriteOptions(r *http.Request) rewriteOptions {
+	st := h.current()
+	return rewriteOptions{
+		thumb:       h.thumbnailProfile(r),
+		convertFrom: st.convertFrom,
+		convertTo:   st.convertTo,
 	}
-	return &Handler{
-		cfg:       cfg,
-		feedCache: feedCache,
-		crawler:   crawl,
-		searcher:  searcher,
-		logger:    logger,
-		feedMap:   fm,
+}
+
+// visibleFeeds returns the configured feeds the requesting user may see,
+// in configuration order.
+func (h *Handler) visibleFeeds(r *http.Request) []config.FeedConfig {
+	cfg := h.current().cfg
+	u, ok := UserFromContext(r.Context())
+	if !ok || len(u.Feeds) == 0 {
+		return cfg.Feeds
+	}
+	var feeds []config.FeedConfig
+	for _, fc := range cfg.Feeds {
+		if u.AllowsFeed(fc.Slug()) {
+			feeds = append(feeds, fc)
+		}
 	}
+	return feeds
 }
 
-// HandleRoot serves the aggregator's navigation root — one entry per source feed.
+// HandleRoot serves the aggregator's navigation root — one entry per source feed,
+// followed by the merged cross-source views.
 func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug("HandleRoot request",
 		"method", r.Method,
@@ -65,10 +197,11 @@ func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		"remoteAddr", r.RemoteAddr,
 		"userAgent", r.UserAgent(),
 	)
+	cfg := h.current().cfg
 	now := time.Now().UTC().Format(time.RFC3339)
 	feed := &opds.Feed{
 		ID:      "urn:opds-aggregator:root",
-		Title:   h.cfg.Server.Title,
+		Title:   cfg.Server.Title,
 		Updated: now,
 		Links: []opds.Link{
 			{Rel: opds.RelSelf, Href: "/opds", Type: opds.MediaTypeAtom},
@@ -83,16 +216,23 @@ func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		Type: opds.MediaTypeAtom,
 	})
 
-	for _, fc := range h.cfg.Feeds {
+	for _, fc := range h.visibleFeeds(r) {
 		slug := fc.Slug()
 		updated := now
-		if cached, ok := h.feedCache.Get(slug); ok {
+		cached, hasCached := h.feedCache.Get(slug)
+		if hasCached {
 			updated = cached.UpdatedAt.UTC().Format(time.RFC3339)
 		}
+		refresh := h.refreshStatus(slug)
+		if cfg.Server.HideDownSources && !hasCached && refresh.LastError != "" {
+			h.logger.Debug("hiding down source", "slug", slug)
+			continue
+		}
 		entry := opds.Entry{
 			ID:      "urn:opds-aggregator:source:" + slug,
 			Title:   fc.Name,
 			Updated: updated,
+			Summary: &opds.Text{Type: "text", Body: healthSummary(cached, refresh)},
 			Content: &opds.Text{Type: "text", Body: fc.URL},
 			Links: []opds.Link{
 				{
@@ -105,13 +245,16 @@ func (h *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
 		feed.Entries = append(feed.Entries, entry)
 	}
 
-	writeOPDS(w, feed, h.logger)
+	// Cross-source views built from the cached trees.
+	feed.Entries = append(feed.Entries, mergedViewEntries(now)...)
+
+	writeOPDS(w, r, feed, h.logger)
 }
 
 // HandleSource serves a cached or on-demand upstream feed with rewritten links.
 func (h *Handler) HandleSource(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
-	feedCfg, ok := h.feedMap[slug]
+	feedCfg, ok := h.lookupFeed(r, slug)
 	if !ok {
 		http.Error(w, "unknown source", http.StatusNotFound)
 		return
@@ -125,14 +268,25 @@ func (h *Handler) HandleSource(w http.ResponseWriter, r *http.Request) {
 	cached, hasCached := h.feedCache.Get(slug)
 	if !hasCached {
 		// No cache yet — try on-demand fetch.
-		h.logger.Info("on-demand fetch", "slug", slug)
-		tree, err := h.crawler.Crawl(r.Context(), feedCfg)
+		metrics.FeedCacheLookups.WithLabelValues(slug, "miss").Inc()
+		tree, err := h.fetches.do(r.Context(), "source:"+slug, func(ctx context.Context) (*crawler.FeedTree, error) {
+			if cached, ok := h.feedCache.Get(slug); ok {
+				return cached.Tree, nil
+			}
+			h.logger.Info("on-demand fetch", "slug", slug)
+			metrics.OnDemandFetches.WithLabelValues(slug, "on_demand").Inc()
+			tree, err := h.crawler.Crawl(ctx, feedCfg)
+			if err != nil {
+				return nil, err
+			}
+			h.feedCache.Put(slug, tree)
+			return tree, nil
+		})
 		if err != nil {
 			h.logger.Error("on-demand crawl failed", "slug", slug, "error", err)
 			http.Error(w, "failed to fetch upstream feed", http.StatusBadGateway)
 			return
 		}
-		h.feedCache.Put(slug, tree)
 		cached = &cache.CachedFeed{Tree: tree, UpdatedAt: time.Now()}
 	}
 
@@ -174,14 +328,25 @@ func (h *Handler) HandleSource(w http.ResponseWriter, r *http.Request) {
 		baseURL = joinURL(cached.Tree.URL, subPath, "")
 	}
 
-	rewritten := rewriteFeedLinks(feed, slug, baseURL, cached.Tree.URL, "")
-	writeOPDS(w, rewritten, h.logger)
+	rewritten := rewriteFeedLinks(feed, slug, baseURL, cached.Tree.URL, "", h.rewriteOptions(r))
+	fetched := result.FetchedAt
+	if fetched.IsZero() {
+		fetched = cached.UpdatedAt
+	}
+	if refresh := h.refreshStatus(slug); isStale(refresh, fetched) {
+		// The latest refresh failed: serve the cached tree, but say so.
+		notice := staleNotice(feedCfg, cached, refresh)
+		rewritten.Entries = append([]opds.Entry{notice}, rewritten.Entries...)
+	}
+	writeOPDS(w, r, rewritten, h.logger)
 }
 
 // HandleDownload proxies a download request, optionally caching it.
+// Feeds with cache_downloads set are served from the download cache once
+// a copy has been stored.
 func (h *Handler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
-	feedCfg, ok := h.feedMap[slug]
+	feedCfg, ok := h.lookupFeed(r, slug)
 	if !ok {
 		http.Error(w, "unknown source", http.StatusNotFound)
 		return
@@ -200,23 +365,203 @@ func (h *Handler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch from upstream.
-	body, contentType, contentLength, err := h.crawler.FetchRaw(r.Context(), dlURL, feedCfg.Auth)
+	r = r.WithContext(crawler.WithSource(r.Context(), slug))
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() { metrics.DownloadBytes.WithLabelValues(slug).Add(float64(cw.n)) }()
+	w = cw
+
+	if name := r.URL.Query().Get("thumb"); name != "" {
+		profile, ok := h.current().cfg.Thumbnails.Profile(name)
+		if !ok {
+			http.Error(w, "unknown thumbnail profile", http.StatusBadRequest)
+			return
+		}
+		h.serveThumbnail(w, r, feedCfg, dlURL, profile)
+		return
+	}
+
+	if name := r.URL.Query().Get("convert"); name != "" {
+		format, ok := h.conversionTarget(name)
+		if !ok {
+			http.Error(w, "conversion not available", http.StatusNotFound)
+			return
+		}
+		h.serveConverted(w, r, feedCfg, dlURL, format)
+		return
+	}
+
+	caching := h.downloads != nil && feedCfg.CacheDownloads != "" && h.linkedFrom(slug, dlURL)
+	if caching {
+		if f, entry, ok := h.downloads.Open(slug, dlURL); ok {
+			defer f.Close()
+			h.logger.Debug("download served from cache", "url", dlURL, "size", entry.Size)
+			serveCachedDownload(w, r, f, entry)
+			return
+		}
+	}
+
+	// Fetch from upstream, forwarding Range/If-Range so resumed downloads
+	// only transfer the missing bytes.
+	resp, err := h.crawler.FetchRaw(r.Context(), r.Method, dlURL, feedCfg.Auth, r.Header)
 	if err != nil {
 		h.logger.Error("download fetch failed", "url", dlURL, "error", err)
 		http.Error(w, "failed to fetch download", http.StatusBadGateway)
 		return
 	}
-	defer body.Close()
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	copyHeaders(w.Header(), resp.Header, downloadHeaders)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Only complete bodies are cached; partial responses are streamed through.
+	if !caching || resp.StatusCode != http.StatusOK || !shouldCacheDownload(feedCfg, contentType) {
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	// Store a copy while streaming to the client.
+	cached := make(http.Header)
+	copyHeaders(cached, resp.Header, cachedDownloadHeaders)
+	blob, err := h.downloads.Create(slug, dlURL, contentType, cached)
+	if err != nil {
+		h.logger.Warn("download cache unavailable", "error", err)
+		io.Copy(w, resp.Body)
+		return
+	}
+	if _, err := io.Copy(io.MultiWriter(w, blob), resp.Body); err != nil {
+		blob.Abort()
+		return
+	}
+	if err := blob.Commit(); err != nil {
+		h.logger.Warn("failed to cache download", "url", dlURL, "error", err)
+	}
+}
+
+// countingWriter counts the body bytes written to a response.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// downloadHeaders are the upstream response headers passed through to clients.
+var downloadHeaders = []string{
+	"Content-Type", "Content-Range", "Accept-Ranges",
+	"ETag", "Last-Modified", "Content-Disposition",
+}
+
+// cachedDownloadHeaders are the upstream headers stored with cached downloads.
+var cachedDownloadHeaders = []string{"ETag", "Last-Modified", "Content-Disposition"}
+
+func copyHeaders(dst, src http.Header, names []string) {
+	for _, name := range names {
+		if v := src.Get(name); v != "" {
+			dst.Set(name, v)
+		}
+	}
+}
+
+// storeFile copies f into the blob cache c under key for source slug.
+func storeFile(c *blobcache.Cache, slug, key, contentType string, header http.Header, f io.Reader) error {
+	cw, err := c.Create(slug, key, contentType, header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, f); err != nil {
+		cw.Abort()
+		return err
+	}
+	return cw.Commit()
+}
+
+// feedLinks memoizes the download and image URLs that each source's cached
+// tree links to, until the feed cache changes.
+type feedLinks struct {
+	mu     sync.Mutex
+	gen    uint64
+	bySlug map[string]map[string]bool
+}
+
+// linkedFrom reports whether the cached tree of source slug links to rawURL
+// as a download or image. Only such URLs are served from or stored in the
+// download cache, so the download endpoint of a source a user may see
+// cannot be used to read files cached for another source.
+func (h *Handler) linkedFrom(slug, rawURL string) bool {
+	cached, ok := h.feedCache.Get(slug)
+	if !ok || cached.Tree == nil {
+		return false
+	}
+
+	gen := h.feedCache.Generation()
+	l := &h.links
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bySlug == nil || l.gen != gen {
+		l.gen = gen
+		l.bySlug = make(map[string]map[string]bool)
+	}
+	urls, ok := l.bySlug[slug]
+	if !ok {
+		urls = make(map[string]bool)
+		add := func(base string, links []opds.Link) {
+			for _, link := range links {
+				if (isAcquisitionRel(link.Rel) || opds.IsImageRel(link.Rel)) && !isAggregatorPath(link.Href) {
+					urls[resolveURL(base, link.Href)] = true
+				}
+			}
+		}
+		cached.Tree.Walk(func(node *crawler.FeedTree, feed *opds.Feed) {
+			if feed == nil {
+				return
+			}
+			add(node.URL, feed.Links)
+			for _, e := range feed.Entries {
+				add(node.URL, e.Links)
+			}
+		})
+		l.bySlug[slug] = urls
+	}
+	return urls[rawURL]
+}
 
-	if contentType != "" {
-		w.Header().Set("Content-Type", contentType)
+// serveCachedDownload serves a download from the cache. http.ServeContent
+// takes care of HEAD, Range, If-Range and the 206/416 responses; the stored
+// upstream ETag (or the content hash) validates If-Range.
+func serveCachedDownload(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, entry blobcache.Entry) {
+	copyHeaders(w.Header(), entry.Header, cachedDownloadHeaders)
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", `"`+entry.Hash+`"`)
 	}
-	if contentLength > 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
+	if entry.ContentType != "" {
+		w.Header().Set("Content-Type", entry.ContentType)
 	}
+	modTime, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	w.Header().Del("Last-Modified") // ServeContent sets it from modTime
+	http.ServeContent(w, r, "", modTime, f)
+}
 
-	io.Copy(w, body)
+// shouldCacheDownload reports whether a response with the given content type
+// may be stored under the feed's cache_downloads mode.
+func shouldCacheDownload(feedCfg config.FeedConfig, contentType string) bool {
+	switch feedCfg.CacheDownloads {
+	case config.CacheDownloadsAll:
+		return true
+	case config.CacheDownloadsImages:
+		return strings.HasPrefix(contentType, "image/")
+	}
+	return false
 }
 
 // HandleSearch handles search queries across all or a specific source.
@@ -232,14 +577,34 @@ func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, err := h.searcher.Search(r.Context(), query)
+	var slugs []string
+	for _, fc := range h.visibleFeeds(r) {
+		slugs = append(slugs, fc.Slug())
+	}
+	results, err := h.searcher.Search(r.Context(), query, slugs)
 	if err != nil {
 		h.logger.Error("search failed", "query", query, "error", err)
 		http.Error(w, "search failed", http.StatusBadGateway)
 		return
 	}
 
-	writeOPDS(w, results, h.logger)
+	// Results are tagged with their source; rewrite each entry's links for
+	// that source, then collapse the same book found in several sources.
+	opts := h.rewriteOptions(r)
+	items := make([]dedup.Item, 0, len(results.Entries))
+	for _, e := range results.Entries {
+		slug := entrySource(e)
+		fc, ok := h.lookupFeed(r, slug)
+		if !ok {
+			continue
+		}
+		e.Links = rewriteEntryLinks(e.Links, slug, fc.URL, fc.URL, "", opts)
+		items = append(items, dedup.Item{Source: fc.Name, Entry: e})
+	}
+	out := *results
+	out.Entries = dedup.Merge(items)
+
+	writeOPDS(w, r, &out, h.logger)
 }
 
 // HandleSourceSearch handles search within a specific source.
@@ -249,7 +614,7 @@ func (h *Handler) HandleSearch(w http.ResponseWriter, r *http.Request) {
 // search link to discover search capabilities.
 func (h *Handler) HandleSourceSearch(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
-	feedCfg, ok := h.feedMap[slug]
+	feedCfg, ok := h.lookupFeed(r, slug)
 	if !ok {
 		http.Error(w, "unknown source", http.StatusNotFound)
 		return
@@ -289,45 +654,72 @@ func (h *Handler) HandleSourceSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rewritten := rewriteFeedLinks(results, slug, feedCfg.URL, feedCfg.URL, "")
-	writeOPDS(w, rewritten, h.logger)
+	rewritten := rewriteFeedLinks(results, slug, feedCfg.URL, feedCfg.URL, "", h.rewriteOptions(r))
+	writeOPDS(w, r, rewritten, h.logger)
 }
 
-// HandleRefresh triggers a manual re-poll of all or a specific source.
+// HandleRefresh queues a manual re-poll of a specific source and returns its job status.
 func (h *Handler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
-	if h.RefreshFunc == nil {
+	if h.poller == nil {
 		http.Error(w, "refresh not available", http.StatusNotImplemented)
 		return
 	}
-	if err := h.RefreshFunc(r.Context(), slug); err != nil {
-		h.logger.Error("refresh failed", "slug", slug, "error", err)
-		http.Error(w, "refresh failed: "+err.Error(), http.StatusInternalServerError)
+	if _, ok := h.lookupFeed(r, slug); !ok {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	status, err := h.poller.Trigger(slug)
+	if errors.Is(err, poller.ErrUnknownFeed) {
+		http.Error(w, "unknown source", http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	writeJSON(w, http.StatusAccepted, status, h.logger)
 }
 
-// HandleRefreshAll triggers a manual re-poll of all sources.
+// HandleRefreshAll queues a manual re-poll of all sources.
 func (h *Handler) HandleRefreshAll(w http.ResponseWriter, r *http.Request) {
-	if h.RefreshFunc == nil {
+	if h.poller == nil {
+		http.Error(w, "refresh not available", http.StatusNotImplemented)
+		return
+	}
+	if u, ok := UserFromContext(r.Context()); ok && len(u.Feeds) > 0 {
+		statuses := []poller.Status{}
+		for _, fc := range h.visibleFeeds(r) {
+			if status, err := h.poller.Trigger(fc.Slug()); err == nil {
+				statuses = append(statuses, status)
+			}
+		}
+		writeJSON(w, http.StatusAccepted, statuses, h.logger)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, h.poller.TriggerAll(), h.logger)
+}
+
+// HandleRefreshStatus reports the status of the most recent refresh job for a source.
+func (h *Handler) HandleRefreshStatus(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+	if h.poller == nil {
 		http.Error(w, "refresh not available", http.StatusNotImplemented)
 		return
 	}
-	if err := h.RefreshFunc(r.Context(), ""); err != nil {
-		h.logger.Error("refresh all failed", "error", err)
-		http.Error(w, "refresh failed: "+err.Error(), http.StatusInternalServerError)
+	if _, ok := h.lookupFeed(r, slug); !ok {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	status, err := h.poller.Status(slug)
+	if errors.Is(err, poller.ErrUnknownFeed) {
+		http.Error(w, "unknown source", http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	writeJSON(w, http.StatusOK, status, h.logger)
 }
 
 // resolveFeedResult contains the feed and pagination metadata.
 type resolveFeedResult struct {
 	Feed            *opds.Feed
 	HasMoreUpstream bool
+	FetchedAt       time.Time // when the feed was fetched on demand; zero if it was crawled
 }
 
 // resolveFeed finds the right feed to serve from the cached tree, given the sub-path.
@@ -341,8 +733,11 @@ func (h *Handler) resolveFeed(ctx context.Context, tree *crawler.FeedTree, feedC
 	// not upstream fetching.
 	cleanQuery := stripPaginationParams(rawQuery)
 
+	slug := feedCfg.Slug()
+
 	// Root of this source.
 	if subPath == "" && cleanQuery == "" {
+		metrics.FeedCacheLookups.WithLabelValues(slug, "hit").Inc()
 		return h.resolveFeedWithLazyLoad(ctx, tree, feedCfg, offset, limit)
 	}
 
@@ -353,7 +748,10 @@ func (h *Handler) resolveFeed(ctx context.Context, tree *crawler.FeedTree, feedC
 	}
 
 	// Check if we have this child in the cached tree.
-	if child, ok := tree.Children[cacheKey]; ok {
+	if child, ok := tree.Child(cacheKey); ok {
+		metrics.FeedCacheLookups.WithLabelValues(slug, "hit").Inc()
+		h.feedCache.Touch(child)
+		h.revalidateChild(ctx, tree, feedCfg, cacheKey, child)
 		return h.resolveFeedWithLazyLoad(ctx, child, feedCfg, offset, limit)
 	}
 
@@ -363,23 +761,18 @@ func (h *Handler) resolveFeed(ctx context.Context, tree *crawler.FeedTree, feedC
 		if qv, err := url.ParseQuery(cleanQuery); err == nil {
 			if extURL := qv.Get("url"); extURL != "" {
 				cacheKey = "ext?url=" + url.QueryEscape(extURL)
-				if child, ok := tree.Children[cacheKey]; ok {
+				if child, ok := tree.Child(cacheKey); ok {
+					metrics.FeedCacheLookups.WithLabelValues(slug, "hit").Inc()
+					h.feedCache.Touch(child)
+					h.revalidateChild(ctx, tree, feedCfg, cacheKey, child)
 					return h.resolveFeedWithLazyLoad(ctx, child, feedCfg, offset, limit)
 				}
-				h.logger.Info("on-demand ext fetch", "url", extURL)
-				feed, hasMore, nextURL, err := h.fetchWithPaginationLimit(ctx, extURL, feedCfg)
+				metrics.FeedCacheLookups.WithLabelValues(slug, "miss").Inc()
+				child, err := h.fetchChild(ctx, tree, feedCfg, cacheKey, extURL, "external")
 				if err != nil {
 					h.logger.Error("on-demand ext fetch failed", "url", extURL, "error", err)
 					return nil
 				}
-				child := &crawler.FeedTree{
-					Feed:            feed,
-					URL:             extURL,
-					Children:        make(map[string]*crawler.FeedTree),
-					HasMoreUpstream: hasMore,
-					NextUpstreamURL: nextURL,
-				}
-				tree.Children[cacheKey] = child
 				return h.resolveFeedWithLazyLoad(ctx, child, feedCfg, offset, limit)
 			}
 		}
@@ -387,71 +780,142 @@ func (h *Handler) resolveFeed(ctx context.Context, tree *crawler.FeedTree, feedC
 
 	// Not in cache — fetch on demand from upstream.
 	upstreamURL := joinURL(tree.URL, subPath, cleanQuery)
-	h.logger.Info("on-demand sub-feed fetch", "url", upstreamURL)
-
-	feed, hasMore, nextURL, err := h.fetchWithPaginationLimit(ctx, upstreamURL, feedCfg)
+	metrics.FeedCacheLookups.WithLabelValues(slug, "miss").Inc()
+	child, err := h.fetchChild(ctx, tree, feedCfg, cacheKey, upstreamURL, "on_demand")
 	if err != nil {
 		h.logger.Error("on-demand fetch failed", "url", upstreamURL, "error", err)
 		return nil
 	}
+	return h.resolveFeedWithLazyLoad(ctx, child, feedCfg, offset, limit)
+}
+
+// fetchChild fetches an uncached sub-feed from feedURL and caches it in tree
+// under key. Concurrent requests for the same node share one upstream fetch;
+// kind is the OnDemandFetches label for it.
+func (h *Handler) fetchChild(ctx context.Context, tree *crawler.FeedTree, feedCfg config.FeedConfig, key, feedURL, kind string) (*crawler.FeedTree, error) {
+	slug := feedCfg.Slug()
+	return h.fetches.do(ctx, "feed:"+slug+"/"+key, func(ctx context.Context) (*crawler.FeedTree, error) {
+		if child, ok := tree.Child(key); ok {
+			return child, nil
+		}
+		h.logger.Info("on-demand sub-feed fetch", "slug", slug, "url", feedURL)
+		metrics.OnDemandFetches.WithLabelValues(slug, kind).Inc()
+		child, err := h.fetchNode(ctx, feedURL, feedCfg)
+		if err != nil {
+			return nil, err
+		}
+		return h.feedCache.AddChild(slug, tree, key, child), nil
+	})
+}
+
+// revalidateChild refreshes a sub-feed fetched on demand in the background
+// once it is older than the feed's child_ttl. The caller keeps serving the
+// cached copy; later requests get the refreshed one. If the refresh fails
+// the stale copy stays, and the next request tries again.
+func (h *Handler) revalidateChild(ctx context.Context, tree *crawler.FeedTree, feedCfg config.FeedConfig, key string, child *crawler.FeedTree) {
+	ttl, _ := feedCfg.ParsedChildTTL()
+	if !child.Stale(ttl) {
+		return
+	}
+	slug := feedCfg.Slug()
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		_, err := h.fetches.do(ctx, "revalidate:"+slug+"/"+key, func(ctx context.Context) (*crawler.FeedTree, error) {
+			if current, ok := tree.Child(key); !ok || current != child {
+				return current, nil // already refreshed, evicted or replaced by a crawl
+			}
+			h.logger.Info("revalidating stale sub-feed", "slug", slug, "url", child.URL, "age", time.Since(child.FetchedAt).Round(time.Second))
+			metrics.OnDemandFetches.WithLabelValues(slug, "revalidate").Inc()
+			fresh, err := h.fetchNode(ctx, child.URL, feedCfg)
+			if err != nil {
+				return nil, err
+			}
+			h.feedCache.ReplaceChild(slug, tree, key, child, fresh)
+			return fresh, nil
+		})
+		if err != nil {
+			h.logger.Warn("stale sub-feed refresh failed, serving cached copy", "slug", slug, "url", child.URL, "error", err)
+		}
+	}()
+}
 
-	// Cache the result for future requests.
-	child := &crawler.FeedTree{
+// fetchNode fetches a sub-feed on demand into a new tree node.
+func (h *Handler) fetchNode(ctx context.Context, feedURL string, feedCfg config.FeedConfig) (*crawler.FeedTree, error) {
+	feed, hasMore, nextURL, err := h.fetchWithPaginationLimit(ctx, feedURL, feedCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &crawler.FeedTree{
 		Feed:            feed,
-		URL:             upstreamURL,
+		URL:             feedURL,
 		Children:        make(map[string]*crawler.FeedTree),
 		HasMoreUpstream: hasMore,
 		NextUpstreamURL: nextURL,
-	}
-	tree.Children[cacheKey] = child
-
-	return h.resolveFeedWithLazyLoad(ctx, child, feedCfg, offset, limit)
+		FetchedAt:       time.Now(),
+	}, nil
 }
 
 // resolveFeedWithLazyLoad returns the feed from the tree, fetching additional
 // upstream pages if the requested offset exceeds the cached entries.
+// Concurrent requests needing the same page share one upstream fetch.
 func (h *Handler) resolveFeedWithLazyLoad(ctx context.Context, tree *crawler.FeedTree, feedCfg config.FeedConfig, offset, limit int) *resolveFeedResult {
-	if tree.Feed == nil {
+	feed, hasMore, nextURL := tree.Snapshot()
+	if feed == nil {
 		return nil
 	}
 
 	// Check if we need to fetch more entries from upstream.
 	// We need more if the requested range extends beyond cached entries
 	// and there are more pages available.
-	for tree.HasMoreUpstream && offset+limit > len(tree.Feed.Entries) {
-		h.logger.Info("lazy-loading next upstream page",
-			"nextURL", tree.NextUpstreamURL,
-			"cachedEntries", len(tree.Feed.Entries),
-			"requestedOffset", offset,
-			"requestedLimit", limit)
-
-		feed, hasMore, nextURL, err := h.fetchWithPaginationLimit(ctx, tree.NextUpstreamURL, feedCfg)
+	slug := feedCfg.Slug()
+	for hasMore && offset+limit > len(feed.Entries) {
+		pageURL := nextURL
+		// The same upstream page can be pending for several nodes (a sub-feed
+		// linked from two parents), and each needs it appended.
+		_, err := h.fetches.do(ctx, fmt.Sprintf("page:%s %p %s", slug, tree, pageURL), func(ctx context.Context) (*crawler.FeedTree, error) {
+			h.logger.Info("lazy-loading next upstream page",
+				"nextURL", pageURL,
+				"cachedEntries", len(feed.Entries),
+				"requestedOffset", offset,
+				"requestedLimit", limit)
+			metrics.OnDemandFetches.WithLabelValues(slug, "lazy_load").Inc()
+
+			page, more, next, err := h.fetchWithPaginationLimit(ctx, pageURL, feedCfg)
+			if err != nil {
+				return nil, err
+			}
+			// Another request may have loaded this page in the meantime;
+			// AppendPage then leaves the node as it is.
+			if h.feedCache.AppendPage(tree, pageURL, page, more, next) {
+				h.logger.Info("lazy-load complete",
+					"newEntries", len(page.Entries),
+					"hasMore", more)
+			}
+			return tree, nil
+		})
 		if err != nil {
-			h.logger.Error("lazy-load fetch failed", "url", tree.NextUpstreamURL, "error", err)
+			h.logger.Error("lazy-load fetch failed", "url", pageURL, "error", err)
 			// Return what we have — better than nothing.
 			break
 		}
 
-		// Append new entries to existing feed.
-		tree.Feed.Entries = append(tree.Feed.Entries, feed.Entries...)
-		tree.HasMoreUpstream = hasMore
-		tree.NextUpstreamURL = nextURL
-
-		h.logger.Info("lazy-load complete",
-			"newEntries", len(feed.Entries),
-			"totalCached", len(tree.Feed.Entries),
-			"hasMore", hasMore)
+		feed, hasMore, nextURL = tree.Snapshot()
+		if hasMore && nextURL == pageURL {
+			break // the page could not be appended; don't fetch it again
+		}
 	}
 
 	return &resolveFeedResult{
-		Feed:            tree.Feed,
-		HasMoreUpstream: tree.HasMoreUpstream,
+		Feed:            feed,
+		HasMoreUpstream: hasMore,
+		FetchedAt:       tree.FetchedAt,
 	}
 }
 
 // fetchWithPaginationLimit fetches a feed using the feed's max_paginate setting.
 // Returns the feed, whether more upstream pages exist, and the URL for the next page.
 func (h *Handler) fetchWithPaginationLimit(ctx context.Context, feedURL string, feedCfg config.FeedConfig) (*opds.Feed, bool, string, error) {
+	ctx = crawler.WithSource(ctx, feedCfg.Slug())
 	maxPages := feedCfg.MaxPaginate
 	if maxPages == 0 {
 		// No limit configured — fetch all pages.
@@ -481,7 +945,7 @@ func (h *Handler) getMaxEntries(feedCfg config.FeedConfig) int {
 	if feedCfg.MaxEntries > 0 {
 		return feedCfg.MaxEntries
 	}
-	return h.cfg.Server.DefaultMaxEntries
+	return h.current().cfg.Server.DefaultMaxEntries
 }
 
 // parsePaginationParams extracts offset and limit from query params.
@@ -621,10 +1085,12 @@ func buildPaginationURL(basePath, rawQuery string, offset, limit int) string {
 	return basePath
 }
 
-func writeOPDS(w http.ResponseWriter, feed *opds.Feed, logger *slog.Logger) {
-	w.Header().Set("Content-Type", opds.MediaTypeAtom+"; charset=utf-8")
-	if err := opds.Render(w, feed); err != nil {
-		logger.Error("failed to write OPDS response", "error", err)
+func writeJSON(w http.ResponseWriter, status int, v any, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Error("failed to write JSON response", "error", err)
 	}
 }
-
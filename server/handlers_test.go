@@ -0,0 +1,88 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/blobcache"
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+func TestDownloadCacheScopedToSource(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/epub+zip")
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	private := upstream.URL + "/private/book.epub"
+
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{
+		Feeds: []config.FeedConfig{
+			{Name: "Private", URL: upstream.URL + "/private", CacheDownloads: config.CacheDownloadsAll},
+			{Name: "Public", URL: upstream.URL + "/public", CacheDownloads: config.CacheDownloadsAll},
+		},
+		Users: []config.UserConfig{
+			{Username: "owner", Password: "secret"},
+			{Username: "guest", Password: "secret", Feeds: []string{"public"}},
+		},
+	}
+	fc := cache.NewFeedCache(logger, nil)
+	for _, f := range cfg.Feeds {
+		fc.Put(f.Slug(), &crawler.FeedTree{
+			Feed: &opds.Feed{Entries: []opds.Entry{{
+				ID:    f.Slug(),
+				Links: []opds.Link{{Rel: opds.RelAcquisition, Href: f.URL + "/book.epub", Type: "application/epub+zip"}},
+			}}},
+			URL:      f.URL,
+			Children: make(map[string]*crawler.FeedTree),
+		})
+	}
+	downloads, err := blobcache.New(t.TempDir(), 1<<20, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := downloads.Create("private", private, "application/epub+zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Write([]byte("cached private book"))
+	if err := blob.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(cfg, fc, crawler.New(nil, logger), nil, nil, downloads, nil, nil, logger)
+	srv := New(cfg, h, nil, logger).Handler
+
+	tests := []struct {
+		user, slug string
+		want       string
+	}{
+		{"owner", "private", "cached private book"},
+		{"guest", "private", "unknown source"},
+		{"guest", "public", "upstream /private/book.epub"},
+		{"owner", "public", "upstream /private/book.epub"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/opds/download/"+tt.slug+"?url="+url.QueryEscape(private), nil)
+		r.SetBasicAuth(tt.user, "secret")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, r)
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("%s downloading via %s: got %q, want %q", tt.user, tt.slug, got, tt.want)
+		}
+	}
+
+	// The public feed does not link to the private URL, so nothing was
+	// cached for it either.
+	if _, _, ok := downloads.Open("public", private); ok {
+		t.Error("download of a URL the feed does not link to was cached")
+	}
+}
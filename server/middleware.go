@@ -1,10 +1,13 @@
 package server
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/sha256"
 	"log/slog"
 	"net/http"
+	"sync"
 
+	"github.com/madeddie/opds-aggregator/auth"
 	"github.com/madeddie/opds-aggregator/config"
 )
 
@@ -24,23 +27,70 @@ func RequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
 	}
 }
 
-// BasicAuth returns middleware that enforces HTTP Basic Auth.
-// If auth is nil, the middleware is a no-op passthrough.
-func BasicAuth(auth *config.AuthConfig) func(http.Handler) http.Handler {
+// contextKey is the type of values stored in request contexts by this package.
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	webContextKey
+)
+
+// UserFromContext returns the account that authenticated the request, if any.
+func UserFromContext(ctx context.Context) (config.UserConfig, bool) {
+	u, ok := ctx.Value(userContextKey).(config.UserConfig)
+	return u, ok
+}
+
+// BasicAuth returns middleware that enforces HTTP Basic Auth against the
+// accounts returned by accounts, keyed by username, and stores the
+// authenticated account in the request context. accounts is consulted on
+// every request so the set of accounts can change at runtime; while it is
+// empty, requests pass through unauthenticated.
+func BasicAuth(accounts func() map[string]config.UserConfig) func(http.Handler) http.Handler {
+	// Password hashes are deliberately slow to check, and e-readers send
+	// credentials with every cover request, so remember digests of
+	// credentials that have already been verified.
+	var verified sync.Map
+
 	return func(next http.Handler) http.Handler {
-		if auth == nil || auth.Username == "" {
-			return next
-		}
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			user, pass, ok := r.BasicAuth()
-			if !ok ||
-				subtle.ConstantTimeCompare([]byte(user), []byte(auth.Username)) != 1 ||
-				subtle.ConstantTimeCompare([]byte(pass), []byte(auth.Password)) != 1 {
+			users := accounts()
+			if len(users) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name, pass, ok := r.BasicAuth()
+			u, known := users[name]
+			if ok && !known {
+				// Spend as long on unknown users as on wrong passwords, so
+				// response times don't reveal which accounts exist.
+				auth.CheckPassword(dummyHash, pass)
+			}
+			if !ok || !known || !checkCredentials(&verified, u, pass) {
 				w.Header().Set("WWW-Authenticate", `Basic realm="OPDS Aggregator"`)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, r)
+			ctx := context.WithValue(r.Context(), userContextKey, u)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// dummyHash is the bcrypt hash (at the default cost) checked for unknown
+// usernames.
+const dummyHash = "$2a$10$HqiwfZJNMmdr/PJQMIEoRuWd6Lkijh7N6786mIotwJ4YyZWf8Olhy"
+
+// checkCredentials verifies pass against u's stored password, consulting and
+// filling the cache of previously verified credentials.
+func checkCredentials(verified *sync.Map, u config.UserConfig, pass string) bool {
+	digest := sha256.Sum256([]byte(u.Username + "\x00" + u.Password + "\x00" + pass))
+	if _, ok := verified.Load(digest); ok {
+		return true
+	}
+	if !auth.CheckPassword(u.Password, pass) {
+		return false
+	}
+	verified.Store(digest, struct{}{})
+	return true
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+// Hashes of "secret" with cheap parameters.
+const (
+	bcryptSecret   = "$2a$04$kRXVCBM7WeE0JV1VzBfZtua0Ttyb6Db/3ShWSq1XAk/ODdBXWfs3O"
+	argon2idSecret = "$argon2id$v=19$m=64,t=1,p=1$b3Bkcy1zYWx0LTEyMzQ1Ng$fUylqEPo1qZx209zvWcIIkF2kLHQcF4jGNOVga7bnZE"
+)
+
+func TestBasicAuth(t *testing.T) {
+	users := map[string]config.UserConfig{
+		"plain":  {Username: "plain", Password: "secret"},
+		"bcrypt": {Username: "bcrypt", Password: bcryptSecret},
+		"argon2": {Username: "argon2", Password: argon2idSecret},
+	}
+	tests := []struct {
+		name     string
+		accounts map[string]config.UserConfig
+		user     string
+		pass     string
+		noAuth   bool
+		want     int
+	}{
+		{"no accounts", nil, "", "", true, http.StatusOK},
+		{"no credentials", users, "", "", true, http.StatusUnauthorized},
+		{"plain", users, "plain", "secret", false, http.StatusOK},
+		{"bcrypt", users, "bcrypt", "secret", false, http.StatusOK},
+		{"argon2", users, "argon2", "secret", false, http.StatusOK},
+		{"wrong password", users, "bcrypt", "wrong", false, http.StatusUnauthorized},
+		{"unknown user", users, "nobody", "secret", false, http.StatusUnauthorized},
+		{"hash as password", users, "bcrypt", bcryptSecret, false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := BasicAuth(func() map[string]config.UserConfig { return tt.accounts })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u, _ := UserFromContext(r.Context())
+				got = u.Username
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/opds", nil)
+			if !tt.noAuth {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if rec.Code == http.StatusOK && got != tt.user {
+				t.Errorf("user in context = %q, want %q", got, tt.user)
+			}
+		})
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	// Unknown users are checked against dummyHash, which must cost as much as
+	// a real hash.
+	cost, err := bcrypt.Cost([]byte(dummyHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost = %d, want %d", cost, bcrypt.DefaultCost)
+	}
+}
+
+func TestCheckCredentialsCache(t *testing.T) {
+	var verified sync.Map
+	u := config.UserConfig{Username: "reader", Password: bcryptSecret}
+	count := func() int {
+		n := 0
+		verified.Range(func(_, _ any) bool { n++; return true })
+		return n
+	}
+
+	if checkCredentials(&verified, u, "wrong") {
+		t.Fatal("wrong password accepted")
+	}
+	if count() != 0 {
+		t.Fatal("failed check was cached")
+	}
+	if !checkCredentials(&verified, u, "secret") {
+		t.Fatal("right password rejected")
+	}
+	if count() != 1 {
+		t.Fatalf("got %d cached digests, want 1", count())
+	}
+	// A cached success is found without hashing again, and still only for
+	// the same password.
+	if !checkCredentials(&verified, u, "secret") || checkCredentials(&verified, u, "wrong") {
+		t.Fatal("cached check gave the wrong answer")
+	}
+	// Changing the stored password invalidates what was verified before.
+	u.Password = "other"
+	if checkCredentials(&verified, u, "secret") {
+		t.Error("old password accepted after the stored password changed")
+	}
+}
@@ -4,37 +4,113 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/madeddie/opds-aggregator/convert"
 	"github.com/madeddie/opds-aggregator/opds"
+	"github.com/madeddie/opds-aggregator/thumb"
 )
 
+// rewriteOptions holds per-request choices that shape rewritten links.
+type rewriteOptions struct {
+	thumb       string           // thumbnail profile for image links ("" = original covers)
+	convertFrom []convert.Format // formats that may be converted, in order of preference
+	convertTo   []convert.Format // formats offered as converted acquisitions
+}
+
 // rewriteFeedLinks rewrites all links in a feed to go through the aggregator proxy.
 // Navigation links become /opds/source/{slug}/... paths.
 // Acquisition/image links become /opds/download/{slug}?url=... for proxying.
-func rewriteFeedLinks(feed *opds.Feed, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string) *opds.Feed {
+// Entries also gain acquisition links for formats the converter can derive.
+func rewriteFeedLinks(feed *opds.Feed, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string, opts rewriteOptions) *opds.Feed {
 	// Deep copy to avoid mutating the cache.
 	out := *feed
-	out.Links = rewriteLinks(feed.Links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix)
+	out.Links = rewriteLinks(feed.Links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, opts)
 	out.Entries = make([]opds.Entry, len(feed.Entries))
 	for i, e := range feed.Entries {
 		out.Entries[i] = e
-		out.Entries[i].Links = rewriteLinks(e.Links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix)
+		out.Entries[i].Links = rewriteEntryLinks(e.Links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, opts)
 	}
 	return &out
 }
 
-func rewriteLinks(links []opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string) []opds.Link {
+// rewriteEntryLinks rewrites an entry's links and appends synthetic
+// acquisition links for converted formats.
+func rewriteEntryLinks(links []opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string, opts rewriteOptions) []opds.Link {
+	out := rewriteLinks(links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, opts)
+	return append(out, conversionLinks(links, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, opts)...)
+}
+
+func rewriteLinks(links []opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string, opts rewriteOptions) []opds.Link {
 	if len(links) == 0 {
 		return nil
 	}
 	out := make([]opds.Link, len(links))
 	for i, l := range links {
 		out[i] = l
-		out[i].Href = rewriteHref(l, slug, baseUpstreamURL, sourceRootURL, proxyPrefix)
+		out[i].Href = rewriteHref(l, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, opts.thumb)
+		// Covers in formats that cannot be resized are served as they are,
+		// so only the others are advertised as thumbnails.
+		if opts.thumb != "" && opds.IsImageRel(l.Rel) && !isAggregatorPath(l.Href) && thumb.Decodes(l.Type) {
+			out[i].Type = thumbnailType
+		}
 	}
 	return out
 }
 
-func rewriteHref(l opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string) string {
+// conversionLinks returns an acquisition link for each conversion target
+// the entry does not already offer, pointing at the download endpoint with
+// ?convert=<format> on the entry's preferred convertible source link.
+func conversionLinks(links []opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix string, opts rewriteOptions) []opds.Link {
+	if len(opts.convertTo) == 0 {
+		return nil
+	}
+
+	offered := make(map[string]bool)
+	for _, l := range links {
+		if f, ok := convert.ForMediaType(l.Type); ok && isAcquisitionRel(l.Rel) {
+			offered[f.Name] = true
+		}
+	}
+	source, ok := convertibleLink(links, opts.convertFrom)
+	if !ok {
+		return nil
+	}
+	href := rewriteHref(source, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, "")
+	if !strings.Contains(href, "/opds/download/") {
+		return nil
+	}
+
+	var out []opds.Link
+	for _, to := range opts.convertTo {
+		if offered[to.Name] {
+			continue
+		}
+		out = append(out, opds.Link{
+			Rel:   source.Rel,
+			Href:  href + "&convert=" + to.Name,
+			Type:  to.MediaType,
+			Title: strings.ToUpper(to.Name) + " (converted)",
+		})
+	}
+	return out
+}
+
+// convertibleLink returns the free acquisition link in the most preferred
+// source format.
+func convertibleLink(links []opds.Link, from []convert.Format) (opds.Link, bool) {
+	for _, f := range from {
+		for _, l := range links {
+			if l.Rel != opds.RelAcquisition && l.Rel != opds.RelOpenAccess {
+				continue
+			}
+			if lf, ok := convert.ForMediaType(l.Type); ok && lf.Name == f.Name {
+				return l, true
+			}
+		}
+	}
+	return opds.Link{}, false
+}
+
+func rewriteHref(l opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix, thumb string) string {
 	// Skip links that are already local aggregator paths (e.g., pagination links).
 	// Check for specific aggregator path patterns, not just /opds/ prefix, because
 	// upstream feeds may also use /opds/ paths (e.g., Calibre-Web).
@@ -44,7 +120,11 @@ func rewriteHref(l opds.Link, slug, baseUpstreamURL, sourceRootURL, proxyPrefix
 
 	href := resolveURL(baseUpstreamURL, l.Href)
 
-	// Acquisition and image links get proxied through the download endpoint.
+	// Acquisition and image links get proxied through the download endpoint;
+	// images point at the resized variant for the client's thumbnail profile.
+	if opds.IsImageRel(l.Rel) && thumb != "" {
+		return proxyPrefix + "/opds/download/" + slug + "?url=" + url.QueryEscape(href) + "&thumb=" + url.QueryEscape(thumb)
+	}
 	if isAcquisitionRel(l.Rel) || opds.IsImageRel(l.Rel) {
 		return proxyPrefix + "/opds/download/" + slug + "?url=" + url.QueryEscape(href)
 	}
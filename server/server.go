@@ -8,39 +8,77 @@ import (
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
 
-	"github.com/madeddie/opds-aggregator/cache"
 	"github.com/madeddie/opds-aggregator/config"
-	"github.com/madeddie/opds-aggregator/crawler"
-	"github.com/madeddie/opds-aggregator/search"
+	"github.com/madeddie/opds-aggregator/metrics"
 )
 
-// New creates a configured HTTP server with all routes.
-func New(
-	cfg *config.Config,
-	feedCache *cache.FeedCache,
-	crawl *crawler.Crawler,
-	searcher *search.Searcher,
-	logger *slog.Logger,
-) *http.Server {
-	h := NewHandler(cfg, feedCache, crawl, searcher, logger)
-
+// New creates a configured HTTP server serving h on all routes. admin may be
+// nil to disable the admin API.
+func New(cfg *config.Config, h *Handler, admin *AdminHandler, logger *slog.Logger) *http.Server {
 	r := chi.NewRouter()
 	r.Use(chimiddleware.Recoverer)
 	r.Use(chimiddleware.RealIP)
 	r.Use(RequestLogger(logger))
-	r.Use(BasicAuth(cfg.Server.Auth))
-
-	// OPDS routes.
-	r.Get("/opds", h.HandleRoot)
-	r.Get("/opds/", h.HandleRoot)
-	r.Get("/opds/source/{slug}/*", h.HandleSource)
-	r.Get("/opds/download/{slug}", h.HandleDownload)
-	r.Get("/opds/search", h.HandleSearch)
-	r.Get("/opds/search/{slug}", h.HandleSourceSearch)
-
-	// Management routes.
-	r.Post("/opds/refresh", h.HandleRefreshAll)
-	r.Post("/opds/refresh/{slug}", h.HandleRefresh)
+
+	// Probes for container orchestration; they stay reachable without credentials.
+	r.Get("/healthz", h.HandleHealthz)
+	r.Get("/readyz", h.HandleReadyz)
+
+	r.Group(func(r chi.Router) {
+		r.Use(BasicAuth(h.Accounts))
+
+		// OPDS routes.
+		r.Get("/opds", h.HandleRoot)
+		r.Get("/opds/", h.HandleRoot)
+		r.Get("/opds/source/{slug}/*", h.HandleSource)
+		r.Get("/opds/download/{slug}", h.HandleDownload)
+		r.Head("/opds/download/{slug}", h.HandleDownload)
+		r.Get("/opds/search", h.HandleSearch)
+		r.Get("/opds/search/{slug}", h.HandleSourceSearch)
+
+		// Merged views across all sources.
+		r.Get("/opds/all/new", h.HandleRecent)
+		r.Get("/opds/all/{view}", h.HandleViewIndex)
+		r.Get("/opds/all/{view}/{key}", h.HandleViewItems)
+
+		// Prometheus metrics, which name every source, for admins only.
+		r.With(AdminOnly(h.Accounts)).Handle("/metrics", metrics.Handler())
+
+		// Management routes.
+		r.Post("/opds/refresh", h.HandleRefreshAll)
+		r.Post("/opds/refresh/{slug}", h.HandleRefresh)
+		r.Get("/opds/refresh/{slug}", h.HandleRefreshStatus)
+
+		// HTML pages for browsers, built by the same handlers as the catalog.
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/web/", http.StatusFound)
+		})
+		r.Route("/web", func(r chi.Router) {
+			r.Use(h.WebOutput)
+			r.Get("/", h.HandleRoot)
+			r.Get("/source/{slug}/*", h.HandleSource)
+			r.Get("/search", h.HandleSearch)
+			r.Get("/search/{slug}", h.HandleSourceSearch)
+			r.Get("/all/new", h.HandleRecent)
+			r.Get("/all/{view}", h.HandleViewIndex)
+			r.Get("/all/{view}/{key}", h.HandleViewItems)
+		})
+
+		// Per-source status.
+		r.Get("/api/sources", h.HandleSources)
+
+		// Admin API for managing feeds.
+		if admin != nil {
+			r.Route("/api/feeds", func(r chi.Router) {
+				r.Use(RequireAdmin)
+				r.Get("/", admin.HandleList)
+				r.Post("/", admin.HandleCreate)
+				r.Get("/{slug}", admin.HandleGet)
+				r.Put("/{slug}", admin.HandleUpdate)
+				r.Delete("/{slug}", admin.HandleDelete)
+			})
+		}
+	})
 
 	return &http.Server{
 		Addr:    cfg.Server.Addr,
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+)
+
+func TestMetricsAccess(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	tests := []struct {
+		name string
+		cfg  config.Config
+		user string
+		want int
+	}{
+		{"no accounts", config.Config{}, "", http.StatusOK},
+		{"anonymous", config.Config{Users: []config.UserConfig{{Username: "reader", Password: "secret"}}}, "", http.StatusUnauthorized},
+		{"reader", config.Config{Users: []config.UserConfig{{Username: "reader", Password: "secret"}}}, "reader", http.StatusForbidden},
+		{"admin", config.Config{Users: []config.UserConfig{{Username: "boss", Password: "secret", Admin: true}}}, "boss", http.StatusOK},
+		{"server auth", config.Config{Server: config.ServerConfig{Auth: &config.AuthConfig{Username: "owner", Password: "secret"}}}, "owner", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			h := NewHandler(&cfg, cache.NewFeedCache(logger, nil), nil, nil, nil, nil, nil, nil, logger)
+			srv := New(&cfg, h, nil, logger).Handler
+
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, "secret")
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
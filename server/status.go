@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+	"github.com/madeddie/opds-aggregator/poller"
+)
+
+// SourceStatus describes the health of one configured source, as reported
+// by /api/sources.
+type SourceStatus struct {
+	Slug            string        `json:"slug"`
+	Name            string        `json:"name"`
+	URL             string        `json:"url"`
+	Cached          bool          `json:"cached"`
+	LastCrawl       *time.Time    `json:"last_crawl,omitempty"` // when the cached tree was stored
+	LastError       string        `json:"last_error,omitempty"`
+	Refresh         poller.Status `json:"refresh"`
+	Children        int           `json:"children"`      // cached sub-feeds
+	Entries         int           `json:"entries"`       // entries in the root feed
+	TotalEntries    int           `json:"total_entries"` // entries across every cached feed
+	Books           int           `json:"books"`         // entries with acquisition links
+	Search          SearchStatus  `json:"search"`
+	HasMoreUpstream bool          `json:"has_more_upstream"`
+	Complete        bool          `json:"complete"` // every navigation link and upstream page was crawled
+}
+
+// SearchStatus reports which kinds of search a source supports.
+type SearchStatus struct {
+	Local    bool `json:"local"`    // cached entries are in the local index
+	Upstream bool `json:"upstream"` // the source advertises an OpenSearch description
+}
+
+// HandleHealthz is a liveness probe: it succeeds as long as the server is
+// able to answer requests.
+func (h *Handler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// HandleReadyz is a readiness probe: it fails with 503 until every source
+// has a cached tree or has finished its initial crawl.
+func (h *Handler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, pending := true, []string(nil)
+	if h.poller != nil {
+		ready, pending = h.poller.Ready()
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, struct {
+		Ready   bool     `json:"ready"`
+		Pending []string `json:"pending,omitempty"`
+	}{ready, pending}, h.logger)
+}
+
+// HandleSources reports the crawl and cache status of every source visible
+// to the requesting user, in configuration order.
+func (h *Handler) HandleSources(w http.ResponseWriter, r *http.Request) {
+	statuses := []SourceStatus{}
+	for _, fc := range h.visibleFeeds(r) {
+		slug := fc.Slug()
+		st := SourceStatus{
+			Slug: slug,
+			Name: fc.Name,
+			URL:  fc.URL,
+		}
+		st.Refresh = h.refreshStatus(slug)
+		st.LastError = st.Refresh.LastError
+		if cached, ok := h.feedCache.Get(slug); ok {
+			updated := cached.UpdatedAt
+			st.Cached = true
+			st.LastCrawl = &updated
+			tree := cached.Tree
+			feed, hasMore, _ := tree.Snapshot()
+			st.Children = len(tree.ChildNodes())
+			if feed != nil {
+				st.Entries = len(feed.Entries)
+			}
+			st.TotalEntries, st.Books = countEntries(tree)
+			st.Search = SearchStatus{Local: st.Books > 0, Upstream: tree.SearchURL != ""}
+			st.HasMoreUpstream = hasMore
+			st.Complete = tree.Complete
+		}
+		statuses = append(statuses, st)
+	}
+	writeJSON(w, http.StatusOK, statuses, h.logger)
+}
+
+// refreshStatus returns the poller's refresh status for a source, or a zero
+// Status when refreshes are disabled.
+func (h *Handler) refreshStatus(slug string) poller.Status {
+	if h.poller == nil {
+		return poller.Status{Slug: slug}
+	}
+	status, _ := h.poller.Status(slug)
+	return status
+}
+
+// healthSummary describes a source's health in one line for its entry in
+// the catalog root: when it was last updated and, if the latest refresh
+// failed, why.
+func healthSummary(cached *cache.CachedFeed, refresh poller.Status) string {
+	summary := "Not crawled yet"
+	if cached != nil {
+		summary = "Last updated " + cached.UpdatedAt.UTC().Format(noticeTimeFormat)
+	}
+	if refresh.LastError != "" {
+		summary += " · Last error"
+		if refresh.FinishedAt != nil {
+			summary += " at " + refresh.FinishedAt.UTC().Format(noticeTimeFormat)
+		}
+		summary += ": " + refresh.LastError
+	}
+	return summary
+}
+
+// noticeTimeFormat is how times are shown to readers inside the catalog.
+const noticeTimeFormat = "2006-01-02 15:04 MST"
+
+// isStale reports whether a feed fetched at fetched predates the latest
+// refresh of its source, which failed. Feeds fetched on demand since then,
+// and trees stored by an on-demand crawl, are current.
+func isStale(refresh poller.Status, fetched time.Time) bool {
+	if refresh.LastError == "" {
+		return false
+	}
+	return refresh.FinishedAt == nil || fetched.Before(*refresh.FinishedAt)
+}
+
+// staleNotice builds the entry shown at the top of a source's feeds while
+// they are served from a cached tree because the latest refresh failed.
+func staleNotice(fc config.FeedConfig, cached *cache.CachedFeed, refresh poller.Status) opds.Entry {
+	since := cached.UpdatedAt.UTC().Format(noticeTimeFormat)
+	return opds.Entry{
+		ID:      "urn:opds-aggregator:notice:stale:" + fc.Slug(),
+		Title:   "Stale since " + since,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Content: &opds.Text{
+			Type: "text",
+			Body: fc.Name + " could not be refreshed (" + refresh.LastError + "). Showing the catalog as cached on " + since + ".",
+		},
+		Links: []opds.Link{
+			{
+				Rel:  opds.RelSubsection,
+				Href: "/opds/source/" + fc.Slug() + "/",
+				Type: opds.MediaTypeAtom,
+			},
+		},
+	}
+}
+
+// countEntries returns the number of entries across every feed in tree and
+// how many of them are books (entries with acquisition links).
+func countEntries(tree *crawler.FeedTree) (total, books int) {
+	tree.Walk(func(_ *crawler.FeedTree, feed *opds.Feed) {
+		if feed == nil {
+			return
+		}
+		total += len(feed.Entries)
+		for _, e := range feed.Entries {
+			if e.HasAcquisitionLinks() {
+				books++
+			}
+		}
+	})
+	return total, books
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+	"github.com/madeddie/opds-aggregator/poller"
+)
+
+// flakyUpstream serves an empty feed on every path, and answers 503 for the
+// paths marked down.
+type flakyUpstream struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (u *flakyUpstream) setDown(path string, down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.down[path] = down
+}
+
+func (u *flakyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	down := u.down[r.URL.Path]
+	u.mu.Unlock()
+	if down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", opds.MediaTypeAtom)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><id>%[1]s</id><title>Feed %[1]s</title></feed>`, r.URL.Path)
+}
+
+// newStatusServer serves the sources "up", "stale" and "down" from a
+// polling upstream. "stale" starts with a cached tree; the root feeds of
+// "stale" and "down" fail until the test brings them back. It returns once
+// every source's first refresh has finished.
+func newStatusServer(t *testing.T, hideDown bool) (http.Handler, *flakyUpstream) {
+	t.Helper()
+	u := &flakyUpstream{down: map[string]bool{"/stale": true, "/down": true}}
+	upstream := httptest.NewServer(u)
+	t.Cleanup(upstream.Close)
+
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{}
+	cfg.Server.HideDownSources = hideDown
+	cfg.Polling.Interval = "1h"
+	for _, name := range []string{"up", "stale", "down"} {
+		cfg.Feeds = append(cfg.Feeds, config.FeedConfig{Name: name, URL: upstream.URL + "/" + name})
+	}
+	fc := cache.NewFeedCache(logger, nil)
+	fc.Put("stale", &crawler.FeedTree{
+		Feed:     &opds.Feed{ID: "stale", Title: "Cached stale"},
+		URL:      upstream.URL + "/stale",
+		Children: make(map[string]*crawler.FeedTree),
+	})
+	crawl := crawler.New(nil, logger)
+	p, err := poller.New(cfg, crawl, fc, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, f := range cfg.Feeds {
+		for {
+			st, _ := p.Status(f.Slug())
+			if st.FinishedAt != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s to refresh", f.Slug())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	h := NewHandler(cfg, fc, crawl, nil, p, nil, nil, nil, logger)
+	return New(cfg, h, nil, logger).Handler, u
+}
+
+func TestHideDownSources(t *testing.T) {
+	tests := []struct {
+		hide bool
+		want []string
+	}{
+		{false, []string{"up", "stale", "down"}},
+		{true, []string{"up", "stale"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint("hide=", tt.hide), func(t *testing.T) {
+			srv, _ := newStatusServer(t, tt.hide)
+			code, body := get(t, srv, "/opds")
+			if code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", code)
+			}
+			feed, err := opds.Parse(strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range feed.Entries {
+				if slug, ok := strings.CutPrefix(e.ID, "urn:opds-aggregator:source:"); ok {
+					got = append(got, slug)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("sources = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleNotice(t *testing.T) {
+	srv, u := newStatusServer(t, false)
+
+	// firstTitle returns the title of the first entry served at target.
+	firstTitle := func(target string) string {
+		t.Helper()
+		code, body := get(t, srv, target)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200", target, code)
+		}
+		feed, err := opds.Parse(strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.Entries) == 0 {
+			return ""
+		}
+		return feed.Entries[0].Title
+	}
+
+	if got := firstTitle("/opds/source/stale/"); !strings.HasPrefix(got, "Stale since ") {
+		t.Errorf("cached tree after a failed refresh: first entry = %q, want the stale notice", got)
+	}
+	if got := firstTitle("/opds/source/up/"); strings.HasPrefix(got, "Stale since ") {
+		t.Errorf("refreshed source: got the stale notice")
+	}
+	// A sub-feed fetched on demand after the failure is current.
+	if got := firstTitle("/opds/source/stale/sub"); strings.HasPrefix(got, "Stale since ") {
+		t.Errorf("sub-feed fetched on demand: got the stale notice")
+	}
+
+	// The source comes back: an on-demand crawl of its root succeeds, even
+	// though the last scheduled refresh still records the failure.
+	u.setDown("/down", false)
+	if got := firstTitle("/opds/source/down/"); strings.HasPrefix(got, "Stale since ") {
+		t.Errorf("source crawled on demand: got the stale notice")
+	}
+}
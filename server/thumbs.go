@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/thumb"
+)
+
+// thumbnailType is the media type of resized covers.
+const thumbnailType = thumb.ContentType
+
+// maxImageBytes bounds the size of the upstream images that are resized;
+// larger ones are rejected rather than truncated.
+const maxImageBytes = 32 << 20
+
+// thumbnailProfile returns the name of the thumbnail profile for the
+// requesting client, or "" to serve original covers.
+func (h *Handler) thumbnailProfile(r *http.Request) string {
+	return h.current().cfg.Thumbnails.ProfileFor(r.UserAgent())
+}
+
+// serveThumbnail serves a cover resized for profile. Resized variants of
+// covers the feed links to are kept in the download cache when it is
+// enabled, independently of the feed's cache_downloads setting, since they
+// are small and costly to make. Images that cannot be decoded are served
+// unchanged.
+func (h *Handler) serveThumbnail(w http.ResponseWriter, r *http.Request, feedCfg config.FeedConfig, imgURL string, profile config.ThumbnailProfile) {
+	slug := feedCfg.Slug()
+	key := fmt.Sprintf("%s#thumb=%dx%d,gray=%t,q=%d", imgURL, profile.Width, profile.Height, profile.Grayscale, profile.Quality)
+	caching := h.downloads != nil && h.linkedFrom(slug, imgURL)
+	if caching {
+		if f, entry, ok := h.downloads.Open(slug, key); ok {
+			defer f.Close()
+			serveCachedDownload(w, r, f, entry)
+			return
+		}
+	}
+
+	original, contentType, err := h.fetchImage(r, feedCfg, imgURL, caching)
+	if err != nil {
+		h.logger.Error("thumbnail fetch failed", "url", imgURL, "error", err)
+		http.Error(w, "failed to fetch image", http.StatusBadGateway)
+		return
+	}
+
+	data, err := thumb.Resize(original, thumb.Options{
+		Width:     profile.Width,
+		Height:    profile.Height,
+		Grayscale: profile.Grayscale,
+		Quality:   profile.Quality,
+	})
+	if err != nil {
+		h.logger.Debug("serving original image", "url", imgURL, "error", err)
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(original))
+		return
+	}
+
+	if caching {
+		if err := storeFile(h.downloads, slug, key, thumbnailType, nil, bytes.NewReader(data)); err != nil {
+			h.logger.Warn("failed to cache thumbnail", "url", imgURL, "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", thumbnailType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// fetchImage returns the original image, from the download cache if
+// caching and present.
+func (h *Handler) fetchImage(r *http.Request, feedCfg config.FeedConfig, imgURL string, caching bool) ([]byte, string, error) {
+	if caching {
+		if f, entry, ok := h.downloads.Open(feedCfg.Slug(), imgURL); ok {
+			defer f.Close()
+			data, err := readImage(f, imgURL)
+			return data, entry.ContentType, err
+		}
+	}
+
+	resp, err := h.crawler.FetchRaw(r.Context(), http.MethodGet, imgURL, feedCfg.Auth, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > maxImageBytes {
+		return nil, "", fmt.Errorf("%s: image of %d bytes exceeds the limit of %d", imgURL, resp.ContentLength, maxImageBytes)
+	}
+	data, err := readImage(resp.Body, imgURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// readImage reads an image of at most maxImageBytes.
+func readImage(r io.Reader, imgURL string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", imgURL, err)
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("%s: image exceeds the limit of %d bytes", imgURL, maxImageBytes)
+	}
+	return data, nil
+}
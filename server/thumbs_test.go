@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+func TestReadImageRejectsOversized(t *testing.T) {
+	tests := []struct {
+		size    int
+		wantErr bool
+	}{
+		{0, false},
+		{1024, false},
+		{maxImageBytes, false},
+		{maxImageBytes + 1, true},
+	}
+	for _, tt := range tests {
+		data, err := readImage(bytes.NewReader(make([]byte, tt.size)), "http://example.com/cover.jpg")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("size %d: error %v, want error %t", tt.size, err, tt.wantErr)
+		}
+		if err == nil && len(data) != tt.size {
+			t.Errorf("size %d: read %d bytes", tt.size, len(data))
+		}
+	}
+}
+
+func TestThumbnailLinkTypes(t *testing.T) {
+	links := []opds.Link{
+		{Rel: opds.RelImage, Href: "cover.png", Type: "image/png"},
+		{Rel: opds.RelThumbnail, Href: "thumb.jpg", Type: "image/jpeg"},
+		{Rel: opds.RelImage, Href: "cover.svg", Type: "image/svg+xml"},
+		{Rel: opds.RelThumbnail, Href: "thumb"},
+		{Rel: opds.RelAcquisition, Href: "book.epub", Type: "application/epub+zip"},
+	}
+	tests := []struct {
+		profile string
+		want    []string
+	}{
+		{"", []string{"image/png", "image/jpeg", "image/svg+xml", "", "application/epub+zip"}},
+		// Only covers that can be resized become JPEG thumbnails; the others
+		// are served unchanged and keep their type.
+		{"eink", []string{thumbnailType, thumbnailType, "image/svg+xml", "", "application/epub+zip"}},
+	}
+	for _, tt := range tests {
+		out := rewriteLinks(links, "books", "http://example.com/opds", "http://example.com/opds", "", rewriteOptions{thumb: tt.profile})
+		var got []string
+		for _, l := range out {
+			got = append(got, l.Type)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("profile %q: types = %q, want %q", tt.profile, got, tt.want)
+		}
+	}
+}
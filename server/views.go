@@ -0,0 +1,360 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/dedup"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// defaultViewPageSize is the page size for merged views when the server has
+// no default_max_entries configured; merged views are never unpaginated.
+const defaultViewPageSize = 50
+
+// mergedView is a browsable grouping of books across all sources.
+type mergedView struct {
+	Name  string // URL segment under /opds/all/
+	Title string
+	// keys returns the display values an entry is grouped under.
+	keys func(e opds.Entry) []string
+}
+
+var mergedViews = []mergedView{
+	{Name: "authors", Title: "By author", keys: authorKeys},
+	{Name: "languages", Title: "By language", keys: languageKeys},
+	{Name: "categories", Title: "By category", keys: categoryKeys},
+}
+
+func findView(name string) (mergedView, bool) {
+	for _, v := range mergedViews {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return mergedView{}, false
+}
+
+// mergedViewEntries returns the navigation entries linking to the merged
+// views, for inclusion in the catalog root.
+func mergedViewEntries(updated string) []opds.Entry {
+	entries := []opds.Entry{{
+		ID:      "urn:opds-aggregator:all:new",
+		Title:   "Recently added",
+		Updated: updated,
+		Content: &opds.Text{Type: "text", Body: "Newest books across all sources"},
+		Links: []opds.Link{{
+			Rel:  opds.RelSubsection,
+			Href: "/opds/all/new",
+			Type: opds.MediaTypeOPDSAcq,
+		}},
+	}}
+	for _, v := range mergedViews {
+		entries = append(entries, opds.Entry{
+			ID:      "urn:opds-aggregator:all:" + v.Name,
+			Title:   v.Title,
+			Updated: updated,
+			Content: &opds.Text{Type: "text", Body: v.Title + " across all sources"},
+			Links: []opds.Link{{
+				Rel:  opds.RelSubsection,
+				Href: "/opds/all/" + v.Name,
+				Type: opds.MediaTypeOPDSNav,
+			}},
+		})
+	}
+	return entries
+}
+
+// HandleRecent serves books from every cached source, newest first.
+func (h *Handler) HandleRecent(w http.ResponseWriter, r *http.Request) {
+	feed := h.mergedFeed("urn:opds-aggregator:all:new", "Recently added", "/opds/all/new", opds.MediaTypeOPDSAcq)
+	feed.Entries = h.mergedBooks(r).entries
+	h.writeMergedFeed(w, r, feed, "/opds/all/new")
+}
+
+// HandleViewIndex serves the list of groups (authors, languages, categories)
+// of a merged view, each linking to the books in that group.
+func (h *Handler) HandleViewIndex(w http.ResponseWriter, r *http.Request) {
+	view, ok := findView(chi.URLParam(r, "view"))
+	if !ok {
+		http.Error(w, "unknown view", http.StatusNotFound)
+		return
+	}
+
+	groups := h.mergedBooks(r).groups[view.Name]
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	basePath := "/opds/all/" + view.Name
+	feed := h.mergedFeed("urn:opds-aggregator:all:"+view.Name, view.Title, basePath, opds.MediaTypeOPDSNav)
+	for _, k := range keys {
+		g := groups[k]
+		href := basePath + "/" + url.PathEscape(k)
+		feed.Entries = append(feed.Entries, opds.Entry{
+			ID:      "urn:opds-aggregator:all:" + view.Name + ":" + url.PathEscape(k),
+			Title:   g.name,
+			Updated: feed.Updated,
+			Content: &opds.Text{Type: "text", Body: fmt.Sprintf("%d books", len(g.entries))},
+			Links: []opds.Link{{
+				Rel:   opds.RelSubsection,
+				Href:  href,
+				Type:  opds.MediaTypeOPDSAcq,
+				Count: len(g.entries),
+			}},
+		})
+	}
+	h.writeMergedFeed(w, r, feed, basePath)
+}
+
+// HandleViewItems serves the books in one group of a merged view, newest first.
+func (h *Handler) HandleViewItems(w http.ResponseWriter, r *http.Request) {
+	view, ok := findView(chi.URLParam(r, "view"))
+	if !ok {
+		http.Error(w, "unknown view", http.StatusNotFound)
+		return
+	}
+	// chi matches against the escaped path only when the request has one
+	// (RawPath); otherwise the parameter is already decoded.
+	key := chi.URLParam(r, "key")
+	if r.URL.RawPath != "" {
+		var err error
+		if key, err = url.PathUnescape(key); err != nil {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+	}
+	key = normalizeKey(key)
+
+	g, ok := h.mergedBooks(r).groups[view.Name][key]
+	if !ok {
+		http.Error(w, "no books found", http.StatusNotFound)
+		return
+	}
+
+	basePath := "/opds/all/" + view.Name + "/" + url.PathEscape(key)
+	feed := h.mergedFeed("urn:opds-aggregator:all:"+view.Name+":"+url.PathEscape(key), g.name, basePath, opds.MediaTypeOPDSAcq)
+	feed.Entries = g.entries
+	h.writeMergedFeed(w, r, feed, basePath)
+}
+
+func (h *Handler) mergedFeed(id, title, selfPath, selfType string) *opds.Feed {
+	return &opds.Feed{
+		ID:      id,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []opds.Link{
+			{Rel: opds.RelSelf, Href: selfPath, Type: selfType},
+			{Rel: opds.RelStart, Href: "/opds", Type: opds.MediaTypeAtom},
+			{Rel: opds.RelSearch, Href: "/opds/search?q={searchTerms}", Type: opds.MediaTypeAtom},
+		},
+	}
+}
+
+// writeMergedFeed paginates a merged view with the same helper as source feeds.
+func (h *Handler) writeMergedFeed(w http.ResponseWriter, r *http.Request, feed *opds.Feed, basePath string) {
+	pageSize := h.current().cfg.Server.DefaultMaxEntries
+	if pageSize <= 0 {
+		pageSize = defaultViewPageSize
+	}
+	offset, limit := h.parsePaginationParams(r, pageSize)
+	feed = h.paginateFeed(feed, basePath, r.URL.RawQuery, offset, limit, false)
+	writeOPDS(w, r, feed, h.logger)
+}
+
+// mergedBooks is the merged, newest-first list of books from a set of
+// sources, grouped for every merged view. It is shared between requests and
+// must not be modified.
+type mergedBooks struct {
+	entries []opds.Entry
+	groups  map[string]map[string]*viewGroup // view name → normalized key → group
+}
+
+// viewGroup is one group of a merged view, e.g. the books of one author.
+type viewGroup struct {
+	name    string // display name, as first seen
+	entries []opds.Entry
+}
+
+// mergedBooksCache memoizes mergedBooks per set of visible sources and
+// thumbnail profile until the feed cache changes. It lives in the handler
+// state, so a reload starts it afresh.
+type mergedBooksCache struct {
+	mu    sync.Mutex
+	gen   uint64 // feed cache generation the books were built from
+	books map[string]*mergedBooks
+}
+
+// mergedBooks returns the books of the sources visible to the requesting
+// user. They are only collected again once the feed cache has changed, so
+// paging through a merged view does not walk every cached tree each time.
+func (h *Handler) mergedBooks(r *http.Request) *mergedBooks {
+	feeds := h.visibleFeeds(r)
+	opts := h.rewriteOptions(r)
+	slugs := make([]string, len(feeds))
+	for i, fc := range feeds {
+		slugs[i] = fc.Slug()
+	}
+	key := opts.thumb + "|" + strings.Join(slugs, ",")
+
+	gen := h.feedCache.Generation()
+	c := &h.current().books
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.books == nil || c.gen != gen {
+		c.gen = gen
+		c.books = make(map[string]*mergedBooks)
+	}
+	if b, ok := c.books[key]; ok {
+		return b
+	}
+	b := newMergedBooks(h.collectBooks(feeds, opts))
+	c.books[key] = b
+	return b
+}
+
+// newMergedBooks sorts entries newest first and groups them for every view.
+func newMergedBooks(entries []opds.Entry) *mergedBooks {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entryTime(entries[i]).After(entryTime(entries[j]))
+	})
+	b := &mergedBooks{entries: entries, groups: make(map[string]map[string]*viewGroup)}
+	for _, v := range mergedViews {
+		groups := make(map[string]*viewGroup)
+		for _, e := range entries {
+			var added map[string]bool
+			for _, name := range v.keys(e) {
+				key := normalizeKey(name)
+				if added[key] {
+					continue
+				}
+				g, ok := groups[key]
+				if !ok {
+					g = &viewGroup{name: name}
+					groups[key] = g
+				}
+				g.entries = append(g.entries, e)
+				if added == nil {
+					added = make(map[string]bool)
+				}
+				added[key] = true
+			}
+		}
+		b.groups[v.Name] = groups
+	}
+	return b
+}
+
+// collectBooks gathers every entry with acquisition links from the cached
+// trees of feeds. Links are rewritten to aggregator paths for their source,
+// and each entry is tagged with a source category. The same work offered by
+// several sources is merged into one entry (see package dedup).
+func (h *Handler) collectBooks(feeds []config.FeedConfig, opts rewriteOptions) []opds.Entry {
+	var items []dedup.Item
+	for _, fc := range feeds {
+		slug := fc.Slug()
+		cached, ok := h.feedCache.Get(slug)
+		if !ok || cached.Tree == nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		cached.Tree.Walk(func(node *crawler.FeedTree, feed *opds.Feed) {
+			if feed == nil {
+				return
+			}
+			for _, e := range feed.Entries {
+				if !e.HasAcquisitionLinks() {
+					continue
+				}
+				id := e.ID
+				if id == "" {
+					id = e.Title
+				}
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+
+				e.Links = rewriteEntryLinks(e.Links, slug, node.URL, cached.Tree.URL, "", opts)
+				items = append(items, dedup.Item{Source: fc.Name, Entry: opds.TagSource(e, slug, fc.Name)})
+			}
+		})
+	}
+	return dedup.Merge(items)
+}
+
+// entrySource returns the slug of the source an entry was tagged with.
+func entrySource(e opds.Entry) string {
+	for _, c := range e.Categories {
+		if c.Scheme == opds.SchemeSource {
+			return c.Term
+		}
+	}
+	return ""
+}
+
+func authorKeys(e opds.Entry) []string {
+	var keys []string
+	for _, a := range e.Authors {
+		if name := strings.TrimSpace(a.Name); name != "" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+func languageKeys(e opds.Entry) []string {
+	if lang := strings.TrimSpace(e.Language); lang != "" {
+		return []string{lang}
+	}
+	return nil
+}
+
+func categoryKeys(e opds.Entry) []string {
+	var keys []string
+	for _, c := range e.Categories {
+		if c.Scheme == opds.SchemeSource {
+			continue
+		}
+		name := c.Label
+		if name == "" {
+			name = c.Term
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// normalizeKey folds case and whitespace so "Jane  Austen" and "jane austen"
+// land in the same group. '/' is replaced because keys are used as a single
+// path segment.
+func normalizeKey(s string) string {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	return strings.ReplaceAll(s, "/", "-")
+}
+
+// entryTime returns the entry's updated time, falling back to its published
+// time. Unparseable timestamps sort last.
+func entryTime(e opds.Entry) time.Time {
+	for _, v := range []string{e.Updated, e.Published} {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
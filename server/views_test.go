@@ -0,0 +1,125 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Jane Austen", "jane austen"},
+		{"  Jane \t Austen ", "jane austen"},
+		{"JANE AUSTEN", "jane austen"},
+		{"Science/Fiction", "science-fiction"},
+		{"100% Fiction", "100% fiction"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeKey(tt.in); got != tt.want {
+			t.Errorf("normalizeKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func book(id, title, updated, author, category string) opds.Entry {
+	return opds.Entry{
+		ID:         id,
+		Title:      title,
+		Updated:    updated,
+		Authors:    []opds.Author{{Name: author}},
+		Categories: []opds.Category{{Term: category, Label: category}},
+		Links:      []opds.Link{{Rel: opds.RelAcquisition, Href: "/" + id + ".epub", Type: "application/epub+zip"}},
+	}
+}
+
+// newViewsServer serves a single source "books" whose root lists entries.
+func newViewsServer(t *testing.T, entries ...opds.Entry) (http.Handler, *cache.FeedCache) {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{Feeds: []config.FeedConfig{{Name: "Books", URL: "http://upstream.example/opds"}}}
+	fc := cache.NewFeedCache(logger, nil)
+	putBooks(fc, entries...)
+	h := NewHandler(cfg, fc, nil, nil, nil, nil, nil, nil, logger)
+	return New(cfg, h, nil, logger).Handler, fc
+}
+
+func putBooks(fc *cache.FeedCache, entries ...opds.Entry) {
+	fc.Put("books", &crawler.FeedTree{
+		Feed:     &opds.Feed{ID: "root", Title: "Books", Entries: entries},
+		URL:      "http://upstream.example/opds",
+		Children: make(map[string]*crawler.FeedTree),
+	})
+}
+
+func get(t *testing.T, h http.Handler, target string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestViewItemsKeyDecoding(t *testing.T) {
+	h, _ := newViewsServer(t,
+		book("a", "Percentages", "2024-01-01T00:00:00Z", "Ann", "100% Fiction"),
+		book("b", "Spaceships", "2024-01-02T00:00:00Z", "Bob", "Sci/Fi"),
+	)
+	tests := []struct {
+		path      string
+		wantCode  int
+		wantTitle string
+	}{
+		{"/opds/all/categories/100%25%20fiction", http.StatusOK, "Percentages"},
+		{"/opds/all/categories/100%25%20Fiction", http.StatusOK, "Percentages"},
+		{"/opds/all/categories/sci-fi", http.StatusOK, "Spaceships"},
+		{"/opds/all/categories/sci%2Ffi", http.StatusOK, "Spaceships"},
+		{"/opds/all/authors/ann", http.StatusOK, "Percentages"},
+		{"/opds/all/authors/nobody", http.StatusNotFound, ""},
+		{"/opds/all/shelves/ann", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		code, body := get(t, h, tt.path)
+		if code != tt.wantCode {
+			t.Errorf("GET %s = %d, want %d: %s", tt.path, code, tt.wantCode, body)
+			continue
+		}
+		if tt.wantTitle != "" && !strings.Contains(body, "<title>"+tt.wantTitle+"</title>") {
+			t.Errorf("GET %s: missing %q in %s", tt.path, tt.wantTitle, body)
+		}
+	}
+}
+
+func TestViewIndexAndRecent(t *testing.T) {
+	h, fc := newViewsServer(t,
+		book("old", "Old Book", "2020-01-01T00:00:00Z", "Jane Austen", "Classics"),
+		book("new", "New Book", "2024-01-01T00:00:00Z", "jane  austen", "Classics"),
+	)
+
+	_, body := get(t, h, "/opds/all/authors")
+	if strings.Count(body, "<entry>") != 1 || !strings.Contains(body, "2 books") {
+		t.Errorf("authors index should have one group with 2 books: %s", body)
+	}
+
+	_, body = get(t, h, "/opds/all/new")
+	if i, j := strings.Index(body, "New Book"), strings.Index(body, "Old Book"); i < 0 || j < 0 || i > j {
+		t.Errorf("recent books not newest first: %s", body)
+	}
+
+	// Storing a new tree invalidates the memoized views.
+	putBooks(fc, book("other", "Other Book", "2024-01-01T00:00:00Z", "Mary Shelley", "Horror"))
+	_, body = get(t, h, "/opds/all/authors")
+	if !strings.Contains(body, "Mary Shelley") || strings.Contains(body, "Jane Austen") {
+		t.Errorf("authors index not rebuilt after Put: %s", body)
+	}
+}
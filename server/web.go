@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"html"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/madeddie/opds-aggregator/convert"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+//go:embed templates/feed.html
+var templateFS embed.FS
+
+var feedTemplate = template.Must(template.ParseFS(templateFS, "templates/feed.html"))
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// maxSummaryRunes caps the length of entry summaries on HTML pages.
+const maxSummaryRunes = 400
+
+// webContext marks a request served under /web, whose feed is rendered as
+// an HTML page instead of OPDS.
+type webContext struct {
+	siteTitle string
+}
+
+// WebOutput returns middleware that makes the OPDS handlers behind it render
+// HTML pages for browsers. The handlers build the same feeds as for
+// e-readers; only the final serialization and the link targets differ.
+func (h *Handler) WebOutput(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wc := webContext{siteTitle: h.current().cfg.Server.Title}
+		ctx := context.WithValue(r.Context(), webContextKey, wc)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func webFromContext(ctx context.Context) (webContext, bool) {
+	wc, ok := ctx.Value(webContextKey).(webContext)
+	return wc, ok
+}
+
+// webPage is the data for the feed template.
+type webPage struct {
+	SiteTitle string
+	Title     string
+	Search    *webSearch
+	Facets    []webFacetGroup
+	Entries   []webEntry
+	Pages     []webLink
+}
+
+type webSearch struct {
+	Action string
+	Hidden []webParam
+	Query  string
+}
+
+type webParam struct {
+	Name, Value string
+}
+
+type webFacetGroup struct {
+	Name  string
+	Links []webLink
+}
+
+type webLink struct {
+	Href   string
+	Title  string
+	Rel    string
+	Count  int
+	Active bool
+}
+
+type webEntry struct {
+	Title     string
+	Href      string // navigation target, if the entry links to another feed
+	Cover     string
+	Meta      string
+	Summary   string
+	Downloads []webLink
+}
+
+// writeHTML renders feed as an HTML page.
+func writeHTML(w http.ResponseWriter, r *http.Request, wc webContext, feed *opds.Feed, logger *slog.Logger) {
+	page := webPage{
+		SiteTitle: wc.siteTitle,
+		Title:     feed.Title,
+		Search:    webSearchForm(feed, r.URL.Query().Get("q")),
+	}
+
+	facetIndex := make(map[string]int)
+	for _, l := range feed.Links {
+		switch l.Rel {
+		case opds.RelFacet:
+			group := l.FacetGroup
+			if group == "" {
+				group = "Filter"
+			}
+			i, ok := facetIndex[group]
+			if !ok {
+				i = len(page.Facets)
+				facetIndex[group] = i
+				page.Facets = append(page.Facets, webFacetGroup{Name: group})
+			}
+			page.Facets[i].Links = append(page.Facets[i].Links, webLink{
+				Href:   webHref(l.Href),
+				Title:  l.Title,
+				Count:  l.Count,
+				Active: l.ActiveFacet == "true",
+			})
+		case opds.RelFirst, opds.RelPrevious, opds.RelNext, opds.RelLast:
+			page.Pages = append(page.Pages, webLink{Href: webHref(l.Href), Title: pageTitles[l.Rel], Rel: l.Rel})
+		}
+	}
+
+	for _, e := range feed.Entries {
+		page.Entries = append(page.Entries, newWebEntry(e))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := feedTemplate.Execute(w, page); err != nil {
+		logger.Error("failed to write HTML response", "error", err)
+	}
+}
+
+var pageTitles = map[string]string{
+	opds.RelFirst:    "« First",
+	opds.RelPrevious: "‹ Previous",
+	opds.RelNext:     "Next ›",
+	opds.RelLast:     "Last »",
+}
+
+func newWebEntry(e opds.Entry) webEntry {
+	we := webEntry{Title: e.Title}
+
+	var authors []string
+	for _, a := range e.Authors {
+		authors = append(authors, a.Name)
+	}
+	meta := strings.Join(authors, ", ")
+	if sources := entrySourceNames(e); len(sources) > 0 {
+		if meta != "" {
+			meta += " · "
+		}
+		meta += strings.Join(sources, ", ")
+	}
+	we.Meta = meta
+
+	text := e.Summary
+	if text == nil {
+		text = e.Content
+	}
+	if text != nil {
+		we.Summary = plainText(text)
+	}
+
+	var image string
+	for _, l := range e.Links {
+		switch {
+		case l.Rel == opds.RelThumbnail:
+			we.Cover = l.Href
+		case l.Rel == opds.RelImage:
+			image = l.Href
+		case isAcquisitionRel(l.Rel):
+			we.Downloads = append(we.Downloads, webLink{Href: l.Href, Title: downloadTitle(l)})
+		case we.Href == "" && (opds.IsNavigationRel(l.Rel) || isOPDSFeedType(l.Type)):
+			we.Href = webHref(l.Href)
+		}
+	}
+	if we.Cover == "" {
+		we.Cover = image
+	}
+	return we
+}
+
+// webSearchForm builds the search box for a page: the feed's own search link
+// (e.g. a source's upstream search) if it has one, otherwise the search
+// across all sources.
+func webSearchForm(feed *opds.Feed, query string) *webSearch {
+	form := &webSearch{Action: "/web/search", Query: query}
+	sl := feed.SearchLink()
+	if sl == nil {
+		return form
+	}
+	u, err := url.Parse(sl.Href)
+	if err != nil || !isAggregatorPath(u.Path) {
+		return form
+	}
+	form.Action = webHref(u.Path)
+	for name, values := range u.Query() {
+		if name == "q" {
+			continue
+		}
+		for _, v := range values {
+			form.Hidden = append(form.Hidden, webParam{Name: name, Value: v})
+		}
+	}
+	return form
+}
+
+// webHref maps an aggregator catalog path to its HTML counterpart under /web.
+// Downloads and links outside the catalog are left untouched.
+func webHref(href string) string {
+	switch {
+	case strings.HasPrefix(href, "/opds/download/"):
+		return href
+	case href == "/opds":
+		return "/web/"
+	case strings.HasPrefix(href, "/opds/"), strings.HasPrefix(href, "/opds?"):
+		return "/web" + strings.TrimPrefix(href, "/opds")
+	}
+	return href
+}
+
+// downloadTitle labels an acquisition link: its own title if it has one,
+// otherwise the format name derived from its media type.
+func downloadTitle(l opds.Link) string {
+	if l.Title != "" {
+		return l.Title
+	}
+	if f, ok := convert.ForMediaType(l.Type); ok {
+		return strings.ToUpper(f.Name)
+	}
+	if mt, _, err := mime.ParseMediaType(l.Type); err == nil {
+		_, sub, _ := strings.Cut(mt, "/")
+		return strings.ToUpper(sub)
+	}
+	return "Download"
+}
+
+// plainText returns the text of an Atom text construct with markup removed,
+// whitespace collapsed and the length capped.
+func plainText(t *opds.Text) string {
+	s := t.Body
+	if t.Type == "html" || t.Type == "xhtml" {
+		s = html.UnescapeString(tagPattern.ReplaceAllString(s, " "))
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > maxSummaryRunes {
+		s = string([]rune(s)[:maxSummaryRunes]) + "…"
+	}
+	return s
+}
+
+// entrySourceNames returns the labels of the source categories that merged
+// views and search results tag entries with.
+func entrySourceNames(e opds.Entry) []string {
+	var names []string
+	for _, c := range e.Categories {
+		if c.Scheme == opds.SchemeSource {
+			names = append(names, c.Label)
+		}
+	}
+	return names
+}
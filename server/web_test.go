@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/madeddie/opds-aggregator/cache"
+	"github.com/madeddie/opds-aggregator/config"
+	"github.com/madeddie/opds-aggregator/crawler"
+	"github.com/madeddie/opds-aggregator/opds"
+)
+
+// browserAccept is the Accept header browsers send for page loads.
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func newWebServer(t *testing.T) http.Handler {
+	t.Helper()
+	logger := slog.New(slog.DiscardHandler)
+	cfg := &config.Config{Feeds: []config.FeedConfig{
+		{Name: "Books <&> Co", URL: "http://upstream.example/opds"},
+	}}
+	cfg.Server.Title = "My <Library>"
+	fc := cache.NewFeedCache(logger, nil)
+	fc.Put(cfg.Feeds[0].Slug(), &crawler.FeedTree{
+		Feed: &opds.Feed{ID: "root", Title: "Root", Entries: []opds.Entry{
+			{
+				ID:    "fiction",
+				Title: "<b>Fiction</b>",
+				Links: []opds.Link{{Rel: opds.RelSubsection, Href: "/opds/fiction", Type: opds.MediaTypeAtom}},
+			},
+			{
+				ID:    "dune",
+				Title: `Dune <script>alert("x")</script>`,
+				Links: []opds.Link{{Rel: opds.RelAcquisition, Href: "/books/dune.epub", Type: "application/epub+zip"}},
+			},
+		}},
+		URL:      "http://upstream.example/opds",
+		Children: make(map[string]*crawler.FeedTree),
+	})
+	h := NewHandler(cfg, fc, nil, nil, nil, nil, nil, nil, logger)
+	return New(cfg, h, nil, logger).Handler
+}
+
+// browse requests target the way a browser would.
+func browse(t *testing.T, h http.Handler, target string) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Accept", browserAccept)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Result()
+}
+
+func TestWebRedirect(t *testing.T) {
+	resp := browse(t, newWebServer(t), "/")
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "/web/" {
+		t.Errorf("GET /: status %d, Location %q, want a redirect to /web/", resp.StatusCode, loc)
+	}
+}
+
+func TestWebPages(t *testing.T) {
+	srv := newWebServer(t)
+	slug := "books-co"
+
+	tests := []struct {
+		target   string
+		contains []string
+		excludes []string
+	}{
+		{
+			target:   "/web",
+			contains: []string{`<a href="/web/source/` + slug + `/">`},
+		},
+		{
+			target: "/web/",
+			contains: []string{
+				`<title>My &lt;Library&gt; · My &lt;Library&gt;</title>`,
+				`<a href="/web/source/` + slug + `/">Books &lt;&amp;&gt; Co</a>`,
+				`action="/web/search"`,
+			},
+			excludes: []string{"<Library>", "Books <&> Co", `href="/opds`},
+		},
+		{
+			target: "/web/source/" + slug + "/",
+			contains: []string{
+				`<a href="/web/source/` + slug + `/fiction">&lt;b&gt;Fiction&lt;/b&gt;</a>`,
+				`Dune &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`,
+				`href="/opds/download/` + slug + `?`,
+			},
+			excludes: []string{"<b>Fiction", "<script>alert", `href="/opds/source`},
+		},
+	}
+	for _, tt := range tests {
+		resp := browse(t, srv, tt.target)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: status = %d, want 200", tt.target, resp.StatusCode)
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("GET %s: Content-Type = %q, want HTML", tt.target, ct)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(string(body), s) {
+				t.Errorf("GET %s: page lacks %s", tt.target, s)
+			}
+		}
+		for _, s := range tt.excludes {
+			if strings.Contains(string(body), s) {
+				t.Errorf("GET %s: page contains %s", tt.target, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package thumb downscales cover images and re-encodes them as JPEG,
+// optionally in grayscale for e-ink readers.
+package thumb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"mime"
+
+	// Decoders for the cover formats found in OPDS catalogs.
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+)
+
+// ContentType is the media type of every generated thumbnail.
+const ContentType = "image/jpeg"
+
+// Decodes reports whether Resize can decode images of the given media type.
+// Images of other types are served unchanged by callers.
+func Decodes(mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return false
+	}
+	switch mt {
+	case "image/jpeg", "image/jpg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// DefaultQuality is the JPEG quality used when Options.Quality is zero.
+const DefaultQuality = 75
+
+// MaxPixels bounds the size of the images Resize decodes: a small but
+// highly compressed file can declare dimensions whose decoded pixels would
+// take gigabytes of memory.
+const MaxPixels = 25_000_000
+
+// Options controls how an image is transformed.
+type Options struct {
+	Width     int  // maximum width in pixels (0 = unbounded)
+	Height    int  // maximum height in pixels (0 = unbounded)
+	Grayscale bool // convert to 8-bit grayscale
+	Quality   int  // JPEG quality 1-100 (0 = DefaultQuality)
+}
+
+// Resize decodes an image, scales it to fit within the box given by opts
+// while keeping its aspect ratio, and returns it encoded as JPEG. Images are
+// never enlarged, but they are still transcoded. Images with more than
+// MaxPixels pixels are rejected before they are decoded.
+func Resize(data []byte, opts Options) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("thumb: decode: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, fmt.Errorf("thumb: image of %dx%d pixels exceeds the limit of %d", cfg.Width, cfg.Height, MaxPixels)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("thumb: decode: %w", err)
+	}
+
+	w, h := fit(src.Bounds().Dx(), src.Bounds().Dy(), opts.Width, opts.Height)
+	rect := image.Rect(0, 0, w, h)
+	var dst draw.Image
+	if opts.Grayscale {
+		dst = image.NewGray(rect)
+	} else {
+		dst = image.NewRGBA(rect)
+	}
+	// JPEG has no alpha channel: flatten transparent covers onto white.
+	draw.Draw(dst, rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, rect, src, src.Bounds(), draw.Over, nil)
+
+	quality := opts.Quality
+	if quality <= 0 || quality > 100 {
+		quality = DefaultQuality
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("thumb: encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// fit returns the largest size with the aspect ratio of w×h that fits
+// within maxW×maxH, without enlarging.
+func fit(w, h, maxW, maxH int) (int, int) {
+	if w <= 0 || h <= 0 {
+		return 1, 1
+	}
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	nw, nh := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	return max(nw, 1), max(nh, 1)
+}
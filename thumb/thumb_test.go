@@ -0,0 +1,96 @@
+package thumb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{600, 800, 300, 400, 300, 400},
+		{600, 800, 300, 0, 300, 400},
+		{600, 800, 0, 200, 150, 200},
+		{600, 800, 0, 0, 600, 800},
+		{100, 100, 300, 400, 100, 100},
+		{1000, 100, 200, 200, 200, 20},
+		{3000, 1, 100, 100, 100, 1},
+		{0, 100, 50, 50, 1, 1},
+	}
+	for _, tt := range tests {
+		w, h := fit(tt.w, tt.h, tt.maxW, tt.maxH)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("fit(%d, %d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.maxW, tt.maxH, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 80))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	src.Set(0, 0, color.RGBA{R: 0xff, A: 0xff})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Resize(buf.Bytes(), Options{Width: 20, Height: 20, Grayscale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || img.Bounds().Dx() != 10 || img.Bounds().Dy() != 20 {
+		t.Errorf("got %s %v, want jpeg 10x20", format, img.Bounds())
+	}
+}
+
+func TestResizeRejects(t *testing.T) {
+	// A GIF header declaring a 65535×65535 image: a few bytes that would
+	// decode to gigabytes of pixels.
+	bomb := []byte("GIF89a\xff\xff\xff\xff\x80\x00\x00\x00\x00\x00\xff\xff\xff;")
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"too many pixels", bomb, "exceeds the limit"},
+		{"not an image", []byte("<svg/>"), "decode"},
+		{"empty", nil, "decode"},
+	}
+	for _, tt := range tests {
+		if _, err := Resize(tt.data, Options{Width: 100}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecodes(t *testing.T) {
+	tests := []struct {
+		mediaType string
+		want      bool
+	}{
+		{"image/jpeg", true},
+		{"image/PNG", true},
+		{"image/webp; q=0.9", true},
+		{"image/gif", true},
+		{"image/svg+xml", false},
+		{"image/avif", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Decodes(tt.mediaType); got != tt.want {
+			t.Errorf("Decodes(%q) = %t, want %t", tt.mediaType, got, tt.want)
+		}
+	}
+}